@@ -1,6 +1,17 @@
 package application
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
 	"github.com/lelandbatey/omegadoc/domain"
 
 	log "github.com/sirupsen/logrus"
@@ -11,6 +22,12 @@ type OmegaDocController struct {
 	parser domain.DocParser
 	pprocs []domain.Postprocessor
 	placer domain.DocPlacer
+	// diagout is where the Diagnostics found while parsing are printed.
+	diagout io.Writer
+	// workers is the most files parsed at once.
+	workers int
+	// cache, if set, remembers what was parsed from each file on disk.
+	cache domain.DocCache
 }
 
 func NewController(
@@ -19,32 +36,253 @@ func NewController(
 	pprocs []domain.Postprocessor,
 	placer domain.DocPlacer) OmegaDocController {
 	return OmegaDocController{
-		finder: finder,
-		parser: parser,
-		pprocs: pprocs,
-		placer: placer,
+		finder:  finder,
+		parser:  parser,
+		pprocs:  pprocs,
+		placer:  placer,
+		diagout: os.Stderr,
+		workers: runtime.NumCPU(),
 	}
 }
 
-func (odcc OmegaDocController) GenerateOmegaTree(inpath, outpath string) error {
-	log.Debug("Beginnning operation")
-	readers, err := odcc.finder.FindReaders(inpath)
+// WithDiagnosticsOutput returns a copy of the controller which prints
+// Diagnostics to w instead of to stderr.
+func (odcc OmegaDocController) WithDiagnosticsOutput(w io.Writer) OmegaDocController {
+	odcc.diagout = w
+	return odcc
+}
+
+// WithWorkers returns a copy of the controller which parses up to workers
+// files at once, each of which is open only while it's parsed. By default
+// this is the number of CPUs.
+func (odcc OmegaDocController) WithWorkers(workers int) OmegaDocController {
+	if workers > 0 {
+		odcc.workers = workers
+	}
+	return odcc
+}
+
+// WithCache returns a copy of the controller which remembers what's parsed
+// from each file on disk in cache, and which doesn't parse files again which
+// cache shows haven't changed.
+func (odcc OmegaDocController) WithCache(cache domain.DocCache) OmegaDocController {
+	odcc.cache = cache
+	return odcc
+}
+
+// parseSource opens, parses and closes a single source, unless the cache
+// has what was parsed from it.
+func (odcc OmegaDocController) parseSource(src domain.DocSource) ([]domain.OmegaDoc, []domain.Diagnostic) {
+	readError := func(err error) domain.Diagnostic {
+		return domain.Diagnostic{
+			SourceFilePath: src.Path,
+			Severity:       domain.SeverityError,
+			Code:           domain.DiagReadError,
+			Message:        err.Error(),
+		}
+	}
+	var info os.FileInfo
+	if odcc.cache != nil && src.Stat != nil {
+		if fi, err := src.Stat(); err == nil {
+			info = fi
+			if odocs, diags, ok := odcc.cache.Lookup(src.Path, info, ""); ok {
+				return odocs, diags
+			}
+		}
+	}
+	rdr, err := src.Open()
+	if err != nil {
+		return nil, []domain.Diagnostic{readError(err)}
+	}
+	defer func() { rdr.Close() }()
+	var hash string
+	if info != nil {
+		// The file may have been modified without its contents changing,
+		// which the hash of its contents shows. The file is read through
+		// once for the hash, then read again from the start to be parsed.
+		h := sha256.New()
+		if _, err := io.Copy(h, rdr); err != nil {
+			return nil, []domain.Diagnostic{readError(err)}
+		}
+		hash = hex.EncodeToString(h.Sum(nil))
+		if odocs, diags, ok := odcc.cache.Lookup(src.Path, info, hash); ok {
+			return odocs, diags
+		}
+		if seeker, ok := rdr.(io.Seeker); ok {
+			_, err = seeker.Seek(0, io.SeekStart)
+		} else {
+			var reopened io.ReadCloser
+			if reopened, err = src.Open(); err == nil {
+				rdr.Close()
+				rdr = reopened
+			}
+		}
+		if err != nil {
+			return nil, []domain.Diagnostic{readError(err)}
+		}
+	}
+	var data io.Reader = rdr
+	if _, ok := rdr.(io.Seeker); !ok {
+		// An include directive makes the parser read the source again.
+		data = domain.NewReopener(rdr, src.Open)
+	}
+	odocs, diags, err := odcc.parser.ParseDoc(src.Path, data)
+	if err != nil {
+		// A file which can't be parsed shouldn't prevent the OmegaDocs
+		// in every other file from being collected.
+		return nil, append(diags, readError(err))
+	}
+	if info != nil {
+		odcc.cache.Store(src.Path, info, hash, odocs, diags)
+	}
+	return odocs, diags
+}
+
+// closeSource closes src once it won't be read again, if it keeps anything
+// open.
+func closeSource(src domain.DocSource) {
+	if src.Close == nil {
+		return
+	}
+	if err := src.Close(); err != nil {
+		log.WithField("path", src.Path).Warnf("cannot close source: %v", err)
+	}
+}
+
+// parseSources parses every source with up to odcc.workers at once, closing
+// each once it's parsed. The OmegaDocs are returned in the order of the
+// sources they came from.
+func (odcc OmegaDocController) parseSources(sources []domain.DocSource) ([]domain.OmegaDoc, []domain.Diagnostic) {
+	type parsed struct {
+		odocs []domain.OmegaDoc
+		diags []domain.Diagnostic
+	}
+	results := make([]parsed, len(sources))
+	todo := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < odcc.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				results[i].odocs, results[i].diags = odcc.parseSource(sources[i])
+				closeSource(sources[i])
+			}
+		}()
+	}
+	for i := range sources {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+
+	odocs := []domain.OmegaDoc{}
+	diags := []domain.Diagnostic{}
+	for _, res := range results {
+		odocs = append(odocs, res.odocs...)
+		diags = append(diags, res.diags...)
+	}
+	return odocs, diags
+}
+
+// withinPath reports whether p is dir or is beneath it.
+func withinPath(p, dir string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// ownedBy reports whether the source at srcpath belongs to roots[idx], rather
+// than to another of roots nested within roots[idx] which contains srcpath as
+// well. Each source belongs only to the innermost root containing it.
+func ownedBy(srcpath string, roots []domain.InputRoot, idx int) bool {
+	for i, other := range roots {
+		if i == idx || len(other.Path) <= len(roots[idx].Path) {
+			continue
+		}
+		if withinPath(other.Path, roots[idx].Path) && withinPath(srcpath, other.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+// rootSources returns the sources which belong to roots[idx].
+func (odcc OmegaDocController) rootSources(roots []domain.InputRoot, idx int) ([]domain.DocSource, error) {
+	found, err := odcc.finder.FindSources(roots[idx].Path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	sources := []domain.DocSource{}
+	for _, src := range found {
+		if ownedBy(src.Path, roots, idx) {
+			log.Infof("Found source: %s", src.Path)
+			sources = append(sources, src)
+		} else {
+			closeSource(src)
+		}
+	}
+	return sources, nil
+}
+
+// setRoot sets the Root of each of odocs to root, prefixing their
+// DestFilePath with its Prefix.
+func setRoot(odocs []domain.OmegaDoc, root *domain.InputRoot) {
+	for i := range odocs {
+		odocs[i].Root = root
+		if root.Prefix != "" {
+			odocs[i].DestFilePath = path.Join(root.Prefix, odocs[i].DestFilePath)
+		}
+	}
+}
+
+// saveCache saves the cache, if there is one.
+func (odcc OmegaDocController) saveCache() {
+	if odcc.cache != nil {
+		if err := odcc.cache.Save(); err != nil {
+			log.Warnf("cannot save the cache of parsed files: %v", err)
+		}
 	}
-	for srcpath := range readers {
-		log.Infof("Found reader: %s", srcpath)
+}
+
+// placeError returns the Diagnostic for an OmegaDoc which couldn't be placed.
+func placeError(odoc domain.OmegaDoc, err error) domain.Diagnostic {
+	return domain.Diagnostic{
+		SourceFilePath: odoc.SourceFilePath,
+		Line:           odoc.StartLineNumber + 1,
+		Severity:       domain.SeverityError,
+		Code:           domain.DiagPlaceError,
+		Message:        err.Error(),
 	}
+}
+
+func (odcc OmegaDocController) GenerateOmegaTree(inpath, outpath string) error {
+	return odcc.GenerateOmegaTreeFromRoots([]domain.InputRoot{{Path: inpath}}, outpath)
+}
 
+// GenerateOmegaTreeFromRoots is GenerateOmegaTree for several input roots at
+// once. The DestFilePath of each OmegaDoc begins with the Prefix of the root
+// it was found beneath, and when roots are nested, each file belongs only to
+// the innermost root containing it.
+func (odcc OmegaDocController) GenerateOmegaTreeFromRoots(roots []domain.InputRoot, outpath string) error {
+	log.Debug("Beginnning operation")
+	roots = append([]domain.InputRoot{}, roots...)
 	odocs := []domain.OmegaDoc{}
-	for srcpath, rdr := range readers {
-		newodocs, err := odcc.parser.ParseDoc(srcpath, rdr)
+	diags := []domain.Diagnostic{}
+	sourcecount := 0
+	for idx := range roots {
+		sources, err := odcc.rootSources(roots, idx)
 		if err != nil {
 			return err
 		}
-		odocs = append(odocs, newodocs...)
+		sourcecount += len(sources)
+
+		rootdocs, rootdiags := odcc.parseSources(sources)
+		setRoot(rootdocs, &roots[idx])
+		odocs = append(odocs, rootdocs...)
+		diags = append(diags, rootdiags...)
 	}
+	odcc.saveCache()
 
+	var err error
 	for _, pproc := range odcc.pprocs {
 		odocs, err = pproc.Postprocess(odocs)
 		if err != nil {
@@ -52,16 +290,38 @@ func (odcc OmegaDocController) GenerateOmegaTree(inpath, outpath string) error {
 		}
 	}
 
-	if len(readers) > len(odocs) {
-		skipped := len(readers) - len(odocs)
-		log.Infof("Some files with potential OmegaDocs in them were ignored, count of ignored: %d, count of files with potential OmegaDocs: %d", skipped, len(readers))
+	if sourcecount > len(odocs) {
+		skipped := sourcecount - len(odocs)
+		log.Infof("Some files with potential OmegaDocs in them were ignored, count of ignored: %d, count of files with potential OmegaDocs: %d", skipped, sourcecount)
 	}
 
 	for _, odoc := range odocs {
 		err := odcc.placer.PlaceDoc(outpath, odoc)
 		if err != nil {
-			return err
+			diags = append(diags, placeError(odoc, err))
 		}
 	}
+	return odcc.reportDiagnostics(diags)
+}
+
+// reportDiagnostics prints all diagnostics in a compiler-style format,
+// returning an error if any of them are errors.
+func (odcc OmegaDocController) reportDiagnostics(diags []domain.Diagnostic) error {
+	domain.SortDiagnostics(diags)
+	errcount, warncount := 0, 0
+	for _, d := range diags {
+		fmt.Fprintln(odcc.diagout, d.String())
+		if d.Severity == domain.SeverityError {
+			errcount++
+		} else {
+			warncount++
+		}
+	}
+	if errcount > 0 {
+		return fmt.Errorf("found %d error(s) and %d warning(s) while extracting OmegaDocs", errcount, warncount)
+	}
+	if warncount > 0 {
+		log.Warnf("found %d warning(s) while extracting OmegaDocs", warncount)
+	}
 	return nil
 }
@@ -0,0 +1,95 @@
+package application_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lelandbatey/omegadoc/application"
+	"github.com/lelandbatey/omegadoc/doccache"
+	"github.com/lelandbatey/omegadoc/docfinder"
+	"github.com/lelandbatey/omegadoc/docparser"
+	"github.com/lelandbatey/omegadoc/docplacer"
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// countingParser counts the files it parses.
+type countingParser struct {
+	domain.DocParser
+	count *int32
+}
+
+func (cp countingParser) ParseDoc(srcpath string, data io.Reader) ([]domain.OmegaDoc, []domain.Diagnostic, error) {
+	atomic.AddInt32(cp.count, 1)
+	return cp.DocParser.ParseDoc(srcpath, data)
+}
+
+func TestGenerateOmegaTreeCached(t *testing.T) {
+	lvl := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(lvl)
+
+	dir := t.TempDir()
+	inpath, cachedir := filepath.Join(dir, "in"), filepath.Join(dir, "cache")
+	old := time.Now().Add(-time.Minute)
+	write := func(name, body string) {
+		p := filepath.Join(inpath, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		def := domain.START_OMEGADOC + "EOD docs/" + name + "\n" + body + "\nEOD\n"
+		require.NoError(t, os.WriteFile(p, []byte(def), 0644))
+		require.NoError(t, os.Chtimes(p, old, old))
+	}
+	write("a.md", "a")
+	write("b.md", "b")
+
+	var count int32
+	run := func(run int) {
+		dc, err := doccache.NewDocCache(cachedir, docparser.Version)
+		require.NoError(t, err)
+		outpath := filepath.Join(dir, "out", fmt.Sprint(run))
+		odcc := application.NewController(
+			docfinder.NewDocFinder(),
+			countingParser{DocParser: docparser.NewDocParser(), count: &count},
+			nil,
+			docplacer.NewDocPlacer(),
+		).WithDiagnosticsOutput(&bytes.Buffer{}).WithCache(dc)
+		require.NoError(t, odcc.GenerateOmegaTree(inpath, outpath))
+	}
+	read := func(run int, name string) string {
+		contents, err := os.ReadFile(filepath.Join(dir, "out", fmt.Sprint(run), "docs", name))
+		require.NoError(t, err)
+		return string(contents)
+	}
+
+	run(1)
+	require.EqualValues(t, 2, count)
+	// Nothing changed, so nothing is parsed.
+	run(2)
+	require.EqualValues(t, 2, count)
+	require.Equal(t, "a\n", read(2, "a.md"))
+	// Only the changed file is parsed again.
+	write("b.md", "b changed")
+	run(3)
+	require.EqualValues(t, 3, count)
+	require.Equal(t, "a\n", read(3, "a.md"))
+	require.Equal(t, "b changed\n", read(3, "b.md"))
+	// A file which was only touched is hashed, but not parsed again, while
+	// one whose hash differs is read again from the start to be parsed.
+	touched := time.Now().Add(-30 * time.Second)
+	write("b.md", "b CHANGED")
+	for _, name := range []string{"a.md", "b.md"} {
+		require.NoError(t, os.Chtimes(filepath.Join(inpath, name), touched, touched))
+	}
+	run(4)
+	require.EqualValues(t, 4, count)
+	require.Equal(t, "a\n", read(4, "a.md"))
+	require.Equal(t, "b CHANGED\n", read(4, "b.md"))
+}
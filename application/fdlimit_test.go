@@ -0,0 +1,64 @@
+//go:build !windows
+// +build !windows
+
+package application_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/application"
+	"github.com/lelandbatey/omegadoc/docfinder"
+	"github.com/lelandbatey/omegadoc/docparser"
+	"github.com/lelandbatey/omegadoc/docplacer"
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TestGenerateOmegaTreeBeyondFDLimit scans more files than the process may
+// have open at once, which only works if each file is closed once parsed.
+func TestGenerateOmegaTreeBeyondFDLimit(t *testing.T) {
+	const fdlimit = 64
+	var lim syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim))
+	if lim.Cur > fdlimit {
+		lowered := lim
+		lowered.Cur = fdlimit
+		require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered))
+		defer syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim)
+	}
+	lvl := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(lvl)
+
+	dir := t.TempDir()
+	inpath, outpath := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	const count = 4 * fdlimit
+	for i := 0; i < count; i++ {
+		p := filepath.Join(inpath, fmt.Sprintf("d%02d", i%10), fmt.Sprintf("f%03d.md", i))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		def := fmt.Sprintf("%sEOD docs/%03d.md\nbody %d\nEOD\n", domain.START_OMEGADOC, i, i)
+		require.NoError(t, os.WriteFile(p, []byte(def), 0644))
+	}
+
+	diagout := &bytes.Buffer{}
+	odcc := application.NewController(
+		docfinder.NewDocFinder(docfinder.WithWorkers(8)),
+		docparser.NewDocParser(),
+		nil,
+		docplacer.NewDocPlacer(),
+	).WithDiagnosticsOutput(diagout).WithWorkers(8)
+	require.NoError(t, odcc.GenerateOmegaTree(inpath, outpath))
+	require.Empty(t, diagout.String())
+	for i := 0; i < count; i++ {
+		contents, err := os.ReadFile(filepath.Join(outpath, "docs", fmt.Sprintf("%03d.md", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("body %d\n", i), string(contents))
+	}
+}
@@ -0,0 +1,75 @@
+package application_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/application"
+	"github.com/lelandbatey/omegadoc/docfinder"
+	"github.com/lelandbatey/omegadoc/docparser"
+	"github.com/lelandbatey/omegadoc/docplacer"
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/lelandbatey/omegadoc/postprocess"
+	"github.com/stretchr/testify/require"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestGenerateOmegaTreeFromRoots(t *testing.T) {
+	lvl := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(lvl)
+
+	dir := t.TempDir()
+	def := func(dest, body string) string {
+		return domain.START_OMEGADOC + "EOD " + dest + "\n" + body + "\nEOD\n"
+	}
+	files := map[string]string{
+		"pay/a.go":        def("index.md", "payments"),
+		"pay/vendor/b.go": def("index.md", "vendored"),
+		"ship/c.go":       def("index.md", "shipping"),
+		"ship/d.go":       def("guide/d.md", "guide"),
+	}
+	for name, contents := range files {
+		p := filepath.Join(dir, "in", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0644))
+	}
+	roots := []domain.InputRoot{
+		{Path: filepath.Join(dir, "in", "pay"), Prefix: "payments"},
+		{Path: filepath.Join(dir, "in", "ship"), Prefix: "shipping"},
+		// Files beneath a root nested in another belong only to the inner
+		// root.
+		{Path: filepath.Join(dir, "in", "pay", "vendor"), Prefix: "payments/vendor"},
+	}
+	outpath := filepath.Join(dir, "out")
+	diagout := &bytes.Buffer{}
+	odcc := application.NewController(
+		docfinder.NewDocFinder(),
+		docparser.NewDocParser(),
+		[]domain.Postprocessor{postprocess.GenerateSiteMap{}},
+		docplacer.NewDocPlacer(),
+	).WithDiagnosticsOutput(diagout)
+	require.NoError(t, odcc.GenerateOmegaTreeFromRoots(roots, outpath))
+	require.Empty(t, diagout.String())
+
+	for name, exp := range map[string]string{
+		"payments/index.md":        "payments\n",
+		"payments/vendor/index.md": "vendored\n",
+		"shipping/index.md":        "shipping\n",
+		"shipping/guide/d.md":      "guide\n",
+	} {
+		contents, err := os.ReadFile(filepath.Join(outpath, name))
+		require.NoError(t, err, name)
+		require.Equal(t, exp, string(contents), name)
+	}
+	index, err := os.ReadFile(filepath.Join(outpath, "index.md"))
+	require.NoError(t, err)
+	require.Equal(t, "\n# Sitemap\n\n"+
+		"## payments\n\n- [payments/](payments/)\n\t- [index.md](payments/index.md)\n\n"+
+		"## shipping\n\n- [shipping/](shipping/)\n\t- [index.md](shipping/index.md)\n\t- [guide/](shipping/guide/)\n\t\t- [d.md](shipping/guide/d.md)\n\n"+
+		"## payments/vendor\n\n- [payments/](payments/)\n\t- [vendor/](payments/vendor/)\n\t\t- [index.md](payments/vendor/index.md)\n\n",
+		string(index))
+}
@@ -0,0 +1,39 @@
+package application_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/docfinder"
+	"github.com/lelandbatey/omegadoc/docparser"
+	"github.com/stretchr/testify/require"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TestRepoSources checks that the only OmegaDocs within this repository are
+// its own documentation, beneath omegadoc/, so that examples of magic strings
+// in comments, tests and the README aren't extracted by mistake.
+func TestRepoSources(t *testing.T) {
+	lvl := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(lvl)
+
+	repo, err := filepath.Abs("..")
+	require.NoError(t, err)
+	sources, err := docfinder.NewDocFinder().FindSources(repo)
+	require.NoError(t, err)
+	parser := docparser.NewDefaultRegistry()
+	for _, src := range sources {
+		rc, err := src.Open()
+		require.NoError(t, err, src.Path)
+		odocs, diags, err := parser.ParseDoc(src.Path, rc)
+		rc.Close()
+		require.NoError(t, err, src.Path)
+		require.Empty(t, diags, src.Path)
+		for _, od := range odocs {
+			require.True(t, strings.HasPrefix(od.DestFilePath, "omegadoc/"), "%s extracts %s", src.Path, od.DestFilePath)
+		}
+	}
+}
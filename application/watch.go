@@ -0,0 +1,238 @@
+package application
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// watchState is what WatchOmegaTree knows of the output tree it keeps up to
+// date, so that each rebuild parses only the files which changed and writes
+// only the output files which changed.
+type watchState struct {
+	// sources holds the sources of each root found by the last rebuild, or
+	// nil if they weren't found.
+	sources [][]domain.DocSource
+	// parsed holds the OmegaDocs, with their Root set, parsed from each
+	// source found by the last rebuild.
+	parsed map[string][]domain.OmegaDoc
+	// placed holds the OmegaDoc placed at each output path by the last
+	// rebuild.
+	placed map[string]placedDoc
+}
+
+// placedDoc is an OmegaDoc placed in the output tree, along with the file
+// it was placed in as it was just after it was placed, or nil if that's
+// unknown.
+type placedDoc struct {
+	odoc domain.OmegaDoc
+	info os.FileInfo
+}
+
+// unchanged reports whether the file at finpath is still as it was just
+// after pd was placed in it, so that it needn't be placed again.
+func (pd placedDoc) unchanged(finpath string) bool {
+	if pd.info == nil {
+		return false
+	}
+	info, err := os.Stat(finpath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(info, pd.info) && info.Size() == pd.info.Size() && info.ModTime().Equal(pd.info.ModTime())
+}
+
+// affected reports whether the source at srcpath is, or is beneath, any of
+// the changed paths. A source within an archive is affected by changes to
+// the archive.
+func affected(srcpath string, changed []string) bool {
+	for _, p := range changed {
+		if withinPath(srcpath, p) || strings.HasPrefix(srcpath, p+domain.ArchiveSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceScope returns the paths beneath which the sources found may differ
+// after changes to the changed paths. A change to an ignore file may change
+// which of the files beside it, and beneath them, are searched.
+func sourceScope(changed []string) []string {
+	scope := []string{}
+	for _, p := range changed {
+		for _, name := range domain.IgnoreFileNames {
+			if filepath.Base(p) == name {
+				p = filepath.Dir(p)
+				break
+			}
+		}
+		scope = append(scope, p)
+	}
+	return scope
+}
+
+// updateSources returns the sources of roots[idx] once the paths in scope
+// have changed, given its sources prev before they changed. Only the paths
+// in scope are searched again, unless prev is nil or the finder can only
+// search whole roots.
+func (odcc OmegaDocController) updateSources(prev []domain.DocSource, roots []domain.InputRoot, idx int, scope []string) ([]domain.DocSource, error) {
+	pf, ok := odcc.finder.(domain.PathFinder)
+	if prev == nil || !ok {
+		return odcc.rootSources(roots, idx)
+	}
+	within := []string{}
+	for _, p := range scope {
+		if withinPath(p, roots[idx].Path) || withinPath(roots[idx].Path, p) {
+			within = append(within, p)
+		}
+	}
+	if len(within) == 0 {
+		return prev, nil
+	}
+	found, err := pf.FindSourcesWithin(roots[idx].Path, within)
+	if err != nil {
+		return nil, err
+	}
+	sources := []domain.DocSource{}
+	for _, src := range prev {
+		if !affected(src.Path, within) {
+			sources = append(sources, src)
+		}
+	}
+	for _, src := range found {
+		if ownedBy(src.Path, roots, idx) {
+			log.Infof("Found source: %s", src.Path)
+			sources = append(sources, src)
+		} else {
+			closeSource(src)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Path < sources[j].Path })
+	return sources, nil
+}
+
+// rebuild brings the output tree up to date. Only the changed paths are
+// searched for sources again, and only the sources which are new or
+// affected by the changed paths are parsed again. Every OmegaDoc is
+// postprocessed, but only output files whose contents changed, or which
+// were changed or removed since they were placed, are placed, and output
+// files which no OmegaDoc is placed at any longer are removed.
+func (odcc OmegaDocController) rebuild(state *watchState, roots []domain.InputRoot, outpath string, changed []string) []domain.Diagnostic {
+	parsed := map[string][]domain.OmegaDoc{}
+	odocs := []domain.OmegaDoc{}
+	diags := []domain.Diagnostic{}
+	scope := sourceScope(changed)
+	for idx := range roots {
+		sources, err := odcc.updateSources(state.sources[idx], roots, idx, scope)
+		state.sources[idx] = sources
+		if err != nil {
+			diags = append(diags, domain.Diagnostic{
+				SourceFilePath: roots[idx].Path,
+				Severity:       domain.SeverityError,
+				Code:           domain.DiagReadError,
+				Message:        err.Error(),
+			})
+			continue
+		}
+		todo := []domain.DocSource{}
+		for _, src := range sources {
+			if prev, ok := state.parsed[src.Path]; ok && !affected(src.Path, changed) {
+				// What was parsed before is kept, so the source isn't read.
+				closeSource(src)
+				parsed[src.Path] = prev
+				continue
+			}
+			parsed[src.Path] = []domain.OmegaDoc{}
+			todo = append(todo, src)
+		}
+		rootdocs, rootdiags := odcc.parseSources(todo)
+		setRoot(rootdocs, &roots[idx])
+		for _, od := range rootdocs {
+			parsed[od.SourceFilePath] = append(parsed[od.SourceFilePath], od)
+		}
+		diags = append(diags, rootdiags...)
+		for _, src := range sources {
+			odocs = append(odocs, parsed[src.Path]...)
+		}
+	}
+	odcc.saveCache()
+	state.parsed = parsed
+
+	var err error
+	for _, pproc := range odcc.pprocs {
+		odocs, err = pproc.Postprocess(odocs)
+		if err != nil {
+			log.Errorf("Postprocessor %s failed, the output is not updated: %v", pproc.Name(), err)
+			return diags
+		}
+	}
+
+	placed := map[string]placedDoc{}
+	for _, odoc := range odocs {
+		dest := strings.TrimPrefix(odoc.DestFilePath, "/")
+		if _, ok := placed[dest]; ok {
+			diags = append(diags, placeError(odoc, fmt.Errorf("another OmegaDoc is already placed at %q", dest)))
+			continue
+		}
+		finpath := filepath.Join(outpath, filepath.FromSlash(dest))
+		if prev, ok := state.placed[dest]; ok && prev.odoc.Contents == odoc.Contents && prev.unchanged(finpath) {
+			placed[dest] = placedDoc{odoc: odoc, info: prev.info}
+			continue
+		}
+		if err := odcc.placer.PlaceDoc(outpath, odoc); err != nil {
+			diags = append(diags, placeError(odoc, err))
+			continue
+		}
+		// Without knowing what the placed file looks like, it's placed
+		// again by the next rebuild.
+		info, _ := os.Stat(finpath)
+		placed[dest] = placedDoc{odoc: odoc, info: info}
+	}
+	for dest, prev := range state.placed {
+		if _, ok := placed[dest]; ok {
+			continue
+		}
+		if err := odcc.placer.RemoveDoc(outpath, prev.odoc); err != nil {
+			log.Warnf("cannot remove %q from the output: %v", dest, err)
+		}
+	}
+	state.placed = placed
+	return diags
+}
+
+// WatchOmegaTree generates the output tree as GenerateOmegaTreeFromRoots
+// does, then keeps it up to date until changes is closed. Each value
+// received from changes is a batch of paths, of files or directories, which
+// were created, modified or removed. When the finder is a
+// domain.PathFinder, only those paths are searched again, and whatever the
+// finder, only the files within them are parsed again, though
+// postprocessors always see every OmegaDoc. The output files of OmegaDocs
+// which no longer exist are removed. The placer must overwrite existing
+// files.
+//
+// The Diagnostics of each rebuild are reported, but unlike with
+// GenerateOmegaTree, errors don't stop the watch.
+func (odcc OmegaDocController) WatchOmegaTree(roots []domain.InputRoot, outpath string, changes <-chan []string) error {
+	roots = append([]domain.InputRoot{}, roots...)
+	state := &watchState{
+		sources: make([][]domain.DocSource, len(roots)),
+		parsed:  map[string][]domain.OmegaDoc{},
+		placed:  map[string]placedDoc{},
+	}
+	if err := odcc.reportDiagnostics(odcc.rebuild(state, roots, outpath, nil)); err != nil {
+		log.Error(err)
+	}
+	for changed := range changes {
+		log.Infof("Rebuilding after changes to %d path(s)", len(changed))
+		if err := odcc.reportDiagnostics(odcc.rebuild(state, roots, outpath, changed)); err != nil {
+			log.Error(err)
+		}
+	}
+	return nil
+}
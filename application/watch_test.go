@@ -0,0 +1,114 @@
+package application_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/application"
+	"github.com/lelandbatey/omegadoc/docfinder"
+	"github.com/lelandbatey/omegadoc/docparser"
+	"github.com/lelandbatey/omegadoc/docplacer"
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/lelandbatey/omegadoc/postprocess"
+	"github.com/stretchr/testify/require"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestWatchOmegaTree(t *testing.T) {
+	lvl := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(lvl)
+
+	dir := t.TempDir()
+	inpath, outpath := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+	write := func(name, dest, body string) string {
+		p := filepath.Join(inpath, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		def := domain.START_OMEGADOC + "EOD " + dest + "\n" + body + "\nEOD\n"
+		require.NoError(t, os.WriteFile(p, []byte(def), 0644))
+		return p
+	}
+	read := func(name string) string {
+		contents, err := os.ReadFile(filepath.Join(outpath, name))
+		require.NoError(t, err, name)
+		return string(contents)
+	}
+	write("a.go", "a.md", "a")
+	bpath := write("sub/b.go", "sub/b.md", "b")
+
+	var count int32
+	odcc := application.NewController(
+		docfinder.NewDocFinder(),
+		countingParser{DocParser: docparser.NewDocParser(), count: &count},
+		[]domain.Postprocessor{postprocess.GenerateSiteMap{}},
+		docplacer.NewDocPlacer(docplacer.WithOverwrite(true)),
+	).WithDiagnosticsOutput(&bytes.Buffer{})
+	changes := make(chan []string)
+	done := make(chan error)
+	go func() {
+		done <- odcc.WatchOmegaTree([]domain.InputRoot{{Path: inpath}}, outpath, changes)
+	}()
+	// Once an empty batch is received, the batch before it has been handled.
+	send := func(changed ...string) {
+		changes <- changed
+		changes <- nil
+	}
+
+	send()
+	require.EqualValues(t, 2, count)
+	require.Equal(t, "a\n", read("a.md"))
+	require.Equal(t, "b\n", read("sub/b.md"))
+	require.Contains(t, read("index.md"), "[b.md](sub/b.md)")
+
+	// Output files removed or changed by hand are placed again, though
+	// their sources haven't changed.
+	require.NoError(t, os.Remove(filepath.Join(outpath, "a.md")))
+	require.NoError(t, os.WriteFile(filepath.Join(outpath, "sub", "b.md"), []byte("edited\n"), 0644))
+	send()
+	require.EqualValues(t, 2, count)
+	require.Equal(t, "a\n", read("a.md"))
+	require.Equal(t, "b\n", read("sub/b.md"))
+
+	// Only the changed file is parsed again.
+	apath := write("a.go", "a.md", "a changed")
+	send(apath)
+	require.EqualValues(t, 3, count)
+	require.Equal(t, "a changed\n", read("a.md"))
+
+	// Only the changed paths are searched again, so a new file is only
+	// found once its path is among the changes.
+	cpath := write("c.go", "c.md", "c")
+	send()
+	require.EqualValues(t, 3, count)
+	send(cpath)
+	require.EqualValues(t, 4, count)
+	require.Equal(t, "c\n", read("c.md"))
+	require.Contains(t, read("index.md"), "[c.md](c.md)")
+
+	// The files within a new directory are found, and a change to an
+	// ignore file changes which of the files beside it are searched.
+	dpath := write("new/d.go", "d.md", "d")
+	ignpath := filepath.Join(inpath, ".omegadocignore")
+	require.NoError(t, os.WriteFile(ignpath, []byte("c.go\n"), 0644))
+	send(filepath.Dir(dpath), ignpath)
+	require.EqualValues(t, 5, count)
+	require.Equal(t, "d\n", read("d.md"))
+	_, err := os.Stat(filepath.Join(outpath, "c.md"))
+	require.True(t, os.IsNotExist(err))
+
+	// The output files of removed sources are removed, along with the
+	// directories they leave empty.
+	require.NoError(t, os.Remove(bpath))
+	send(filepath.Dir(bpath))
+	require.EqualValues(t, 5, count)
+	_, err = os.Stat(filepath.Join(outpath, "sub"))
+	require.True(t, os.IsNotExist(err))
+	require.False(t, strings.Contains(read("index.md"), "b.md"))
+
+	close(changes)
+	require.NoError(t, <-done)
+}
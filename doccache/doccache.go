@@ -0,0 +1,204 @@
+// doccache keeps what was parsed from each file on disk between runs, so
+// that files which haven't changed needn't be read or parsed again.
+package doccache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheFileName is the name of the file within the cache directory holding
+// the cache.
+const cacheFileName = "parsed.json"
+
+// formatVersion is the version of the layout of the cache file.
+const formatVersion = 1
+
+// racyWindow is how long after a file was last modified its modification
+// time is trusted to show that it's unchanged. A file modified again within
+// the resolution of the filesystem's timestamps may keep the same
+// modification time, so the contents of files parsed so soon after being
+// modified are checked by their hash instead.
+const racyWindow = 2 * time.Second
+
+// entry is what's remembered of a single file.
+type entry struct {
+	Size int64
+	// ModTime is the modification time of the file in nanoseconds since the
+	// Unix epoch.
+	ModTime int64
+	// Parsed is when the file was parsed, in nanoseconds since the Unix
+	// epoch.
+	Parsed int64
+	// Hash is the SHA-256 hash of the contents of the file, in hex.
+	Hash  string
+	Docs  []domain.OmegaDoc
+	Diags []domain.Diagnostic
+}
+
+// cacheFile is the layout of the file holding the cache.
+type cacheFile struct {
+	Format  int
+	Version string
+	Entries map[string]*entry
+}
+
+type docCache struct {
+	path    string
+	version string
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// used holds the paths of the entries looked up or stored since the
+	// cache was loaded.
+	used  map[string]bool
+	dirty bool
+}
+
+var _ domain.DocCache = &docCache{}
+
+// DefaultDir returns the directory in which the cache is kept by default,
+// within the user's cache directory.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "omegadoc"), nil
+}
+
+// NewDocCache returns a DocCache kept in the directory dir, which is created
+// if it doesn't exist. version identifies how files are parsed, such as
+// docparser.Version along with the options of the DocParser; whatever was
+// remembered under a different version is forgotten. A cache which can't be
+// read is started afresh.
+func NewDocCache(dir, version string) (domain.DocCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("cannot create cache directory %q: %w", dir, err)
+	}
+	dc := &docCache{
+		path:    filepath.Join(dir, cacheFileName),
+		version: version,
+		entries: map[string]*entry{},
+		used:    map[string]bool{},
+	}
+	data, err := os.ReadFile(dc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return dc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cache %q: %w", dc.path, err)
+	}
+	cf := cacheFile{}
+	if err := json.Unmarshal(data, &cf); err != nil {
+		log.WithField("path", dc.path).Warnf("cannot decode cache, starting afresh: %v", err)
+		return dc, nil
+	}
+	if cf.Format != formatVersion || cf.Version != version {
+		log.WithField("path", dc.path).Info("cache was written by another version, starting afresh")
+		return dc, nil
+	}
+	if cf.Entries != nil {
+		dc.entries = cf.Entries
+	}
+	return dc, nil
+}
+
+// copyResults returns copies of odocs and diags, so that neither the cache
+// nor its callers see changes the other makes to them.
+func copyResults(odocs []domain.OmegaDoc, diags []domain.Diagnostic) ([]domain.OmegaDoc, []domain.Diagnostic) {
+	return append([]domain.OmegaDoc{}, odocs...), append([]domain.Diagnostic{}, diags...)
+}
+
+func (dc *docCache) Lookup(path string, info os.FileInfo, hash string) ([]domain.OmegaDoc, []domain.Diagnostic, bool) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	e, ok := dc.entries[path]
+	if !ok {
+		return nil, nil, false
+	}
+	dc.used[path] = true
+	if hash == "" {
+		modtime := info.ModTime().UnixNano()
+		if info.Size() != e.Size || modtime != e.ModTime || e.Parsed-e.ModTime < int64(racyWindow) {
+			return nil, nil, false
+		}
+	} else {
+		if hash != e.Hash {
+			return nil, nil, false
+		}
+		// The file was only touched, so remember when, and it needn't be
+		// read next time.
+		e.Size, e.ModTime, e.Parsed = info.Size(), info.ModTime().UnixNano(), time.Now().UnixNano()
+		dc.dirty = true
+	}
+	odocs, diags := copyResults(e.Docs, e.Diags)
+	return odocs, diags, true
+}
+
+func (dc *docCache) Store(path string, info os.FileInfo, hash string, odocs []domain.OmegaDoc, diags []domain.Diagnostic) {
+	odocs, diags = copyResults(odocs, diags)
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.entries[path] = &entry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Parsed:  time.Now().UnixNano(),
+		Hash:    hash,
+		Docs:    odocs,
+		Diags:   diags,
+	}
+	dc.used[path] = true
+	dc.dirty = true
+}
+
+// Save writes the cache file, replacing it at once so that a cache file is
+// never left half written. Files which no longer exist are forgotten.
+func (dc *docCache) Save() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for path := range dc.entries {
+		if dc.used[path] {
+			continue
+		}
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			delete(dc.entries, path)
+			dc.dirty = true
+		}
+	}
+	if !dc.dirty {
+		return nil
+	}
+	data, err := json.Marshal(cacheFile{Format: formatVersion, Version: dc.version, Entries: dc.entries})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dc.path), cacheFileName+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dc.path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	dc.dirty = false
+	return nil
+}
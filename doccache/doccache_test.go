@@ -0,0 +1,91 @@
+package doccache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocCache(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.md")
+	require.NoError(t, os.WriteFile(src, []byte("hello"), 0644))
+	// The file was last modified long enough ago for its modification time
+	// to be trusted.
+	old := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(src, old, old))
+	info, err := os.Stat(src)
+	require.NoError(t, err)
+	odocs := []domain.OmegaDoc{{SourceFilePath: src, DestFilePath: "a.md", Contents: "hi\n", HTTPUrl: "https://example.com/a.md#L1"}}
+	diags := []domain.Diagnostic{{SourceFilePath: src, Line: 1, Code: domain.DiagEmptyBody}}
+
+	cachedir := filepath.Join(dir, "cache")
+	dc, err := NewDocCache(cachedir, "v1")
+	require.NoError(t, err)
+	_, _, ok := dc.Lookup(src, info, "")
+	require.False(t, ok)
+	dc.Store(src, info, "hash", odocs, diags)
+	require.NoError(t, dc.Save())
+
+	dc, err = NewDocCache(cachedir, "v1")
+	require.NoError(t, err)
+	gotdocs, gotdiags, ok := dc.Lookup(src, info, "")
+	require.True(t, ok)
+	require.Equal(t, odocs, gotdocs)
+	require.Equal(t, diags, gotdiags)
+	// What's returned is a copy.
+	gotdocs[0].DestFilePath = "prefix/a.md"
+	gotdocs, _, _ = dc.Lookup(src, info, "")
+	require.Equal(t, "a.md", gotdocs[0].DestFilePath)
+
+	// A modified file is only known to be unchanged by its hash.
+	require.NoError(t, os.Chtimes(src, old.Add(time.Second), old.Add(time.Second)))
+	touched, err := os.Stat(src)
+	require.NoError(t, err)
+	_, _, ok = dc.Lookup(src, touched, "")
+	require.False(t, ok)
+	_, _, ok = dc.Lookup(src, touched, "other")
+	require.False(t, ok)
+	_, _, ok = dc.Lookup(src, touched, "hash")
+	require.True(t, ok)
+	_, _, ok = dc.Lookup(src, touched, "")
+	require.True(t, ok)
+
+	// A file modified just before it was parsed might be modified again
+	// without its modification time changing.
+	now := time.Now()
+	require.NoError(t, os.Chtimes(src, now, now))
+	recent, err := os.Stat(src)
+	require.NoError(t, err)
+	dc.Store(src, recent, "hash", odocs, diags)
+	_, _, ok = dc.Lookup(src, recent, "")
+	require.False(t, ok)
+	_, _, ok = dc.Lookup(src, recent, "hash")
+	require.True(t, ok)
+	require.NoError(t, dc.Save())
+
+	// Another version forgets everything.
+	dc, err = NewDocCache(cachedir, "v2")
+	require.NoError(t, err)
+	_, _, ok = dc.Lookup(src, touched, "hash")
+	require.False(t, ok)
+
+	// Files which no longer exist are forgotten once saved.
+	dc, err = NewDocCache(cachedir, "v1")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(src))
+	require.NoError(t, dc.Save())
+	dc, err = NewDocCache(cachedir, "v1")
+	require.NoError(t, err)
+	_, _, ok = dc.Lookup(src, touched, "hash")
+	require.False(t, ok)
+
+	// A corrupt cache is started afresh.
+	require.NoError(t, os.WriteFile(filepath.Join(cachedir, cacheFileName), []byte("{"), 0644))
+	_, err = NewDocCache(cachedir, "v1")
+	require.NoError(t, err)
+}
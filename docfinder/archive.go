@@ -0,0 +1,404 @@
+package docfinder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// archiveFinder finds the OmegaDocs in files on disk, like docfinder, and in
+// the files within archives on disk.
+type archiveFinder struct {
+	df       docfinder
+	excludes []gitignore.Pattern
+	includes gitignore.Matcher
+}
+
+// NewArchiveFinder returns a DocFinder which searches the files on disk just
+// as the DocFinder returned by NewDocFinder does, except that tar, gzipped
+// tar and zip archives, recognized by their names, are searched as
+// directories of the files within them. The path searched may itself be an
+// archive. Files within archives have paths such as
+// "/src/handoff.zip!/docs/a.md"; see domain.ArchiveSeparator.
+//
+// Archives are never extracted. The files within them are found by the
+// native search, whatever WithSearchFunc sets, reading each archive once. As
+// they're searched, the files containing magic strings, and archives within
+// archives, are copied into a single temporary spool file, from which their
+// DocSources read; the spool file is removed as soon as it's created, where
+// the operating system allows, and closed once every DocSource reading it is
+// closed. Archives within archives are opened up to the
+// depth set by WithArchiveDepth. The exclude and include
+// patterns apply to the paths of files within archives relative to their
+// archive, while ignore files within archives aren't read.
+func NewArchiveFinder(opts ...Option) domain.DocFinder {
+	af := archiveFinder{df: newDocFinder(opts...)}
+	af.excludes = parsePatterns(af.df.filter.excludes, nil)
+	if len(af.df.filter.includes) > 0 {
+		af.includes = gitignore.NewMatcher(parsePatterns(af.df.filter.includes, nil))
+	}
+	return af
+}
+
+// archiveFormat returns the format of the archive named name, one of "zip",
+// "tar" and "tgz", or "" if name isn't that of an archive.
+func archiveFormat(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tgz"
+	}
+	return ""
+}
+
+// opener opens a file, on disk or within an archive, for reading.
+type opener func() (io.ReadCloser, error)
+
+func fileOpener(path string) opener {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// entryReadCloser reads a file within an archive, closing the archive when
+// closed.
+type entryReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// archiveIter iterates over the regular files within an archive.
+type archiveIter struct {
+	// next returns the path and a reader of the next file within the
+	// archive, valid until next is called again, or io.EOF after the last.
+	next    func() (string, io.Reader, error)
+	closers []io.Closer
+}
+
+func (ai *archiveIter) Close() error {
+	var err error
+	for i := len(ai.closers) - 1; i >= 0; i-- {
+		if cerr := ai.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// sectionReadCloser reads a section of a spool file. Closing it leaves the
+// spool file open.
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error {
+	return nil
+}
+
+// readerAt returns rc as an io.ReaderAt along with its size, as zip archives
+// require. Files on disk and sections of the spool file are read in place,
+// while anything else is read into memory.
+func readerAt(rc io.ReadCloser) (io.ReaderAt, int64, error) {
+	switch r := rc.(type) {
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, info.Size(), nil
+	case sectionReadCloser:
+		return r.SectionReader, r.Size(), nil
+	}
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// openArchive opens the archive, of the given format, read by open.
+func openArchive(format string, open opener) (*archiveIter, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, err
+	}
+	ai := &archiveIter{closers: []io.Closer{rc}}
+	switch format {
+	case "zip":
+		ra, size, err := readerAt(rc)
+		if err != nil {
+			ai.Close()
+			return nil, err
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			ai.Close()
+			return nil, err
+		}
+		i := 0
+		ai.next = func() (string, io.Reader, error) {
+			for i < len(zr.File) {
+				f := zr.File[i]
+				i++
+				if !f.Mode().IsRegular() {
+					continue
+				}
+				r, err := f.Open()
+				if err != nil {
+					return "", nil, fmt.Errorf("cannot open %q: %w", f.Name, err)
+				}
+				ai.closers = append(ai.closers, r)
+				return f.Name, r, nil
+			}
+			return "", nil, io.EOF
+		}
+	case "tar", "tgz":
+		var r io.Reader = rc
+		if format == "tgz" {
+			gz, err := gzip.NewReader(rc)
+			if err != nil {
+				ai.Close()
+				return nil, err
+			}
+			ai.closers = append(ai.closers, gz)
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		ai.next = func() (string, io.Reader, error) {
+			for {
+				hdr, err := tr.Next()
+				if err != nil {
+					return "", nil, err
+				}
+				if hdr.FileInfo().Mode().IsRegular() {
+					return hdr.Name, tr, nil
+				}
+			}
+		}
+	default:
+		ai.Close()
+		return nil, fmt.Errorf("unknown archive format %q", format)
+	}
+	return ai, nil
+}
+
+// spool is a temporary file into which the files within archives are copied
+// as they're searched, so that their DocSources can read them without
+// reading their archives again.
+type spool struct {
+	f    *os.File
+	size int64
+
+	// refs counts the DocSources reading from the spool which aren't
+	// closed yet. The spool file is closed along with the last of them.
+	mu   sync.Mutex
+	refs int
+}
+
+func newSpool() (*spool, error) {
+	f, err := os.CreateTemp("", "omegadoc-archive-*")
+	if err != nil {
+		return nil, err
+	}
+	// The file stays readable through f once removed, and is then deleted
+	// when the program exits. Where an open file can't be removed, it's left
+	// in the temporary directory.
+	os.Remove(f.Name())
+	return &spool{f: f}, nil
+}
+
+// writer returns a writer appending to the spool, and a function which keeps
+// all that was written through it, returning an opener of it. Unless kept,
+// what was written is overwritten by the next writer.
+func (sp *spool) writer() (io.Writer, func() opener) {
+	start := sp.size
+	w := &offsetWriter{f: sp.f, off: start}
+	return w, func() opener {
+		sp.size = w.off
+		section := io.NewSectionReader(sp.f, start, w.off-start)
+		return func() (io.ReadCloser, error) {
+			return sectionReadCloser{io.NewSectionReader(section, 0, section.Size())}, nil
+		}
+	}
+}
+
+// closer returns a Close for a DocSource reading from the spool. Closing it
+// again has no effect.
+func (sp *spool) closer() func() error {
+	sp.mu.Lock()
+	sp.refs++
+	sp.mu.Unlock()
+	once := sync.Once{}
+	return func() error {
+		var err error
+		once.Do(func() {
+			sp.mu.Lock()
+			defer sp.mu.Unlock()
+			sp.refs--
+			if sp.refs == 0 {
+				err = sp.f.Close()
+			}
+		})
+		return err
+	}
+}
+
+// offsetWriter writes to f from off onward.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.f.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	return n, err
+}
+
+// cleanEntryName returns the name of a file within an archive as a relative
+// slash separated path.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (af archiveFinder) FindSources(srcpath string) ([]domain.DocSource, error) {
+	return af.FindSourcesWithin(srcpath, nil)
+}
+
+func (af archiveFinder) FindSourcesWithin(srcpath string, within []string) ([]domain.DocSource, error) {
+	candidates, err := walkFilesWithin(srcpath, within, af.df.filter, af.df.workers)
+	if err != nil {
+		return nil, err
+	}
+	files, archives := []string{}, []string{}
+	for _, c := range candidates {
+		if af.df.archiveDepth > 0 && archiveFormat(c) != "" {
+			archives = append(archives, c)
+		} else {
+			files = append(files, c)
+		}
+	}
+	filepaths, err := af.df.searchfunc(files, af.df.syntaxes)
+	if err != nil {
+		return nil, err
+	}
+	sources := []domain.DocSource{}
+	for _, fp := range filepaths {
+		sources = append(sources, FileSource(fp))
+	}
+	if len(archives) == 0 {
+		return sources, nil
+	}
+	sp, err := newSpool()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create spool file for archives: %w", err)
+	}
+	s := newSearcher(af.df.syntaxes)
+	for _, archive := range archives {
+		found, err := af.searchArchive(s, sp, archive, archiveFormat(archive), fileOpener(archive), 1)
+		if err != nil {
+			if archive == srcpath {
+				return nil, fmt.Errorf("cannot read archive %q: %w", archive, err)
+			}
+			log.WithField("path", archive).Warnf("cannot read archive: %v", err)
+			continue
+		}
+		sources = append(sources, found...)
+	}
+	// Otherwise the spool file is closed once each of its DocSources is.
+	if sp.refs == 0 {
+		sp.f.Close()
+	} else {
+		// What was written beyond the last file kept isn't needed.
+		sp.f.Truncate(sp.size)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Path < sources[j].Path })
+	return sources, nil
+}
+
+// searchArchive returns DocSources of the files containing magic strings
+// within the archive at archivepath, of the given format and read by open,
+// which is nested within depth-1 other archives. Those files, and the
+// archives nested within, are copied into sp.
+func (af archiveFinder) searchArchive(s *searcher, sp *spool, archivepath, format string, open opener, depth int) ([]domain.DocSource, error) {
+	ai, err := openArchive(format, open)
+	if err != nil {
+		return nil, err
+	}
+	defer ai.Close()
+	sources := []domain.DocSource{}
+	for {
+		name, r, err := ai.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name = cleanEntryName(name)
+		entrypath := archivepath + domain.ArchiveSeparator + name
+		components := splitPath(name)
+		if matchPatterns(components, false, af.excludes) {
+			continue
+		}
+		if af.includes != nil && !af.includes.Match(components, false) {
+			continue
+		}
+		if nested := archiveFormat(name); nested != "" {
+			if depth >= af.df.archiveDepth {
+				log.WithField("path", entrypath).Warnf("not searching archive nested within %d others, the most allowed", depth)
+				continue
+			}
+			start := sp.size
+			w, keep := sp.writer()
+			if _, err := io.Copy(w, r); err != nil {
+				log.WithField("path", entrypath).Warnf("cannot read archive: %v", err)
+				continue
+			}
+			found, err := af.searchArchive(s, sp, entrypath, nested, keep(), depth+1)
+			if err != nil {
+				log.WithField("path", entrypath).Warnf("cannot read archive: %v", err)
+			}
+			if len(found) == 0 {
+				// Nothing reads the archive's copy, or anything copied
+				// after it, so it's overwritten by what's copied next.
+				sp.size = start
+				continue
+			}
+			sources = append(sources, found...)
+			continue
+		}
+		w, keep := sp.writer()
+		found, err := s.search(io.TeeReader(r, w))
+		if err == nil && found {
+			// The rest of the file follows what was searched.
+			_, err = io.Copy(w, r)
+		}
+		if err != nil {
+			log.WithField("path", entrypath).Warnf("cannot search file for OmegaDocs: %v", err)
+			continue
+		}
+		if found {
+			sources = append(sources, domain.DocSource{Path: entrypath, Open: keep(), Close: sp.closer()})
+		}
+	}
+	return sources, nil
+}
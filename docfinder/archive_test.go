@@ -0,0 +1,176 @@
+package docfinder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// archiveFile is a file within an archive made by makeArchive.
+type archiveFile struct {
+	Name     string
+	Contents string
+}
+
+// makeArchive returns an archive, in the format named as by archiveFormat,
+// of files.
+func makeArchive(t *testing.T, format string, files ...archiveFile) []byte {
+	buf := &bytes.Buffer{}
+	switch format {
+	case "zip":
+		zw := zip.NewWriter(buf)
+		for _, f := range files {
+			w, err := zw.Create(f.Name)
+			require.NoError(t, err)
+			_, err = w.Write([]byte(f.Contents))
+			require.NoError(t, err)
+		}
+		require.NoError(t, zw.Close())
+	case "tar", "tgz":
+		var w io.Writer = buf
+		var gz *gzip.Writer
+		if format == "tgz" {
+			gz = gzip.NewWriter(buf)
+			w = gz
+		}
+		tw := tar.NewWriter(w)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}))
+		for _, f := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.Name, Mode: 0644, Size: int64(len(f.Contents))}))
+			_, err := tw.Write([]byte(f.Contents))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		if gz != nil {
+			require.NoError(t, gz.Close())
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveFinder(t *testing.T) {
+	doc := func(body string) string {
+		return domain.START_OMEGADOC + "EOD a.md\n" + body + "\nEOD\n"
+	}
+	inner := makeArchive(t, "zip", archiveFile{"deep.md", doc("deep")})
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"plain.md": doc("plain"),
+		"a.zip": string(makeArchive(t, "zip",
+			archiveFile{"docs/a.md", doc("zip a")},
+			archiveFile{"none.md", "nothing\n"},
+			archiveFile{"testdata/skip.md", doc("skipped")},
+			archiveFile{"nested.zip", string(inner)},
+		)),
+		"b.tar.gz": string(makeArchive(t, "tgz",
+			archiveFile{"./b.md", doc("tgz b")},
+			archiveFile{"c.md", doc("tgz c")},
+		)),
+		"c.tar": string(makeArchive(t, "tar", archiveFile{"c.md", doc("tar c")})),
+		"d.tgz": "not really an archive",
+	})
+	type tst struct {
+		Path string
+		Opts []Option
+		Exp  map[string]string
+	}
+	for tidx, test := range []tst{
+		{Path: "", Opts: []Option{WithExcludes("testdata/")}, Exp: map[string]string{
+			"plain.md":         doc("plain"),
+			"a.zip!/docs/a.md": doc("zip a"),
+			"b.tar.gz!/b.md":   doc("tgz b"),
+			"b.tar.gz!/c.md":   doc("tgz c"),
+			"c.tar!/c.md":      doc("tar c"),
+		}},
+		// An archive within an archive is opened only when deep enough.
+		{Path: "a.zip", Opts: []Option{WithArchiveDepth(2)}, Exp: map[string]string{
+			"a.zip!/docs/a.md":           doc("zip a"),
+			"a.zip!/testdata/skip.md":    doc("skipped"),
+			"a.zip!/nested.zip!/deep.md": doc("deep"),
+		}},
+		{Path: "b.tar.gz", Opts: []Option{WithIncludes("c.md")}, Exp: map[string]string{
+			"b.tar.gz!/c.md": doc("tgz c"),
+		}},
+		// Without any depth, archives are ordinary (binary) files.
+		{Path: "", Opts: []Option{WithArchiveDepth(0)}, Exp: map[string]string{
+			"plain.md": doc("plain"),
+		}},
+	} {
+		sources, err := NewArchiveFinder(test.Opts...).FindSources(filepath.Join(dir, test.Path))
+		require.NoError(t, err, "test #%d", tidx)
+		require.True(t, sort.SliceIsSorted(sources, func(i, j int) bool { return sources[i].Path < sources[j].Path }))
+		found := map[string]string{}
+		for _, src := range sources {
+			rc, err := src.Open()
+			require.NoError(t, err, "test #%d", tidx)
+			contents, err := io.ReadAll(rc)
+			require.NoError(t, err, "test #%d", tidx)
+			require.NoError(t, rc.Close())
+			// Files within archives are read from the spool, so they can
+			// seek, and can be opened again without reading the archive.
+			require.Implements(t, (*io.Seeker)(nil), rc, "test #%d", tidx)
+			again, err := src.Open()
+			require.NoError(t, err, "test #%d", tidx)
+			reread, err := io.ReadAll(again)
+			require.NoError(t, err, "test #%d", tidx)
+			require.NoError(t, again.Close())
+			require.Equal(t, string(contents), string(reread), "test #%d", tidx)
+			rel, err := filepath.Rel(dir, src.Path)
+			require.NoError(t, err)
+			found[filepath.ToSlash(rel)] = string(contents)
+		}
+		require.Equal(t, test.Exp, found, "test #%d", tidx)
+	}
+
+	_, err := NewArchiveFinder().FindSources(filepath.Join(dir, "d.tgz"))
+	require.Error(t, err)
+}
+
+func TestArchiveSpool(t *testing.T) {
+	doc := func(body string) string {
+		return domain.START_OMEGADOC + "EOD a.md\n" + body + "\nEOD\n"
+	}
+	empty := makeArchive(t, "zip", archiveFile{"none.md", strings.Repeat("nothing\n", 1000)})
+	archive := makeArchive(t, "zip",
+		archiveFile{"empty.zip", string(empty)},
+		archiveFile{"a.md", doc("a")},
+		archiveFile{"b.md", doc("b")},
+	)
+	open := func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(archive)), nil
+	}
+	af := NewArchiveFinder(WithArchiveDepth(2)).(archiveFinder)
+	sp, err := newSpool()
+	require.NoError(t, err)
+	sources, err := af.searchArchive(newSearcher(af.df.syntaxes), sp, "/x.zip", "zip", open, 1)
+	require.NoError(t, err)
+	require.Len(t, sources, 2)
+	// The copy of the nested archive, which holds no OmegaDocs, isn't kept.
+	require.EqualValues(t, len(doc("a"))+len(doc("b")), sp.size)
+
+	read := func(src domain.DocSource) error {
+		rc, err := src.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return err
+	}
+	// The spool is closed only once every source reading it is closed,
+	// however many times each is closed.
+	require.NoError(t, sources[0].Close())
+	require.NoError(t, sources[0].Close())
+	require.NoError(t, read(sources[1]))
+	require.NoError(t, sources[1].Close())
+	require.Error(t, read(sources[1]))
+}
@@ -1,100 +1,334 @@
 package docfinder
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 
 	"github.com/lelandbatey/omegadoc/domain"
-	//log "github.com/sirupsen/logrus"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type docfinder struct {
-	ignorepaths []string
-	searchfunc  func(string, ...string) ([]string, error)
+	// filter decides which files are searched.
+	filter pathFilter
+	// syntaxes are the syntaxes of the magic strings searched for.
+	syntaxes []domain.MagicSyntax
+	// workers is the most directories read, or files searched by the native
+	// search, at once.
+	workers    int
+	searchfunc SearchFunc
+	// archiveDepth is the most archives a file may be nested within to be
+	// searched by the archive finder.
+	archiveDepth int
 }
 
+// SearchFunc returns those of paths, which are absolute paths of files,
+// containing the magic strings of any of syntaxes.
+type SearchFunc func(paths []string, syntaxes []domain.MagicSyntax) ([]string, error)
+
 var _ domain.DocFinder = docfinder{}
 
-func NewDocFinder(ignorepaths ...string) domain.DocFinder {
-	// TODO use exec.LookPath to look up 'rg', 'ag', and 'grep' to choose the
-	// underlying search program.
-	return docfinder{
-		ignorepaths: ignorepaths,
-		searchfunc:  grepFind,
+// Option configures optional behavior of the DocFinder returned by
+// NewDocFinder.
+type Option func(*docfinder)
+
+// WithIgnorePaths sets absolute paths which, along with everything beneath
+// them, are not searched.
+func WithIgnorePaths(ignorepaths ...string) Option {
+	return func(df *docfinder) {
+		df.filter.ignorepaths = ignorepaths
 	}
 }
 
-func (df docfinder) FindReaders(path string) (map[string]io.Reader, error) {
-	filepaths, err := df.searchfunc(path, df.ignorepaths...)
-	if err != nil {
-		return nil, err
+// WithExcludes adds patterns, in gitignore syntax and relative to the path
+// being searched, of files and directories which are not searched. These take
+// priority over the patterns of ignore files, so "!pattern" re-includes
+// files which an ignore file excludes.
+func WithExcludes(globs ...string) Option {
+	return func(df *docfinder) {
+		df.filter.excludes = append(df.filter.excludes, globs...)
 	}
-	var readers map[string]io.Reader = map[string]io.Reader{}
-	{
-		for _, fp := range filepaths {
-			f, err := os.OpenFile(fp, os.O_RDONLY, 0644)
-			if err != nil {
-				return nil, err
-			}
-			readers[fp] = f
+}
+
+// WithIncludes adds patterns, in gitignore syntax and relative to the path
+// being searched, of the files which are searched. When there are any such
+// patterns, files which match none of them are not searched. Files which are
+// excluded are not searched even if they match.
+func WithIncludes(globs ...string) Option {
+	return func(df *docfinder) {
+		df.filter.includes = append(df.filter.includes, globs...)
+	}
+}
+
+// WithIgnoreFiles enables (or disables) excluding the paths matched by the
+// patterns of .gitignore and .omegadocignore files, which are read in every
+// directory searched. By default ignore files are used.
+func WithIgnoreFiles(enabled bool) Option {
+	return func(df *docfinder) {
+		df.filter.ignoreFiles = enabled
+	}
+}
+
+// WithFollowSymlinks enables (or disables) searching what the symbolic links
+// beneath the search path point to. By default, as with grep -r, they're
+// skipped, though a search path which is itself a symbolic link is always
+// followed. When links are followed, each file is found once, by its
+// canonical path, however many links lead to it, and links which loop are
+// detected.
+func WithFollowSymlinks(enabled bool) Option {
+	return func(df *docfinder) {
+		df.filter.followSymlinks = enabled
+	}
+}
+
+// WithMagicSyntaxes sets the syntaxes of the magic strings to search for,
+// replacing the default of only domain.DefaultMagicSyntax. These should be the
+// same syntaxes as are recognized by the DocParser.
+func WithMagicSyntaxes(syntaxes ...domain.MagicSyntax) Option {
+	return func(df *docfinder) {
+		df.syntaxes = syntaxes
+	}
+}
+
+// WithWorkers sets the most directories read, or files searched by the
+// native search, at once. By default this is the number of CPUs.
+func WithWorkers(workers int) Option {
+	return func(df *docfinder) {
+		if workers > 0 {
+			df.workers = workers
 		}
 	}
-	return readers, nil
 }
 
-// grepFind finds all files recursively in srcpath which contain an OmegaDoc.
-// srcpath and ignorepaths are absolute paths. The returned slice of strings is
-// absolute paths to files which contain OmegaDoc(s).
-func grepFind(srcpath string, ignorepaths ...string) ([]string, error) {
-	var matches []string = []string{}
-	{
-		// TODO ignore the paths passed in ignorepaths. Right now no files are ignored.
-		cmds := []string{"grep",
-			// If 'type' passed to `--binary-files=type` is 'without-match', when grep
-			// discovers null input binary data it assumes that the rest of the file
-			// does not match; this is equivalent to the -I option.
-			// https://www.gnu.org/software/grep/manual/grep.html#index-_002d_002dbinary_002dfiles
-			"--binary-files=without-match",
-			// Suppress normal output; instead print the name of each input file from
-			// which output would normally have been printed. Scanning each input file
-			// stops upon first match.
-			// https://www.gnu.org/software/grep/manual/grep.html#index-_002dl
-			"--files-with-matches",
-			regexp.QuoteMeta(domain.START_OMEGADOC),
-			"-r", srcpath,
+// WithSearchFunc sets how files are searched for magic strings. By default,
+// the native search is used; see SearchFuncByName.
+func WithSearchFunc(fn SearchFunc) Option {
+	return func(df *docfinder) {
+		df.searchfunc = fn
+	}
+}
+
+// WithArchiveDepth sets the most archives a file may be nested within to be
+// searched by the DocFinder returned by NewArchiveFinder. At 1, the default,
+// the files within archives are searched but archives within archives are
+// not opened; at 0, archives are searched as ordinary files.
+func WithArchiveDepth(depth int) Option {
+	return func(df *docfinder) {
+		if depth >= 0 {
+			df.archiveDepth = depth
 		}
-		cmd := exec.Command(cmds[0], cmds[1:]...)
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return nil, fmt.Errorf("cannot create stdout pipe of grep find: %w", err)
+	}
+}
+
+// SearchFuncNames are the names accepted by SearchFuncByName.
+var SearchFuncNames = []string{"native", "grep", "rg", "auto"}
+
+// SearchFuncByName returns the SearchFunc called name:
+//
+//   - "native" searches within this program, with up to workers files
+//     searched at once, or as many as there are CPUs if workers is less
+//     than 1.
+//   - "grep" runs grep.
+//   - "rg" runs ripgrep.
+//   - "auto" runs ripgrep or else grep, whichever is found first on the PATH,
+//     and otherwise uses the native search.
+//
+// Only the native search finds magic strings in UTF-16 text; grep and
+// ripgrep match the bytes of the magic strings as written in UTF-8.
+//
+// An error is returned if the program of the named search can't be found.
+func SearchFuncByName(name string, workers int) (SearchFunc, error) {
+	switch name {
+	case "native":
+		return NativeSearch(workers), nil
+	case "grep", "rg":
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("cannot use the %q finder: %w", name, err)
+		}
+		if name == "rg" {
+			return rgFind, nil
 		}
-		//stderr, err := cmd.StderrPipe()
-		//if err != nil {
-		//	return nil, fmt.Errorf("cannot create stderr pipe of grep find: %w", err)
-		//}
-		err = cmd.Start()
-		if err != nil {
-			return nil, fmt.Errorf("cannot start grep: %w", err)
+		return grepFind, nil
+	case "auto":
+		for _, prog := range []string{"rg", "grep"} {
+			if _, err := exec.LookPath(prog); err == nil {
+				log.WithField("program", prog).Debug("searching for OmegaDocs with external program")
+				return SearchFuncByName(prog, workers)
+			}
+		}
+		return NativeSearch(workers), nil
+	}
+	return nil, fmt.Errorf("unknown finder %q, must be one of %q", name, SearchFuncNames)
+}
+
+func NewDocFinder(opts ...Option) domain.DocFinder {
+	return newDocFinder(opts...)
+}
+
+func newDocFinder(opts ...Option) docfinder {
+	df := docfinder{
+		filter:   pathFilter{ignoreFiles: true},
+		syntaxes: []domain.MagicSyntax{domain.DefaultMagicSyntax},
+		workers:  runtime.NumCPU(),
+
+		archiveDepth: 1,
+	}
+	for _, opt := range opts {
+		opt(&df)
+	}
+	if df.searchfunc == nil {
+		df.searchfunc = NativeSearch(df.workers)
+	}
+	return df
+}
+
+func (df docfinder) FindSources(path string) ([]domain.DocSource, error) {
+	return df.FindSourcesWithin(path, nil)
+}
+
+func (df docfinder) FindSourcesWithin(path string, within []string) ([]domain.DocSource, error) {
+	candidates, err := walkFilesWithin(path, within, df.filter, df.workers)
+	if err != nil {
+		return nil, err
+	}
+	filepaths, err := df.searchfunc(candidates, df.syntaxes)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(filepaths)
+	sources := []domain.DocSource{}
+	for _, fp := range filepaths {
+		sources = append(sources, FileSource(fp))
+	}
+	return sources, nil
+}
+
+// FileSource returns a DocSource of the on-disk file at path.
+func FileSource(path string) domain.DocSource {
+	return domain.DocSource{
+		Path: path,
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+		Stat: func() (os.FileInfo, error) {
+			return os.Stat(path)
+		},
+	}
+}
+
+// magicPattern returns an extended regular expression matching the common
+// prefix of the magic strings of any of syntaxes. Occurrences escaped by a
+// preceding ESCAPE_OMEGADOC don't match.
+func magicPattern(syntaxes []domain.MagicSyntax) string {
+	prefixes := []string{}
+	for _, syn := range syntaxes {
+		prefixes = append(prefixes, regexp.QuoteMeta(syn.Prefix))
+	}
+	return "(^|[^" + regexp.QuoteMeta(domain.ESCAPE_OMEGADOC) + "])(" + strings.Join(prefixes, "|") + ")"
+}
+
+// searchBatchSize is the most paths given to a single run of a search
+// program, keeping its command line well within the limits of the OS.
+const searchBatchSize = 1000
+
+// grepFind returns those of paths which contain the magic strings of any of
+// syntaxes, using grep. Any of paths which are directories are searched
+// recursively. paths are absolute paths, as are the returned paths of files
+// which contain OmegaDoc(s). Files in UTF-16 are never found, since they hold
+// NUL bytes, and grep would consider them binary, and since the pattern
+// matches UTF-8.
+func grepFind(paths []string, syntaxes []domain.MagicSyntax) ([]string, error) {
+	return runSearchProgram("grep", []string{
+		// If 'type' passed to `--binary-files=type` is 'without-match', when grep
+		// discovers null input binary data it assumes that the rest of the file
+		// does not match; this is equivalent to the -I option.
+		// https://www.gnu.org/software/grep/manual/grep.html#index-_002d_002dbinary_002dfiles
+		"--binary-files=without-match",
+		// Suppress normal output; instead print the name of each input file from
+		// which output would normally have been printed. Scanning each input file
+		// stops upon first match.
+		// https://www.gnu.org/software/grep/manual/grep.html#index-_002dl
+		"--files-with-matches",
+		// End each file name with a NUL rather than a newline, so that file
+		// names containing newlines survive.
+		"--null",
+		// Any magic string may begin an OmegaDoc, including the include
+		// directive, so the common prefix of each syntax is searched for.
+		// Magic strings escaped by a preceding ESCAPE_OMEGADOC don't count
+		// as matches.
+		"--extended-regexp",
+		"--regexp", magicPattern(syntaxes),
+		"-r", "--",
+	}, paths)
+}
+
+// rgFind is like grepFind, but uses ripgrep. Unlike grep, ripgrep searches
+// binary files which are named on its command line, so a binary file
+// containing a magic string may be returned. Like grep, ripgrep doesn't find
+// magic strings in UTF-16 files.
+func rgFind(paths []string, syntaxes []domain.MagicSyntax) ([]string, error) {
+	return runSearchProgram("rg", []string{
+		// Configuration files could change what's printed.
+		"--no-config",
+		"--files-with-matches",
+		"--null",
+		"--regexp", magicPattern(syntaxes),
+		"--",
+	}, paths)
+}
+
+// runSearchProgram runs a grep-like program with args followed by batches of
+// paths, returning the absolute paths of the files which it prints as
+// matching. The program must print each file name followed by a NUL, and
+// follow grep's convention of exiting with 1 when nothing matches and with 2
+// on errors. Errors such as unreadable files don't prevent using the rest of
+// the program's output, so they're only logged.
+func runSearchProgram(name string, args []string, paths []string) ([]string, error) {
+	var matches []string = []string{}
+	for len(paths) > 0 {
+		batch := paths
+		if len(batch) > searchBatchSize {
+			batch = batch[:searchBatchSize]
 		}
-		all, err := io.ReadAll(stdout)
-		if err != nil {
-			return nil, fmt.Errorf("cannot read all of stdout from running grep: %w", err)
+		paths = paths[len(batch):]
+
+		cmd := exec.Command(name, append(append([]string{}, args...), batch...)...)
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+		err := cmd.Run()
+		var exiterr *exec.ExitError
+		if errors.As(err, &exiterr) {
+			switch exiterr.ExitCode() {
+			case 1:
+				// Nothing matched.
+			case 2:
+				log.WithField("program", name).Warnf("errors while searching for OmegaDocs: %s", strings.TrimSpace(stderr.String()))
+			default:
+				return nil, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot run %s: %w", name, err)
 		}
-		for _, line := range strings.Split(string(all), "\n") {
-			if strings.TrimSpace(line) == "" {
+		for _, found := range strings.Split(stdout.String(), "\x00") {
+			if found == "" {
 				continue
 			}
-			foundp, err := filepath.Abs(line)
+			foundp, err := filepath.Abs(found)
 			if err != nil {
-				return nil, fmt.Errorf("cannot create absolute path of line %q: %w", line, err)
+				return nil, fmt.Errorf("cannot create absolute path of %q: %w", found, err)
 			}
 			matches = append(matches, foundp)
 		}
-		return matches, nil
 	}
+	return matches, nil
 }
@@ -0,0 +1,65 @@
+package docfinder
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0644))
+	}
+}
+
+func TestGrepFindEscaped(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"start.md":   domain.START_OMEGADOC + "EOD a.md\nhi\nEOD\n",
+		"middle.go":  "// " + domain.START_OMEGADOC + "EOD a.md\n",
+		"escaped.md": "an example: " + domain.ESCAPE_OMEGADOC + domain.START_OMEGADOC + "EOD a.md\n",
+		"none.md":    "nothing to see here\n",
+	})
+	found, err := grepFind([]string{dir}, []domain.MagicSyntax{domain.DefaultMagicSyntax})
+	require.NoError(t, err)
+	sort.Strings(found)
+	require.Equal(t, []string{filepath.Join(dir, "middle.go"), filepath.Join(dir, "start.md")}, found)
+}
+
+func TestGrepFindSyntaxes(t *testing.T) {
+	dir := t.TempDir()
+	at, err := domain.ParseMagicSyntax("@omegadoc <<")
+	require.NoError(t, err)
+	colon, err := domain.ParseMagicSyntax("omegadoc:begin")
+	require.NoError(t, err)
+	writeFiles(t, dir, map[string]string{
+		"default.md": domain.START_OMEGADOC + "EOD a.md\nhi\nEOD\n",
+		"include.md": domain.INCLUDE_OMEGADOC + " a.md\n",
+		"at.json":    `{"doc": "` + at.StartString() + `EOD a.md"}` + "\n",
+		"colon.sql":  "-- " + colon.StartString() + " EOD a.md\n",
+		"escaped.md": domain.ESCAPE_OMEGADOC + at.StartString() + "EOD a.md\n",
+	})
+	for tidx, test := range []struct {
+		Syntaxes []domain.MagicSyntax
+		Exp      []string
+	}{
+		{[]domain.MagicSyntax{domain.DefaultMagicSyntax}, []string{"default.md", "include.md"}},
+		{[]domain.MagicSyntax{at, colon}, []string{"at.json", "colon.sql"}},
+		{[]domain.MagicSyntax{domain.DefaultMagicSyntax, colon}, []string{"colon.sql", "default.md", "include.md"}},
+	} {
+		found, err := grepFind([]string{dir}, test.Syntaxes)
+		require.NoError(t, err, "test #%d", tidx)
+		sort.Strings(found)
+		exp := []string{}
+		for _, name := range test.Exp {
+			exp = append(exp, filepath.Join(dir, name))
+		}
+		require.Equal(t, exp, found, "test #%d", tidx)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package docfinder
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNativeSearchFDLimit checks that a file which can't be opened because
+// too many files are open fails the search rather than being skipped.
+func TestNativeSearchFDLimit(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.md": domain.START_OMEGADOC + "EOD a.md\nhi\nEOD\n"})
+	paths := []string{filepath.Join(dir, "a.md")}
+
+	var lim syscall.Rlimit
+	require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim))
+	lowered := lim
+	lowered.Cur = 3
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered))
+	found, err := NativeSearch(1)(paths, []domain.MagicSyntax{domain.DefaultMagicSyntax})
+	require.NoError(t, syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lim))
+
+	require.True(t, errors.Is(err, syscall.EMFILE), "got %v", err)
+	require.Nil(t, found)
+}
@@ -0,0 +1,25 @@
+package docfinder
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// fileKey identifies a file however many paths lead to it: by its device and
+// inode where the OS has them, and otherwise by its canonical path.
+type fileKey struct {
+	dev, ino uint64
+	path     string
+}
+
+// fileKeyOf returns the fileKey of the file at path, described by info as
+// returned by os.Stat.
+func fileKeyOf(path string, info os.FileInfo) fileKey {
+	if key, ok := sysFileKey(info); ok {
+		return key
+	}
+	if canon, err := filepath.EvalSymlinks(path); err == nil {
+		path = canon
+	}
+	return fileKey{path: path}
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package docfinder
+
+import (
+	"os"
+)
+
+func sysFileKey(info os.FileInfo) (fileKey, bool) {
+	return fileKey{}, false
+}
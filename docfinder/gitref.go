@@ -0,0 +1,315 @@
+package docfinder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gitRevisionFinder finds the OmegaDocs in the files of a commit of a git
+// repository, rather than in the files on disk.
+type gitRevisionFinder struct {
+	df  docfinder
+	ref string
+}
+
+// NewGitRevisionFinder returns a DocFinder which searches the files of the
+// commit named by ref, such as a commit hash, a branch or a tag, in the git
+// repository containing the path it's asked to search. The files are read
+// from the repository, so they needn't exist in the working tree, and each
+// DocSource reads the contents of its file at that commit. The readers of
+// the DocSources are domain.RevisionReaders giving the hash of the commit.
+// Files are streamed from the objects of the repository, both when searched,
+// with up to WithWorkers files searched at once, and when opened.
+//
+// The paths of the DocSources are those the files would have in the working
+// tree. Ignore files are read from the commit rather than from disk, and
+// files are always searched natively, so WithSearchFunc has no effect.
+func NewGitRevisionFinder(ref string, opts ...Option) domain.DocFinder {
+	return gitRevisionFinder{df: newDocFinder(opts...), ref: ref}
+}
+
+// repoPool lends out handles on a git repository. The objects of a single
+// handle aren't safe to read concurrently, so each handle is lent to one
+// reader at a time. When every handle is lent out another is opened, so
+// borrowing never waits, while up to size handles are kept for reuse.
+type repoPool struct {
+	path string
+	free chan *git.Repository
+}
+
+func newRepoPool(repo *git.Repository, path string, size int) *repoPool {
+	rp := &repoPool{path: path, free: make(chan *git.Repository, size)}
+	rp.free <- repo
+	return rp
+}
+
+func (rp *repoPool) release(repo *git.Repository) {
+	select {
+	case rp.free <- repo:
+	default:
+	}
+}
+
+// openBlob returns a reader of the blob with the given hash, which holds a
+// handle of the pool until it's closed.
+func (rp *repoPool) openBlob(hash plumbing.Hash, revision string) (io.ReadCloser, error) {
+	var repo *git.Repository
+	select {
+	case repo = <-rp.free:
+	default:
+		var err error
+		repo, err = git.PlainOpenWithOptions(rp.path, &git.PlainOpenOptions{DetectDotGit: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		rp.release(repo)
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		rp.release(repo)
+		return nil, err
+	}
+	return &blobReader{ReadCloser: r, revision: revision, release: func() { rp.release(repo) }}, nil
+}
+
+// blobReader reads the contents of a file at a commit, straight from the
+// objects of the repository.
+type blobReader struct {
+	io.ReadCloser
+	revision string
+	release  func()
+}
+
+func (br *blobReader) Revision() string {
+	return br.revision
+}
+
+func (br *blobReader) Close() error {
+	err := br.ReadCloser.Close()
+	if br.release != nil {
+		br.release()
+		br.release = nil
+	}
+	return err
+}
+
+// treeFile is a regular file within the tree of a commit.
+type treeFile struct {
+	path string
+	hash plumbing.Hash
+}
+
+func (gf gitRevisionFinder) FindSources(path string) ([]domain.DocSource, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.PlainOpenWithOptions(abspath, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open git repository containing %q: %w", path, err)
+	}
+	root := abspath
+	var excludefile string
+	if wt, err := repo.Worktree(); err == nil {
+		root = wt.Filesystem.Root()
+		excludefile = filepath.Join(root, ".git", "info", "exclude")
+	} else if !errors.Is(err, git.ErrIsBareRepository) {
+		return nil, fmt.Errorf("cannot access working tree of git repository containing %q: %w", path, err)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(gf.ref))
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve git revision %q: %w", gf.ref, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read commit %s: %w", hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read tree of commit %s: %w", hash, err)
+	}
+	rel, err := filepath.Rel(root, abspath)
+	if err != nil {
+		return nil, err
+	}
+	components := splitPath(rel)
+	if len(components) > 0 && components[0] == ".." {
+		return nil, fmt.Errorf("path %q is not within the git repository at %q", path, root)
+	}
+
+	tw := &treeWalker{
+		repo:     repo,
+		root:     root,
+		filter:   gf.df.filter,
+		excludes: parsePatterns(gf.df.filter.excludes, components),
+		files:    []treeFile{},
+	}
+	if len(gf.df.filter.includes) > 0 {
+		tw.includes = gitignore.NewMatcher(parsePatterns(gf.df.filter.includes, components))
+	}
+	patterns := []gitignore.Pattern{}
+	if gf.df.filter.ignoreFiles && excludefile != "" {
+		patterns = append(patterns, readIgnoreFile(excludefile, nil)...)
+	}
+	// As with the working tree, the ignore files of the directories
+	// containing path apply, and a path which is a file is always searched.
+	if len(components) > 0 {
+		entry, err := tree.FindEntry(strings.Join(components, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot find %q in commit %s: %w", rel, hash, err)
+		}
+		if entry.Mode != filemode.Dir {
+			if !entry.Mode.IsRegular() {
+				return nil, fmt.Errorf("%q is not a regular file in commit %s", rel, hash)
+			}
+			tw.files = append(tw.files, treeFile{path: abspath, hash: entry.Hash})
+		} else {
+			for i, name := range components {
+				if gf.df.filter.ignoreFiles {
+					patterns = append(patterns, tw.readIgnoreBlobs(tree, components[:i])...)
+				}
+				if tree, err = tree.Tree(name); err != nil {
+					return nil, fmt.Errorf("cannot read tree of %q in commit %s: %w", rel, hash, err)
+				}
+			}
+		}
+	}
+	if len(tw.files) == 0 {
+		if err := tw.walk(tree, components, patterns); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(tw.files, func(i, j int) bool { return tw.files[i].path < tw.files[j].path })
+
+	revision := hash.String()
+	pool := newRepoPool(repo, abspath, gf.df.workers)
+	found := make([]bool, len(tw.files))
+	todo := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < gf.df.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := newSearcher(gf.df.syntaxes)
+			for i := range todo {
+				tf := tw.files[i]
+				rc, err := pool.openBlob(tf.hash, revision)
+				if err != nil {
+					log.WithField("path", tf.path).Warnf("cannot search file for OmegaDocs: %v", err)
+					continue
+				}
+				found[i], err = s.search(rc)
+				rc.Close()
+				if err != nil {
+					log.WithField("path", tf.path).Warnf("cannot search file for OmegaDocs: %v", err)
+				}
+			}
+		}()
+	}
+	for i := range tw.files {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+
+	sources := []domain.DocSource{}
+	for i, tf := range tw.files {
+		if !found[i] {
+			continue
+		}
+		hash := tf.hash
+		sources = append(sources, domain.DocSource{Path: tf.path, Open: func() (io.ReadCloser, error) {
+			return pool.openBlob(hash, revision)
+		}})
+	}
+	return sources, nil
+}
+
+// treeWalker collects the regular files within the tree of a commit which
+// pass its filter.
+type treeWalker struct {
+	repo     *git.Repository
+	root     string
+	filter   pathFilter
+	excludes []gitignore.Pattern
+	includes gitignore.Matcher
+	files    []treeFile
+}
+
+// readIgnoreBlobs returns the patterns of each ignore file in tree, which is
+// the directory with the components domain.
+func (tw *treeWalker) readIgnoreBlobs(tree *object.Tree, domain []string) []gitignore.Pattern {
+	ps := []gitignore.Pattern{}
+	for _, name := range ignoreFileNames {
+		entry, err := tree.FindEntry(name)
+		if err != nil || !entry.Mode.IsRegular() {
+			continue
+		}
+		blob, err := tw.repo.BlobObject(entry.Hash)
+		if err != nil {
+			continue
+		}
+		r, err := blob.Reader()
+		if err != nil {
+			continue
+		}
+		ps = append(ps, parseIgnoreFile(r, domain)...)
+		r.Close()
+	}
+	return ps
+}
+
+// walk collects the files beneath tree, which is the directory with the
+// components given. patterns are those of the ignore files of the
+// directories containing tree, in order of increasing priority.
+func (tw *treeWalker) walk(tree *object.Tree, components []string, patterns []gitignore.Pattern) error {
+	if tw.filter.ignoreFiles {
+		if own := tw.readIgnoreBlobs(tree, components); len(own) > 0 {
+			patterns = append(patterns[:len(patterns):len(patterns)], own...)
+		}
+	}
+	for _, entry := range tree.Entries {
+		comps := append(components[:len(components):len(components)], entry.Name)
+		path := filepath.Join(tw.root, filepath.Join(comps...))
+		if entry.Mode == filemode.Dir {
+			if isIgnoredPath(path, tw.filter.ignorepaths) || matchPatterns(comps, true, patterns, tw.excludes) {
+				continue
+			}
+			sub, err := tree.Tree(entry.Name)
+			if err != nil {
+				return fmt.Errorf("cannot read tree of %q: %w", strings.Join(comps, "/"), err)
+			}
+			if err := tw.walk(sub, comps, patterns); err != nil {
+				return err
+			}
+			continue
+		}
+		// Symbolic links and submodules aren't files of this repository.
+		if !entry.Mode.IsRegular() || isIgnoredPath(path, tw.filter.ignorepaths) || matchPatterns(comps, false, patterns, tw.excludes) {
+			continue
+		}
+		if tw.includes != nil && !tw.includes.Match(comps, false) {
+			continue
+		}
+		tw.files = append(tw.files, treeFile{path: path, hash: entry.Hash})
+	}
+	return nil
+}
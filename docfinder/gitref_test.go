@@ -0,0 +1,122 @@
+package docfinder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// commitFiles writes files into the working tree of repo at dir, then commits
+// every change, returning the hash of the commit.
+func commitFiles(t *testing.T, repo *git.Repository, dir string, files map[string]string) plumbing.Hash {
+	writeFiles(t, dir, files)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, wt.AddGlob("."))
+	hash, err := wt.Commit("commit", &git.CommitOptions{
+		All:    true,
+		Author: &object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(0, 0)},
+	})
+	require.NoError(t, err)
+	return hash
+}
+
+func TestGitRevisionFinder(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	doc := func(body string) string {
+		return domain.START_OMEGADOC + "EOD a.md\n" + body + "\nEOD\n"
+	}
+	first := commitFiles(t, repo, dir, map[string]string{
+		"a.md":            doc("first"),
+		"none.md":         "nothing\n",
+		"ignored.md":      doc("ignored"),
+		".omegadocignore": "ignored.md\n",
+		"sub/b.md":        doc("first b"),
+		"sub/deep/c.md":   doc("first c"),
+	})
+	_, err = repo.CreateTag("v1", first, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "a", Email: "a@example.com", When: time.Unix(0, 0)},
+		Message: "v1",
+	})
+	require.NoError(t, err)
+	second := commitFiles(t, repo, dir, map[string]string{
+		"a.md":     doc("second"),
+		"sub/b.md": "no more\n",
+	})
+	// Changes in the working tree aren't seen, nor are deleted files missed.
+	writeFiles(t, dir, map[string]string{"a.md": doc("uncommitted"), "new.md": doc("new")})
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "sub")))
+
+	type tst struct {
+		Ref  string
+		Path string
+		Opts []Option
+		Rev  plumbing.Hash
+		Exp  map[string]string
+	}
+	for tidx, test := range []tst{
+		{Ref: "HEAD", Path: "", Rev: second, Exp: map[string]string{
+			"a.md": doc("second"), "sub/deep/c.md": doc("first c"),
+		}},
+		// An annotated tag names the commit it tags.
+		{Ref: "v1", Path: "", Rev: first, Exp: map[string]string{
+			"a.md": doc("first"), "sub/b.md": doc("first b"), "sub/deep/c.md": doc("first c"),
+		}},
+		{Ref: "v1", Path: "", Opts: []Option{WithIgnoreFiles(false), WithExcludes("sub/")}, Rev: first, Exp: map[string]string{
+			"a.md": doc("first"), "ignored.md": doc("ignored"),
+		}},
+		{Ref: first.String(), Path: "sub", Rev: first, Exp: map[string]string{
+			"sub/b.md": doc("first b"), "sub/deep/c.md": doc("first c"),
+		}},
+		{Ref: "HEAD~1", Path: "sub/b.md", Rev: first, Exp: map[string]string{
+			"sub/b.md": doc("first b"),
+		}},
+	} {
+		sources, err := NewGitRevisionFinder(test.Ref, test.Opts...).FindSources(filepath.Join(dir, test.Path))
+		require.NoError(t, err, "test #%d", tidx)
+		found := map[string]string{}
+		for _, src := range sources {
+			rc, err := src.Open()
+			require.NoError(t, err, "test #%d", tidx)
+			require.Equal(t, test.Rev.String(), domain.ReaderRevision(rc), "test #%d", tidx)
+			contents, err := io.ReadAll(rc)
+			require.NoError(t, err, "test #%d", tidx)
+			require.NoError(t, rc.Close())
+			rel, err := filepath.Rel(dir, src.Path)
+			require.NoError(t, err)
+			found[filepath.ToSlash(rel)] = string(contents)
+		}
+		require.Equal(t, test.Exp, found, "test #%d", tidx)
+	}
+
+	// Sources may be opened again while already open, as when a parser
+	// reads a file twice, even with a single worker.
+	sources, err := NewGitRevisionFinder("HEAD", WithWorkers(1)).FindSources(dir)
+	require.NoError(t, err)
+	require.NotEmpty(t, sources)
+	opened, err := sources[0].Open()
+	require.NoError(t, err)
+	reopened, err := sources[0].Open()
+	require.NoError(t, err)
+	for _, rc := range []io.ReadCloser{opened, reopened} {
+		contents, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, doc("second"), string(contents))
+		require.NoError(t, rc.Close())
+	}
+
+	_, err = NewGitRevisionFinder("no-such-branch").FindSources(dir)
+	require.Error(t, err)
+	_, err = NewGitRevisionFinder("HEAD").FindSources(filepath.Join(dir, "new.md"))
+	require.Error(t, err)
+}
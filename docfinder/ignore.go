@@ -0,0 +1,417 @@
+package docfinder
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ignoreFileNames are the names of the ignore files read in each directory,
+// in order of increasing priority.
+var ignoreFileNames = domain.IgnoreFileNames
+
+// pathFilter decides which of the files beneath a search root are searched.
+type pathFilter struct {
+	// ignorepaths are absolute paths which, along with everything beneath
+	// them, aren't searched.
+	ignorepaths []string
+	// excludes and includes are patterns in gitignore syntax, relative to
+	// the search root. Files matching any exclude aren't searched, and when
+	// there are includes, only files matching at least one are searched.
+	excludes []string
+	includes []string
+	// ignoreFiles enables reading the patterns of ignore files, such as
+	// .gitignore.
+	ignoreFiles bool
+	// followSymlinks enables searching the files and directories which
+	// symbolic links within the search root point to.
+	followSymlinks bool
+}
+
+// splitPath splits a slash or OS separated relative path into its
+// components, returning nil for ".".
+func splitPath(rel string) []string {
+	rel = filepath.ToSlash(rel)
+	if rel == "." || rel == "" {
+		return nil
+	}
+	return strings.Split(rel, "/")
+}
+
+// findRepoRoot returns the closest directory containing dir, or dir itself,
+// which is the top of a git working tree, or "" if there's none.
+func findRepoRoot(dir string) string {
+	for {
+		if _, err := os.Lstat(filepath.Join(dir, ".git")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readIgnoreFile returns the patterns of the ignore file at path, which apply
+// to the paths beneath the directory with the components domain. A missing
+// or unreadable ignore file has no patterns.
+func readIgnoreFile(path string, domain []string) []gitignore.Pattern {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return parseIgnoreFile(f, domain)
+}
+
+// parseIgnoreFile returns the patterns read from r, in gitignore syntax,
+// which apply to the paths beneath the directory with the components domain.
+func parseIgnoreFile(r io.Reader, domain []string) []gitignore.Pattern {
+	ps := []gitignore.Pattern{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, domain))
+	}
+	return ps
+}
+
+// readIgnoreFiles returns the patterns of each ignore file in the directory
+// at dir, which has the components domain.
+func readIgnoreFiles(dir string, domain []string) []gitignore.Pattern {
+	ps := []gitignore.Pattern{}
+	for _, name := range ignoreFileNames {
+		ps = append(ps, readIgnoreFile(filepath.Join(dir, name), domain)...)
+	}
+	return ps
+}
+
+// hasIgnoreFile reports whether entries includes an ignore file, so that
+// directories without one, which are most, aren't searched for one again.
+func hasIgnoreFile(entries []os.DirEntry) bool {
+	for _, entry := range entries {
+		for _, name := range ignoreFileNames {
+			if entry.Name() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parsePatterns(globs []string, domain []string) []gitignore.Pattern {
+	ps := []gitignore.Pattern{}
+	for _, glob := range globs {
+		ps = append(ps, gitignore.ParsePattern(glob, domain))
+	}
+	return ps
+}
+
+// matchPatterns reports whether the path with the given components is
+// excluded by the lists of patterns, which are in order of increasing
+// priority. As with git, the last pattern matching the path decides.
+func matchPatterns(components []string, isDir bool, lists ...[]gitignore.Pattern) bool {
+	for li := len(lists) - 1; li >= 0; li-- {
+		for i := len(lists[li]) - 1; i >= 0; i-- {
+			if m := lists[li][i].Match(components, isDir); m != gitignore.NoMatch {
+				return m == gitignore.Exclude
+			}
+		}
+	}
+	return false
+}
+
+// isIgnoredPath reports whether path is one of ignorepaths or is beneath one.
+func isIgnoredPath(path string, ignorepaths []string) bool {
+	return withinAny(path, ignorepaths)
+}
+
+// withinAny reports whether path is one of dirs or is beneath one.
+func withinAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkFiles returns the absolute paths, sorted, of the regular files beneath
+// srcpath which pass the filter. Up to workers directories are read at once,
+// or as many as there are CPUs if workers is less than 1.
+// Directories which are excluded aren't descended into, so nothing beneath
+// them can be re-included, just as with git. When srcpath is within a git
+// working tree, the .gitignore files between the top of the working tree and
+// srcpath, and the working tree's .git/info/exclude, apply as well. ".git"
+// directories are never searched. A srcpath which is a file is always
+// searched, even through a symbolic link.
+//
+// As with grep -r, symbolic links beneath srcpath are skipped unless the
+// filter follows them. When they're followed, each directory is read only
+// once however many links lead to it, so links which loop are harmless, and
+// each file is returned once, by its canonical path with every symbolic link
+// resolved. Ignore patterns match the paths of the links rather than of what
+// they point to.
+func walkFiles(srcpath string, filter pathFilter, workers int) ([]string, error) {
+	return walkFilesWithin(srcpath, nil, filter, workers)
+}
+
+// walkFilesWithin returns the files walkFiles would return which are, or are
+// beneath, any of within, reading only the directories on the way to them,
+// so that the same ignore files and patterns apply. A nil within returns
+// every file.
+func walkFilesWithin(srcpath string, within []string, filter pathFilter, workers int) ([]string, error) {
+	info, err := os.Stat(srcpath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		if within != nil && !withinAny(srcpath, within) {
+			return []string{}, nil
+		}
+		return []string{srcpath}, nil
+	}
+	// Paths are matched by their components relative to base.
+	base := srcpath
+	if root := findRepoRoot(srcpath); root != "" {
+		base = root
+	}
+	rel, err := filepath.Rel(base, srcpath)
+	if err != nil {
+		return nil, err
+	}
+	rootdomain := splitPath(rel)
+
+	patterns := []gitignore.Pattern{}
+	if filter.ignoreFiles {
+		patterns = append(patterns, readIgnoreFile(filepath.Join(base, ".git", "info", "exclude"), nil)...)
+		// The ignore files of srcpath itself are read during the walk.
+		for i := 0; i < len(rootdomain); i++ {
+			patterns = append(patterns, readIgnoreFiles(filepath.Join(base, filepath.Join(rootdomain[:i]...)), rootdomain[:i])...)
+		}
+	}
+	w := &walker{
+		filter:   filter,
+		within:   within,
+		excludes: parsePatterns(filter.excludes, rootdomain),
+		files:    []string{},
+	}
+	if len(filter.includes) > 0 {
+		w.includes = gitignore.NewMatcher(parsePatterns(filter.includes, rootdomain))
+	}
+	w.cond = sync.NewCond(&w.mu)
+	w.queue = []walkDir{{path: srcpath, components: rootdomain, patterns: patterns}}
+	if filter.followSymlinks {
+		w.seen = map[fileKey]bool{}
+		w.visit(srcpath)
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.work()
+		}()
+	}
+	wg.Wait()
+	if filter.followSymlinks {
+		return canonicalFiles(w.files), nil
+	}
+	sort.Strings(w.files)
+	return w.files, nil
+}
+
+// canonicalFiles returns paths with every symbolic link resolved, sorted,
+// and with each file only once however many of paths lead to it. Of several
+// paths of the same file, such as hard links, the first in sorted order is
+// kept.
+func canonicalFiles(paths []string) []string {
+	byfile := map[fileKey]string{}
+	for _, p := range paths {
+		canon, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			log.WithField("path", p).Warnf("cannot resolve symbolic links: %v", err)
+			continue
+		}
+		info, err := os.Stat(canon)
+		if err != nil {
+			log.WithField("path", canon).Warnf("cannot inspect file: %v", err)
+			continue
+		}
+		key := fileKeyOf(canon, info)
+		if cur, ok := byfile[key]; !ok || canon < cur {
+			byfile[key] = canon
+		}
+	}
+	files := make([]string, 0, len(byfile))
+	for _, p := range byfile {
+		files = append(files, p)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// walkDir is a directory waiting to be read by a walker.
+type walkDir struct {
+	path       string
+	components []string
+	// patterns are the patterns of the ignore files of the directories
+	// containing this one, in order of increasing priority.
+	patterns []gitignore.Pattern
+}
+
+// walker reads directories in parallel, collecting the files which pass its
+// filter.
+type walker struct {
+	filter pathFilter
+	// within, unless nil, restricts the walk to the paths which are, or are
+	// beneath, any of it, and the directories containing them.
+	within   []string
+	excludes []gitignore.Pattern
+	includes gitignore.Matcher
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the directories waiting to be read, and active counts
+	// those being read. The walk is done when both are empty.
+	queue  []walkDir
+	active int
+	files  []string
+
+	// seen holds the directories read so far when following symbolic
+	// links, guarded by seenmu.
+	seenmu sync.Mutex
+	seen   map[fileKey]bool
+}
+
+// visit reports whether the directory at path hasn't been read yet,
+// marking it as read.
+func (w *walker) visit(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	key := fileKeyOf(path, info)
+	w.seenmu.Lock()
+	defer w.seenmu.Unlock()
+	if w.seen[key] {
+		return false
+	}
+	w.seen[key] = true
+	return true
+}
+
+// wanted reports whether path is, or is beneath, one of the paths the walk is
+// restricted to, or is a directory containing one.
+func (w *walker) wanted(path string, isdir bool) bool {
+	if w.within == nil || withinAny(path, w.within) {
+		return true
+	}
+	if !isdir {
+		return false
+	}
+	for _, p := range w.within {
+		if withinAny(p, []string{path}) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *walker) work() {
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && w.active > 0 {
+			w.cond.Wait()
+		}
+		if len(w.queue) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		dir := w.queue[len(w.queue)-1]
+		w.queue = w.queue[:len(w.queue)-1]
+		w.active++
+		w.mu.Unlock()
+
+		subdirs, files := w.readDir(dir)
+
+		w.mu.Lock()
+		w.queue = append(w.queue, subdirs...)
+		w.files = append(w.files, files...)
+		w.active--
+		w.cond.Broadcast()
+		w.mu.Unlock()
+	}
+}
+
+// readDir returns the subdirectories of dir to walk, and the files within dir
+// which pass the filter. An unreadable directory is skipped, as grep does.
+func (w *walker) readDir(dir walkDir) ([]walkDir, []string) {
+	entries, err := os.ReadDir(dir.path)
+	if err != nil {
+		log.WithField("path", dir.path).Warnf("cannot read directory: %v", err)
+		return nil, nil
+	}
+	patterns := dir.patterns
+	if w.filter.ignoreFiles && hasIgnoreFile(entries) {
+		if own := readIgnoreFiles(dir.path, dir.components); len(own) > 0 {
+			// The slice of patterns is shared with the siblings of dir, so
+			// it must be copied rather than appended to in place.
+			patterns = append(patterns[:len(patterns):len(patterns)], own...)
+		}
+	}
+	subdirs := []walkDir{}
+	files := []string{}
+	for _, entry := range entries {
+		path := filepath.Join(dir.path, entry.Name())
+		components := append(dir.components[:len(dir.components):len(dir.components)], entry.Name())
+		isdir, regular := entry.IsDir(), entry.Type().IsRegular()
+		if entry.Type()&os.ModeSymlink != 0 && w.filter.followSymlinks {
+			info, err := os.Stat(path)
+			if err != nil {
+				log.WithField("path", path).Debugf("skipping broken symbolic link: %v", err)
+				continue
+			}
+			isdir, regular = info.IsDir(), info.Mode().IsRegular()
+		}
+		if !w.wanted(path, isdir) {
+			continue
+		}
+		if isdir {
+			if entry.Name() == ".git" || isIgnoredPath(path, w.filter.ignorepaths) || matchPatterns(components, true, patterns, w.excludes) {
+				continue
+			}
+			if w.seen != nil && !w.visit(path) {
+				log.WithField("path", path).Debug("skipping directory which was already searched")
+				continue
+			}
+			subdirs = append(subdirs, walkDir{path: path, components: components, patterns: patterns})
+			continue
+		}
+		if !regular || isIgnoredPath(path, w.filter.ignorepaths) || matchPatterns(components, false, patterns, w.excludes) {
+			continue
+		}
+		if w.includes != nil && !w.includes.Match(components, false) {
+			continue
+		}
+		files = append(files, path)
+	}
+	return subdirs, files
+}
@@ -0,0 +1,143 @@
+package docfinder
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// relFiles returns paths relative to dir, sorted.
+func relFiles(t *testing.T, dir string, paths []string) []string {
+	rels := []string{}
+	for _, p := range paths {
+		rel, err := filepath.Rel(dir, p)
+		require.NoError(t, err)
+		rels = append(rels, filepath.ToSlash(rel))
+	}
+	sort.Strings(rels)
+	return rels
+}
+
+func TestWalkFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".git/HEAD":                  "ref: refs/heads/main\n",
+		".git/info/exclude":          "secret.md\n",
+		".gitignore":                 "# build outputs\nnode_modules/\n*.log\n/build\n",
+		".omegadocignore":            "!keep.log\ndraft/\n",
+		"a.md":                       "",
+		"secret.md":                  "",
+		"debug.log":                  "",
+		"keep.log":                   "",
+		"build/out.md":               "",
+		"node_modules/pkg/README.md": "",
+		"src/build/b.md":             "",
+		"src/.gitignore":             "gen.md\n",
+		"src/gen.md":                 "",
+		"src/c.go":                   "",
+		"src/draft/d.md":             "",
+		"other/gen.md":               "",
+	})
+	type tst struct {
+		Root   string
+		Filter pathFilter
+		Exp    []string
+	}
+	for tidx, test := range []tst{
+		{Root: "", Filter: pathFilter{ignoreFiles: true},
+			Exp: []string{".gitignore", ".omegadocignore", "a.md", "keep.log", "other/gen.md", "src/.gitignore", "src/build/b.md", "src/c.go"}},
+		// The ignore files above the search root, up to the top of the
+		// working tree, apply as well.
+		{Root: "src", Filter: pathFilter{ignoreFiles: true},
+			Exp: []string{"src/.gitignore", "src/build/b.md", "src/c.go"}},
+		{Root: "", Filter: pathFilter{ignoreFiles: true, excludes: []string{"*.go", "other/", ".*"}},
+			Exp: []string{"a.md", "keep.log", "src/build/b.md"}},
+		// Excludes take priority over the ignore files.
+		{Root: "", Filter: pathFilter{ignoreFiles: true, excludes: []string{"!debug.log"}, includes: []string{"*.log"}},
+			Exp: []string{"debug.log", "keep.log"}},
+		{Root: "src", Filter: pathFilter{ignoreFiles: true, includes: []string{"/build"}},
+			Exp: []string{"src/build/b.md"}},
+		{Root: "", Filter: pathFilter{ignoreFiles: true, ignorepaths: []string{filepath.Join(dir, "src")}},
+			Exp: []string{".gitignore", ".omegadocignore", "a.md", "keep.log", "other/gen.md"}},
+		{Root: "src", Filter: pathFilter{ignoreFiles: false},
+			Exp: []string{"src/.gitignore", "src/build/b.md", "src/c.go", "src/draft/d.md", "src/gen.md"}},
+		// A file given as the search root is searched even if it's ignored.
+		{Root: "debug.log", Filter: pathFilter{ignoreFiles: true},
+			Exp: []string{"debug.log"}},
+	} {
+		found, err := walkFiles(filepath.Join(dir, test.Root), test.Filter, 4)
+		require.NoError(t, err, "test #%d", tidx)
+		require.Equal(t, test.Exp, relFiles(t, dir, found), "test #%d", tidx)
+	}
+}
+
+func TestWalkFilesWithin(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		".gitignore":        "gen.md\n",
+		"a.md":              "",
+		"src/gen.md":        "",
+		"src/c.go":          "",
+		"src/sub/d.md":      "",
+		"other/e.md":        "",
+		"src/sub/.git/f.md": "",
+	})
+	type tst struct {
+		Within []string
+		Exp    []string
+	}
+	for tidx, test := range []tst{
+		{Within: []string{"src/c.go", "other"},
+			Exp: []string{"other/e.md", "src/c.go"}},
+		// The ignore files of the directories on the way are read, so an
+		// ignored file isn't found even when it's given itself.
+		{Within: []string{"src/gen.md", "src/sub"},
+			Exp: []string{"src/sub/d.md"}},
+		{Within: []string{"missing", "src/missing.md"},
+			Exp: []string{}},
+		{Within: []string{""},
+			Exp: []string{".gitignore", "a.md", "other/e.md", "src/c.go", "src/sub/d.md"}},
+	} {
+		within := []string{}
+		for _, w := range test.Within {
+			within = append(within, filepath.Join(dir, w))
+		}
+		found, err := walkFilesWithin(dir, within, pathFilter{ignoreFiles: true}, 4)
+		require.NoError(t, err, "test #%d", tidx)
+		require.Equal(t, test.Exp, relFiles(t, dir, found), "test #%d", tidx)
+	}
+}
+
+func TestFindSourcesIgnore(t *testing.T) {
+	dir := t.TempDir()
+	def := domain.START_OMEGADOC + "EOD a.md\nhi\nEOD\n"
+	writeFiles(t, dir, map[string]string{
+		".gitignore":            "vendor/\n",
+		"a.md":                  def,
+		"vendor/lib/a.md":       def,
+		"docs/.omegadocignore":  "*.txt\n",
+		"docs/b.md":             def,
+		"docs/c.txt":            def,
+		"docs/nothing.md":       "nothing here\n",
+		"docs/deeper/d.txt":     def,
+		"docs/deeper/e.md":      def,
+		"docs/deeper/f.md.orig": def,
+	})
+	// A missing directory is an error.
+	_, err := NewDocFinder().FindSources(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+
+	sources, err := NewDocFinder(WithExcludes("*.orig")).FindSources(dir)
+	require.NoError(t, err)
+	found := []string{}
+	for _, src := range sources {
+		found = append(found, src.Path)
+		rdr, err := src.Open()
+		require.NoError(t, err)
+		require.NoError(t, rdr.Close())
+	}
+	require.Equal(t, []string{"a.md", "docs/b.md", "docs/deeper/e.md"}, relFiles(t, dir, found))
+}
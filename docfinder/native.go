@@ -0,0 +1,232 @@
+package docfinder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"unicode/utf16"
+
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// searchChunkSize is how much of a file the native search reads at a time.
+const searchChunkSize = 64 << 10
+
+// magicNeedles are the prefixes of the magic strings, and the escape which
+// cancels them, encoded as they'd appear in text of one encoding.
+type magicNeedles struct {
+	prefixes [][]byte
+	escape   []byte
+	// unit is the size in bytes of a code unit of the encoding. A match must
+	// begin at an offset in the file which is a multiple of unit.
+	unit int
+	// carry is how many bytes at the end of each chunk are searched again
+	// along with the next chunk, so that a prefix split between chunks, and
+	// the escape preceding it, are found.
+	carry int
+}
+
+func newMagicNeedles(syntaxes []domain.MagicSyntax, encode func(string) []byte, unit int) magicNeedles {
+	mn := magicNeedles{escape: encode(domain.ESCAPE_OMEGADOC), unit: unit}
+	for _, syn := range syntaxes {
+		p := encode(syn.Prefix)
+		mn.prefixes = append(mn.prefixes, p)
+		if c := len(p) + len(mn.escape) - 1; c > mn.carry {
+			mn.carry = c
+		}
+	}
+	return mn
+}
+
+func encodeUTF16(order binary.ByteOrder) func(string) []byte {
+	return func(s string) []byte {
+		units := utf16.Encode([]rune(s))
+		b := make([]byte, 2*len(units))
+		for i, u := range units {
+			order.PutUint16(b[2*i:], u)
+		}
+		return b
+	}
+}
+
+// index returns the index within window of the first prefix which isn't
+// escaped, or -1 if there's none. offset is the offset within the file of
+// window[0].
+func (mn *magicNeedles) index(window []byte, offset int64) int {
+	best := -1
+	for _, p := range mn.prefixes {
+		for from := 0; from < len(window); {
+			i := bytes.Index(window[from:], p)
+			if i == -1 {
+				break
+			}
+			i += from
+			from = i + 1
+			if best != -1 && i >= best {
+				break
+			}
+			if (offset+int64(i))%int64(mn.unit) != 0 {
+				continue
+			}
+			if i < len(mn.escape) {
+				// Without the bytes before the match it can't be checked for
+				// an escape, but unless this is the start of the file, the
+				// match was within the carry and was already checked.
+				if offset > 0 {
+					continue
+				}
+			} else if bytes.Equal(window[i-len(mn.escape):i], mn.escape) {
+				continue
+			}
+			best = i
+			break
+		}
+	}
+	return best
+}
+
+// searcher searches files for magic strings. Each searcher has its own
+// buffer, so a searcher may only search one file at a time.
+type searcher struct {
+	utf8, utf16le, utf16be magicNeedles
+	buf                    []byte
+}
+
+func newSearcher(syntaxes []domain.MagicSyntax) *searcher {
+	s := &searcher{
+		utf8:    newMagicNeedles(syntaxes, func(s string) []byte { return []byte(s) }, 1),
+		utf16le: newMagicNeedles(syntaxes, encodeUTF16(binary.LittleEndian), 2),
+		utf16be: newMagicNeedles(syntaxes, encodeUTF16(binary.BigEndian), 2),
+	}
+	carry := s.utf8.carry
+	if s.utf16le.carry > carry {
+		carry = s.utf16le.carry
+	}
+	s.buf = make([]byte, carry+searchChunkSize)
+	return s
+}
+
+// search reports whether r contains an unescaped magic string prefix,
+// reading no further than the first one. Text which domain.DetectEncoding,
+// as used by the parser, finds to be UTF-16 is searched as UTF-16. Otherwise,
+// as with grep's --binary-files=without-match, text containing a NUL byte
+// before the first magic string is considered binary and not to match.
+func (s *searcher) search(r io.Reader) (bool, error) {
+	var offset int64
+	n, err := io.ReadFull(r, s.buf[:searchChunkSize])
+	window := s.buf[:n]
+	mn, binarycheck := &s.utf8, true
+	switch enc, _ := domain.DetectEncoding(window); enc {
+	case domain.EncodingUTF16LE:
+		mn, binarycheck = &s.utf16le, false
+	case domain.EncodingUTF16BE:
+		mn, binarycheck = &s.utf16be, false
+	}
+	for {
+		eof := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !eof {
+			return false, err
+		}
+		idx := mn.index(window, offset)
+		if binarycheck {
+			if nul := bytes.IndexByte(window, 0); nul != -1 && (idx == -1 || nul < idx) {
+				return false, nil
+			}
+		}
+		if idx != -1 {
+			return true, nil
+		}
+		if eof {
+			return false, nil
+		}
+		keep := mn.carry
+		if keep > len(window) {
+			keep = len(window)
+		}
+		copy(s.buf, window[len(window)-keep:])
+		offset += int64(len(window) - keep)
+		n, err = io.ReadFull(r, s.buf[keep:keep+searchChunkSize])
+		window = s.buf[:keep+n]
+	}
+}
+
+func (s *searcher) searchFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return s.search(f)
+}
+
+// NativeSearch returns a SearchFunc which searches files within this program,
+// with up to workers files searched at once. Each file is read only up to the
+// first magic string. Unlike grep, files in UTF-16, whether or not they
+// begin with a byte order mark, are searched as UTF-16 text. Files which
+// can't be read are skipped, except when no more files may be opened, which
+// fails the search rather than silently missing files.
+// If workers is less than 1, the number of CPUs is used.
+func NativeSearch(workers int) SearchFunc {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	return func(paths []string, syntaxes []domain.MagicSyntax) ([]string, error) {
+		matches := []string{}
+		var failed error
+		mu := sync.Mutex{}
+		wg := sync.WaitGroup{}
+		todo := make(chan string)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s := newSearcher(syntaxes)
+				for path := range todo {
+					found, err := s.searchFile(path)
+					if tooManyFiles(err) {
+						mu.Lock()
+						if failed == nil {
+							failed = fmt.Errorf("cannot search %q for OmegaDocs: %w", path, err)
+						}
+						mu.Unlock()
+						continue
+					}
+					if err != nil {
+						log.WithField("path", path).Warnf("cannot search file for OmegaDocs: %v", err)
+						continue
+					}
+					if found {
+						mu.Lock()
+						matches = append(matches, path)
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, path := range paths {
+			todo <- path
+		}
+		close(todo)
+		wg.Wait()
+		if failed != nil {
+			return nil, failed
+		}
+		sort.Strings(matches)
+		return matches, nil
+	}
+}
+
+// tooManyFiles reports whether err is due to the process, or the system,
+// having as many files open as it may.
+func tooManyFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
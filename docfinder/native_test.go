@@ -0,0 +1,101 @@
+package docfinder
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+func TestSearcherSearch(t *testing.T) {
+	open := domain.START_OMEGADOC
+	esc := domain.ESCAPE_OMEGADOC
+	le := func(s string) string { return string(bomUTF16LE) + string(encodeUTF16(binary.LittleEndian)(s)) }
+	be := func(s string) string { return string(bomUTF16BE) + string(encodeUTF16(binary.BigEndian)(s)) }
+	// pad is text which, followed by n bytes, ends a chunk.
+	pad := func(n int) string { return strings.Repeat("x", searchChunkSize-n) }
+	type tst struct {
+		Def string
+		Exp bool
+	}
+	for tidx, test := range []tst{
+		{Def: "", Exp: false},
+		{Def: open + "EOD a.md\n", Exp: true},
+		{Def: "// " + open + "EOD a.md\n", Exp: true},
+		{Def: domain.INCLUDE_OMEGADOC + " a.md\n", Exp: true},
+		{Def: esc + open + "EOD a.md\n", Exp: false},
+		{Def: esc + open + "EOD a.md\n" + open + "EOD a.md\n", Exp: true},
+		{Def: "nothing\n", Exp: false},
+		// Binary files don't match unless the magic string comes first.
+		{Def: "\x00" + open + "EOD a.md\n", Exp: false},
+		{Def: open + "EOD a.md\n\x00", Exp: true},
+		{Def: pad(0) + "\x00" + open, Exp: false},
+		// Magic strings split between chunks.
+		{Def: pad(5) + open, Exp: true},
+		{Def: pad(len(open)) + open, Exp: true},
+		{Def: pad(len(open)-1) + open, Exp: true},
+		{Def: pad(1) + esc + open, Exp: false},
+		{Def: pad(1) + esc + open + "x" + open, Exp: true},
+		{Def: strings.Repeat(pad(0), 3) + open, Exp: true},
+		// UTF-16 text is found by its byte order mark.
+		{Def: le("text\n" + open + "EOD a.md\n"), Exp: true},
+		{Def: be("text\n" + open + "EOD a.md\n"), Exp: true},
+		{Def: le(esc + open + "EOD a.md\n"), Exp: false},
+		{Def: be("text\n" + esc + open + "EOD a.md\n"), Exp: false},
+		{Def: le(strings.Repeat("x", searchChunkSize/2-3) + open), Exp: true},
+		// UTF-16 text without a byte order mark is found as the parser finds
+		// it, when it's mostly ASCII.
+		{Def: string(encodeUTF16(binary.LittleEndian)("text\n" + open + "EOD a.md\n")), Exp: true},
+		{Def: string(encodeUTF16(binary.BigEndian)("text\n" + open + "EOD a.md\n")), Exp: true},
+		{Def: string(encodeUTF16(binary.LittleEndian)(esc + open + "EOD a.md\n")), Exp: false},
+		// A match must be aligned with the code units of UTF-16.
+		{Def: string(bomUTF16LE) + "x" + string(encodeUTF16(binary.LittleEndian)(open)), Exp: false},
+	} {
+		found, err := newSearcher([]domain.MagicSyntax{domain.DefaultMagicSyntax}).search(strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Equal(t, test.Exp, found, "test #%d", tidx)
+	}
+}
+
+func TestSearchFuncsAgree(t *testing.T) {
+	dir := t.TempDir()
+	colon, err := domain.ParseMagicSyntax("omegadoc:begin")
+	require.NoError(t, err)
+	writeFiles(t, dir, map[string]string{
+		"start.md":          domain.START_OMEGADOC + "EOD a.md\nhi\nEOD\n",
+		"middle.go":         "// " + domain.START_OMEGADOC + "EOD a.md\n",
+		"escaped.md":        "an example: " + domain.ESCAPE_OMEGADOC + domain.START_OMEGADOC + "EOD a.md\n",
+		"none.md":           "nothing to see here\n",
+		"binary.bin":        "\x00\x01" + domain.START_OMEGADOC + "EOD a.md\n",
+		"colon.sql":         "-- " + colon.StartString() + " EOD a.md\n",
+		"new\nline.md":      domain.START_OMEGADOC + "EOD a.md\n",
+		"deep/er/space .md": domain.START_OMEGADOC + "EOD a.md\n",
+	})
+	paths, err := walkFiles(dir, pathFilter{}, 2)
+	require.NoError(t, err)
+	exp := []string{}
+	for _, name := range []string{"colon.sql", "deep/er/space .md", "middle.go", "new\nline.md", "start.md"} {
+		exp = append(exp, filepath.Join(dir, name))
+	}
+	syntaxes := []domain.MagicSyntax{domain.DefaultMagicSyntax, colon}
+	for _, name := range []string{"native", "grep", "rg"} {
+		search, err := SearchFuncByName(name, 2)
+		if err != nil {
+			t.Logf("skipping the %q finder: %v", name, err)
+			continue
+		}
+		found, err := search(paths, syntaxes)
+		require.NoError(t, err, "finder %q", name)
+		require.ElementsMatch(t, exp, found, "finder %q", name)
+	}
+	_, err = SearchFuncByName("ag", 2)
+	require.Error(t, err)
+}
@@ -0,0 +1,61 @@
+//go:build !windows
+// +build !windows
+
+package docfinder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWalkFilesSymlinks(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	def := domain.START_OMEGADOC + "EOD a.md\nhi\nEOD\n"
+	writeFiles(t, dir, map[string]string{
+		"cache/repo/a.md":     def,
+		"cache/repo/sub/b.md": def,
+		"clones/own.md":       def,
+	})
+	for link, target := range map[string]string{
+		"clones/one":     "../cache/repo",
+		"clones/two":     "../cache/repo",
+		"clones/file.md": "../cache/repo/a.md",
+		// Loops back to a directory containing the link.
+		"cache/repo/sub/up": "../..",
+		"clones/broken":     "../missing",
+	} {
+		require.NoError(t, os.Symlink(target, filepath.Join(dir, link)))
+	}
+
+	type tst struct {
+		Root   string
+		Filter pathFilter
+		Exp    []string
+	}
+	for tidx, test := range []tst{
+		// As with grep -r, links beneath the root are skipped by default.
+		{Root: "clones", Filter: pathFilter{},
+			Exp: []string{"clones/own.md"}},
+		// But a root which is a link is followed.
+		{Root: "clones/one", Filter: pathFilter{},
+			Exp: []string{"clones/one/a.md", "clones/one/sub/b.md"}},
+		// Each file is found once, by its canonical path.
+		{Root: "clones", Filter: pathFilter{followSymlinks: true},
+			Exp: []string{"cache/repo/a.md", "cache/repo/sub/b.md", "clones/own.md"}},
+		{Root: "clones", Filter: pathFilter{followSymlinks: true, excludes: []string{"two/sub/"}},
+			Exp: []string{"cache/repo/a.md", "cache/repo/sub/b.md", "clones/own.md"}},
+		{Root: "clones", Filter: pathFilter{followSymlinks: true, excludes: []string{"sub/"}},
+			Exp: []string{"cache/repo/a.md", "clones/own.md"}},
+		{Root: "cache", Filter: pathFilter{followSymlinks: true},
+			Exp: []string{"cache/repo/a.md", "cache/repo/sub/b.md"}},
+	} {
+		found, err := walkFiles(filepath.Join(dir, test.Root), test.Filter, 4)
+		require.NoError(t, err, "test #%d", tidx)
+		require.Equal(t, test.Exp, relFiles(t, dir, found), "test #%d", tidx)
+	}
+}
@@ -0,0 +1,62 @@
+package docparser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// genSource returns roughly size bytes of Go-like source. If docs is true,
+// an OmegaDoc is placed about every hundred lines.
+func genSource(size int, docs bool) []byte {
+	buf := &bytes.Buffer{}
+	for i := 0; buf.Len() < size; i++ {
+		if docs && i%100 == 0 {
+			fmt.Fprintf(buf, "\t// %sEOD section:%04d docs/generated.md\n", domain.START_OMEGADOC, i)
+			fmt.Fprintf(buf, "\t// Field%d holds a generated value. It's documented here so the\n", i)
+			fmt.Fprintf(buf, "\t// documentation is next to the code.\n\t// EOD\n")
+		}
+		fmt.Fprintf(buf, "\tField%d string `json:\"field_%d,omitempty\"` // comment with ünïcödé #%d\n", i, i, i)
+	}
+	return buf.Bytes()
+}
+
+// onlyReader hides any other methods of the wrapped reader, such as Seek.
+type onlyReader struct {
+	io.Reader
+}
+
+func benchmarkParse(b *testing.B, data []byte, wrap func(io.Reader) io.Reader) {
+	lvl := log.GetLevel()
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(lvl)
+	dp := NewDocParser()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := dp.ParseDocStream("/nonexistent/bench.go", wrap(bytes.NewReader(data)), func(domain.OmegaDoc) error {
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseNoDocs(b *testing.B) {
+	benchmarkParse(b, genSource(8<<20, false), func(r io.Reader) io.Reader { return r })
+}
+
+func BenchmarkParseManyDocs(b *testing.B) {
+	benchmarkParse(b, genSource(8<<20, true), func(r io.Reader) io.Reader { return r })
+}
+
+func BenchmarkParseNoDocsUnseekable(b *testing.B) {
+	benchmarkParse(b, genSource(8<<20, false), func(r io.Reader) io.Reader { return onlyReader{r} })
+}
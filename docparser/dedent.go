@@ -0,0 +1,110 @@
+package docparser
+
+import (
+	"strings"
+	"unicode"
+)
+
+// INDENT_ATTR is the attribute which controls whether the common indentation
+// of the contents of an OmegaDoc is removed. Its value may be INDENT_STRIP
+// (the default) or INDENT_KEEP.
+const INDENT_ATTR string = "indent"
+const INDENT_STRIP string = "strip"
+const INDENT_KEEP string = "keep"
+
+// IndentMode returns the value of the "indent" attribute of this OmegaDoc, or
+// INDENT_STRIP if the attribute isn't set. Other values are rejected when the
+// opening statement is parsed.
+func (po *parseOdoc) IndentMode() string {
+	for _, att := range po.Attrs {
+		if strings.ToLower(att.Key) == INDENT_ATTR {
+			return strings.ToLower(att.Value)
+		}
+	}
+	return INDENT_STRIP
+}
+
+// validIndentMode reports whether mode is a value of the "indent" attribute
+// which IndentMode understands.
+func validIndentMode(mode string) bool {
+	switch strings.ToLower(mode) {
+	case INDENT_STRIP, INDENT_KEEP:
+		return true
+	}
+	return false
+}
+
+// dedent removes the longest common leading whitespace from every line of
+// contents. Leading whitespace is compared rune by rune, so a tab and a
+// space are never considered equal; a body indented with tabs on some lines
+// and spaces on others will only have the whitespace common to all of them
+// removed (which may be none). Lines consisting entirely of whitespace don't
+// count towards the common indentation, and are reduced to just their
+// newline. The number of lines is never changed.
+func dedent(contents []rune) []rune {
+	lines := splitLines(contents)
+	var margin []rune
+	found := false
+	for _, line := range lines {
+		if isBlank(line) {
+			continue
+		}
+		indent := leadingSpace(line)
+		if !found {
+			margin = indent
+			found = true
+			continue
+		}
+		i := 0
+		for i < len(margin) && i < len(indent) && margin[i] == indent[i] {
+			i++
+		}
+		margin = margin[:i]
+	}
+
+	out := make([]rune, 0, len(contents))
+	for _, line := range lines {
+		if isBlank(line) {
+			if line[len(line)-1] == '\n' {
+				out = append(out, '\n')
+			}
+			continue
+		}
+		out = append(out, line[len(margin):]...)
+	}
+	return out
+}
+
+// splitLines splits runes into lines, each retaining its trailing newline
+// (the final line may lack one).
+func splitLines(rs []rune) [][]rune {
+	lines := [][]rune{}
+	start := 0
+	for i, r := range rs {
+		if r == '\n' {
+			lines = append(lines, rs[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(rs) {
+		lines = append(lines, rs[start:])
+	}
+	return lines
+}
+
+func isBlank(line []rune) bool {
+	for _, r := range line {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func leadingSpace(line []rune) []rune {
+	i := 0
+	for i < len(line) && line[i] != '\n' && unicode.IsSpace(line[i]) {
+		i++
+	}
+	return line[:i]
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"os"
 	"unicode"
 
 	"github.com/lelandbatey/omegadoc/domain"
@@ -13,6 +13,12 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Version identifies the behavior of the DocParsers of this package. It must
+// be changed whenever a change to them changes what they parse from the same
+// file, so that OmegaDocs parsed by an earlier version, such as those kept
+// by a domain.DocCache, aren't used in place of parsing the file again.
+const Version = "2"
+
 // RequiredParseError represents an error which cannot be skipped and which is
 // NOT safe to ignore.
 type RequiredParseError struct {
@@ -29,12 +35,83 @@ func (e *RequiredParseError) Unwrap() error {
 
 type docfinder struct {
 	urlfinder gitURLFinder
+	// substringDelims enables the legacy behavior where the delimiting
+	// identifier ends an OmegaDoc wherever it appears, instead of only when
+	// it's alone on its own line.
+	substringDelims bool
+	// lineEndings controls whether the line endings of the contents are
+	// normalized to newlines or kept as they were in the source.
+	lineEndings LineEndings
+	// magic holds the syntaxes of the magic strings which are recognized.
+	magic magicSet
+	// languageAware restricts magic strings to comments in files whose
+	// language is known.
+	languageAware bool
+	// language, when set, is used as the comment syntax of the text being
+	// parsed instead of the one guessed from its path, as for the code cells
+	// of a notebook.
+	language *commentSyntax
+}
+
+// Option configures optional behavior of the DocParser returned by
+// NewDocParser.
+type Option func(*docfinder)
+
+// WithSubstringDelimiters enables (or disables) the legacy behavior where an
+// OmegaDoc is ended by its delimiting identifier appearing anywhere, even in
+// the middle of a line. By default the delimiting identifier only ends an
+// OmegaDoc when it's alone on its own line.
+func WithSubstringDelimiters(enabled bool) Option {
+	return func(df *docfinder) {
+		df.substringDelims = enabled
+	}
 }
 
-func NewDocParser() domain.DocParser {
-	return docfinder{
+// WithLineEndings sets how the line endings of the contents of each OmegaDoc
+// are written. By default every line ending, including CRLF, is normalized to
+// a newline. Opening statements are always read with CRLFs treated as
+// newlines, so a CRLF never ends up in a destination file path.
+func WithLineEndings(endings LineEndings) Option {
+	return func(df *docfinder) {
+		df.lineEndings = endings
+	}
+}
+
+// WithMagicSyntaxes sets the syntaxes of the magic strings which are
+// recognized, replacing the default of only domain.DefaultMagicSyntax. Each
+// syntax should be valid according to domain.MagicSyntax.Validate.
+func WithMagicSyntaxes(syntaxes ...domain.MagicSyntax) Option {
+	return func(df *docfinder) {
+		df.magic = newMagicSet(syntaxes)
+	}
+}
+
+// WithLanguageAware enables (or disables) language-aware parsing. When
+// enabled, magic strings in files of a known language (such as Go, Python,
+// shell, SQL, YAML, HTML and the C family, known by their file extension) are
+// only recognized within comments, so magic strings within string literals
+// are ignored. The comment markup on the lines of each OmegaDoc is removed as
+// well, even for comments which don't begin their line. Files of other
+// languages are parsed as usual.
+func WithLanguageAware(enabled bool) Option {
+	return func(df *docfinder) {
+		df.languageAware = enabled
+	}
+}
+
+func NewDocParser(opts ...Option) domain.DocParser {
+	return newDocfinder(opts...)
+}
+
+func newDocfinder(opts ...Option) docfinder {
+	df := docfinder{
 		urlfinder: newGitURLFinder(),
+		magic:     newMagicSet([]domain.MagicSyntax{domain.DefaultMagicSyntax}),
+	}
+	for _, opt := range opts {
+		opt(&df)
 	}
+	return df
 }
 
 type oatt struct {
@@ -50,6 +127,14 @@ type parseOdoc struct {
 	Contents        []rune
 	Attrs           []oatt
 	StartLineNumber int
+	StartColumn     int
+	EndLineNumber   int
+
+	HeaderStartOffset int64
+	HeaderEndOffset   int64
+	BodyStartOffset   int64
+	BodyEndOffset     int64
+	DelimiterOffset   int64
 	//HTTPUrl string
 }
 
@@ -76,119 +161,70 @@ func (po *parseOdoc) MakeOmegaDoc() domain.OmegaDoc {
 		Contents:        string(po.Contents),
 		Attributes:      attrs,
 		StartLineNumber: po.StartLineNumber,
-	}
-}
+		StartColumn:     po.StartColumn,
+		EndLineNumber:   po.EndLineNumber,
 
-func (df docfinder) ParseDoc(srcpath string, data io.Reader) ([]domain.OmegaDoc, error) {
-	l := log.WithField("srcpath", srcpath)
-	odocs, err := df.parseDoc(srcpath, data)
-	if err != nil {
-		return nil, err
+		HeaderStartOffset: po.HeaderStartOffset,
+		HeaderEndOffset:   po.HeaderEndOffset,
+		BodyStartOffset:   po.BodyStartOffset,
+		BodyEndOffset:     po.BodyEndOffset,
+		DelimiterOffset:   po.DelimiterOffset,
 	}
-	newodocs := []domain.OmegaDoc{}
-	for _, od := range odocs {
-		url, err := df.urlfinder.GetURL(od.SourceFilePath, od.StartLineNumber)
-		if err != nil {
-			l.Warnf("cannot find URL for document %q: %v", od.SourceFilePath, err)
-		} else {
-			l.WithField("url", url).Infof("URL for %q found", od.SourceFilePath)
-		}
-		od.HTTPUrl = url
-		newodocs = append(newodocs, od)
-	}
-	return newodocs, nil
-}
-
-const COMMON_PREFIX string = "#!/usr/bin/env omegadoc "
-
-var BEGINDOC_MAGICRUNES []rune = []rune(strings.ReplaceAll(domain.START_OMEGADOC, COMMON_PREFIX, ""))
-var IGNORDOC_MAGICRUNES []rune = []rune(strings.ReplaceAll(domain.IGNORE_OMEGADOC, COMMON_PREFIX, ""))
-
-type odScanner struct {
-	Rdr    *bufio.Reader
-	LineNo int
-	Prior  rune
 }
 
-func (ods *odScanner) ReadRune() (rune, int, error) {
-	r, s, err := ods.Rdr.ReadRune()
-	ods.Prior = r
-	if r == '\n' {
-		ods.LineNo++
-	}
-	return r, s, err
+func (df docfinder) ParseDoc(srcpath string, data io.Reader) ([]domain.OmegaDoc, []domain.Diagnostic, error) {
+	return collectDocs(df.ParseDocStream, srcpath, data)
 }
 
-func (ods *odScanner) UnreadRune() error {
-	if ods.Prior == '\n' {
-		ods.LineNo -= 1
+// collectDocs implements ParseDoc using the ParseDocStream of a DocParser.
+func collectDocs(stream func(string, io.Reader, func(domain.OmegaDoc) error) ([]domain.Diagnostic, error), srcpath string, data io.Reader) ([]domain.OmegaDoc, []domain.Diagnostic, error) {
+	odocs := []domain.OmegaDoc{}
+	diags, err := stream(srcpath, data, func(od domain.OmegaDoc) error {
+		odocs = append(odocs, od)
+		return nil
+	})
+	if err != nil {
+		return nil, diags, err
 	}
-	ods.Prior = rune(0)
-	return ods.Rdr.UnreadRune()
+	return odocs, diags, nil
 }
 
-func (ods *odScanner) LineNumber() int {
-	return ods.LineNo
+// ParseDocStream parses the OmegaDocs in data just like ParseDoc, except that
+// each OmegaDoc is passed to emit as soon as it's been parsed instead of all
+// of them being returned at the end. If emit returns an error, parsing stops
+// and that error is returned.
+func (df docfinder) ParseDocStream(srcpath string, data io.Reader, emit func(domain.OmegaDoc) error) ([]domain.Diagnostic, error) {
+	l := log.WithField("srcpath", srcpath)
+	rev := domain.ReaderRevision(data)
+	return df.parseDoc(srcpath, data, func(od domain.OmegaDoc) error {
+		od.Revision = rev
+		df.setURL(l, &od, od.StartLineNumber, od.EndLineNumber)
+		return emit(od)
+	})
 }
 
-// Returns the next group of runes in a logical group. There are three possible
-// groups: a group of non-whitespace characters, a single newline, and a group
-// of non-newline whitespace characters.
-func (ods *odScanner) ReadRuneGroup() ([]rune, error) {
-	buf := []rune{}
-
-	ch, _, err := ods.ReadRune()
+// setURL sets the HTTPUrl of od to the URL of the lines from startline to
+// endline of its source file at its revision, as described by
+// gitURLFinder.GetURL.
+func (df docfinder) setURL(l *log.Entry, od *domain.OmegaDoc, startline, endline int) {
+	url, err := df.urlfinder.GetURL(od.SourceFilePath, od.Revision, startline, endline)
 	if err != nil {
-		return nil, err
-	}
-	buf = append(buf, ch)
-	if ch == '\n' {
-		// A single newline
-		return buf, nil
-	} else if unicode.IsSpace(ch) {
-		// A group of non-newline whitespace characters
-		for {
-			ch, _, err = ods.ReadRune()
-			if err != nil {
-				return buf, err
-			}
-			if !unicode.IsSpace(ch) || ch == '\n' {
-				err = ods.UnreadRune()
-				if err != nil {
-					return buf, err
-				}
-				return buf, nil
-			} else {
-				buf = append(buf, ch)
-			}
-		}
+		l.Warnf("cannot find URL for document %q: %v", od.SourceFilePath, err)
 	} else {
-		// A group of non-whitespace characters
-		for {
-			ch, _, err = ods.ReadRune()
-			if err != nil {
-				return buf, err
-			}
-			if unicode.IsSpace(ch) {
-				err = ods.UnreadRune()
-				if err != nil {
-					return buf, err
-				}
-				return buf, nil
-			}
-			buf = append(buf, ch)
-		}
+		l.WithField("url", url).Infof("URL for %q found", od.SourceFilePath)
 	}
+	od.HTTPUrl = url
 }
 
-// FFTillMagicCommon moves through the odScanner till the underlying reader is
-// just after the string "#!/usr/bin/env omegadoc ", which is the common prefix
-// to both "magic strings" of OmegaDoc: the 'ignore directive' and the 'opening
-// statement'.
-func (ods *odScanner) FFTillMagicCommon() error {
-	_, err := readTillSentinel([]rune(COMMON_PREFIX), ods)
-	return err
-}
+// COMMON_PREFIX is the common prefix of the magic strings of the default
+// syntax, domain.DefaultMagicSyntax.
+var COMMON_PREFIX string = domain.DefaultMagicSyntax.Prefix
+
+// MAGIC_ESCAPE is the rune which, when immediately preceding the common
+// prefix, causes that occurrence of the common prefix to be treated as
+// ordinary text. Within the contents of an OmegaDoc the escaping rune is
+// removed, leaving the literal magic string.
+var MAGIC_ESCAPE rune = []rune(domain.ESCAPE_OMEGADOC)[0]
 
 func runesEqual(a, b []rune) bool {
 	if len(a) != len(b) {
@@ -202,139 +238,471 @@ func runesEqual(a, b []rune) bool {
 	return true
 }
 
-func readTillSentinel(sentinel []rune, ods *odScanner) ([]rune, error) {
-	buf := []rune{}
-	pos := 0
+func runesIndex(haystack, needle []rune) int {
+	for i := 0; i+len(needle) <= len(haystack); i++ {
+		if runesEqual(haystack[i:i+len(needle)], needle) {
+			return i
+		}
+	}
+	return -1
+}
+
+// contentsEnd describes where within the source the contents of an OmegaDoc
+// ended.
+type contentsEnd struct {
+	// BodyEndOffset is the byte offset just past the end of the body.
+	BodyEndOffset int64
+	// DelimiterOffset is the byte offset of the delimiting identifier, or -1
+	// if the contents were ended by the end of the file.
+	DelimiterOffset int64
+	// EndLineNumber is the line of the delimiting identifier, or the last
+	// line of the file.
+	EndLineNumber int
+	// Mismatch is the line number of the first line where the own-line and
+	// substring rules for the delimiting identifier disagree, or -1 if they
+	// agree.
+	Mismatch int
+	// CRLF holds, for each line of the contents, whether that line was ended
+	// by a CRLF in the source.
+	CRLF []bool
+}
+
+// readContents reads the body of an OmegaDoc line by line until the line
+// with the delimiting identifier is found, removing the line prefix from the
+// start of each line as it goes. The delimiting identifier ends the contents
+// only when it's alone on its line (ignoring surrounding whitespace), unless
+// substring is true, in which case the delimiting identifier ends the
+// contents wherever it appears and any text on the same line after it is left
+// in the odScanner to be read again.
+func readContents(ods *odScanner, delim []rune, prefix []rune, substring bool) ([]rune, contentsEnd, error) {
+	contents := []rune{}
+	end := contentsEnd{Mismatch: -1, DelimiterOffset: -1}
 	for {
-		r, _, err := ods.ReadRune()
-		if err != nil {
-			return buf, err
+		lineno, linestart := ods.LineNumber(), ods.Offset
+		raw, err := ods.ReadLine()
+		line := stripLinePrefix(raw, prefix)
+		idx := runesIndex(line, delim)
+		ownline := runesEqual(trimSpaceRunes(line), delim)
+		if idx >= 0 && !ownline && end.Mismatch == -1 {
+			end.Mismatch = lineno
 		}
-		buf = append(buf, r)
-		if r == sentinel[pos] {
-			pos++
-		} else {
-			pos = 0
+		if (substring && idx >= 0) || (!substring && ownline) {
+			end.EndLineNumber = lineno
+			end.DelimiterOffset = linestart + int64(len(string(raw[:len(raw)-len(line)+idx])))
+			end.BodyEndOffset = linestart
+			if substring {
+				end.BodyEndOffset = end.DelimiterOffset
+				contents = append(contents, ods.Magic.unescape(line[:idx])...)
+				ods.Unread(line[idx+len(delim):])
+			}
+			return contents, end, nil
 		}
-
-		if pos == len(sentinel) {
-			// For compatibility with previous behavior, slice off the sentinel
-			// from the end of buf
-			return buf[:len(buf)-len(sentinel)], nil
+		contents = append(contents, ods.Magic.unescape(line)...)
+		end.CRLF = append(end.CRLF, ods.CRLF[lineno])
+		if err != nil {
+			end.EndLineNumber = lineno
+			if len(raw) == 0 && lineno > 0 {
+				// The file ended with a newline, so the last line is the
+				// one before
+				end.EndLineNumber = lineno - 1
+			}
+			end.BodyEndOffset = ods.Offset
+			return contents, end, err
 		}
 	}
 }
 
+func trimSpaceRunes(rs []rune) []rune {
+	start := 0
+	for start < len(rs) && unicode.IsSpace(rs[start]) {
+		start++
+	}
+	end := len(rs)
+	for end > start && unicode.IsSpace(rs[end-1]) {
+		end--
+	}
+	return rs[start:end]
+}
+
 // ParseDoc for docfinder parses a text file and extracts all OmegaDocs present
 // in the file. This is currently implemented as a simple direct parser,
 // without being broken down into scanner/lexer since the language is so
-// simple. In the future this implementation may need to be further broken down
-// though, as features such as automatic indentation removal or line-prefix
-// removal may require a full lexer/parser.
-func (df docfinder) parseDoc(srcpath string, data io.Reader) ([]domain.OmegaDoc, error) {
+// simple. The contents are read line by line so that per-line transformations
+// such as line-prefix removal may be applied, after which the common
+// indentation of the contents is removed. In the future this implementation
+// may need to be further broken down though, as more complicated features may
+// require a full lexer/parser.
+func (df docfinder) parseDoc(srcpath string, data io.Reader, emit func(domain.OmegaDoc) error) ([]domain.Diagnostic, error) {
 	l := log.WithField("srcpath", srcpath)
-	var odocs []domain.OmegaDoc = []domain.OmegaDoc{}
-	brdr := bufio.NewReader(data)
-	rdr := &odScanner{brdr, 0, 0}
+	var diags []domain.Diagnostic = []domain.Diagnostic{}
+	// Files containing an "include" directive are emitted whole. When data
+	// can seek, or is a domain.Reopener, the file is read again from the
+	// start once it's known to contain an include directive. Otherwise a
+	// copy of everything read has to be kept as it's read, which is spooled
+	// to a temporary file so as not to hold the file in memory.
+	seeker, canseek := data.(io.Seeker)
+	var start int64
+	if canseek {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		canseek = err == nil
+	}
+	reopen := domain.ReaderReopen(data)
+	// The text is transcoded to UTF-8 before anything else, so any copy is of
+	// the transcoded text.
+	text, enc, bomlen, err := decodeText(data)
+	if err != nil {
+		return diags, &RequiredParseError{inner: err}
+	}
+	if enc != domain.EncodingUTF8 || bomlen > 0 {
+		l.WithField("encoding", enc).Debug("transcoding source file to UTF-8")
+	}
+	// Offsets are counted within the transcoded text as it's read, and are
+	// mapped back to offsets within the file as each OmegaDoc is emitted.
+	transcoded, _ := text.(*utf16Reader)
+	toSource := func(off int64) int64 {
+		if transcoded == nil || off < 0 {
+			return off
+		}
+		return int64(bomlen) + transcoded.sourceOffset(off-int64(bomlen))
+	}
+	var spool *os.File
+	if !canseek && reopen == nil {
+		spool, err = os.CreateTemp("", "omegadoc-spool-*")
+		if err != nil {
+			return diags, &RequiredParseError{inner: err}
+		}
+		defer func() {
+			spool.Close()
+			os.Remove(spool.Name())
+		}()
+		text = bufio.NewReaderSize(io.TeeReader(text, spool), readBufferSize)
+	}
+	brdr, ok := text.(*bufio.Reader)
+	if !ok {
+		brdr = bufio.NewReaderSize(text, readBufferSize)
+	}
+	// Offsets are counted from the start of the file, so include the byte
+	// order mark which has already been read.
+	rdr := &odScanner{Rdr: brdr, Magic: df.magic, Offset: int64(bomlen)}
+	if df.languageAware {
+		cs := df.language
+		if cs == nil {
+			cs = commentSyntaxFor(srcpath)
+		}
+		if cs != nil {
+			l.WithField("language", cs.Name).Debug("only recognizing magic strings within comments")
+			rdr.Lexer = newCommentLexer(cs)
+		}
+	}
+	emitted := 0
+	emitdoc := func(od domain.OmegaDoc) error {
+		emitted++
+		od.HeaderStartOffset = toSource(od.HeaderStartOffset)
+		od.HeaderEndOffset = toSource(od.HeaderEndOffset)
+		od.BodyStartOffset = toSource(od.BodyStartOffset)
+		od.BodyEndOffset = toSource(od.BodyEndOffset)
+		od.DelimiterOffset = toSource(od.DelimiterOffset)
+		return emit(od)
+	}
+	includes := []includeDirective{}
 
 	var curodoc parseOdoc = parseOdoc{
 		SourceFilePath: srcpath,
 	}
 
-	deriveCorrectExit := func(err error) ([]domain.OmegaDoc, error) {
+	// skipping is true while parsing an OmegaDoc which follows an "ignore
+	// next" directive; such OmegaDocs are neither kept nor diagnosed.
+	skipping := false
+	skipnext := false
+
+	// diag records a Diagnostic; line is 0-based as with
+	// odScanner.LineNumber, while col is 1-based.
+	diag := func(sev domain.Severity, code string, line, col int, format string, args ...interface{}) {
+		if skipping {
+			return
+		}
+		d := domain.Diagnostic{
+			SourceFilePath: srcpath,
+			Line:           line + 1,
+			Column:         col,
+			Severity:       sev,
+			Code:           code,
+			Message:        fmt.Sprintf(format, args...),
+		}
+		l.WithField("code", code).Debug(d.String())
+		diags = append(diags, d)
+	}
+	// finish creates the OmegaDocs for any "include" directives, which
+	// requires that the whole file has been read.
+	finish := func() ([]domain.Diagnostic, error) {
+		if len(includes) == 0 {
+			return diags, nil
+		}
+		// readWhole reads the whole text again, and then maps offsets
+		// through its transcoding, which has seen all of the file.
+		readWhole := func(text io.Reader) ([]byte, error) {
+			whole, err := io.ReadAll(text)
+			if u, ok := text.(*utf16Reader); ok && transcoded != nil {
+				transcoded = u
+			}
+			return whole, err
+		}
+		wholebytes, err := func() ([]byte, error) {
+			switch {
+			case canseek:
+				if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+					return nil, err
+				}
+				text, _, _, err := decodeText(data)
+				if err != nil {
+					return nil, err
+				}
+				return readWhole(text)
+			case reopen != nil:
+				rc, err := reopen()
+				if err != nil {
+					return nil, err
+				}
+				defer rc.Close()
+				text, _, _, err := decodeText(rc)
+				if err != nil {
+					return nil, err
+				}
+				return readWhole(text)
+			}
+			if _, err := io.Copy(io.Discard, brdr); err != nil {
+				return nil, err
+			}
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return io.ReadAll(spool)
+		}()
+		if err != nil {
+			return diags, &RequiredParseError{inner: err}
+		}
+		for _, inc := range includes {
+			if err := emitdoc(inc.MakeOmegaDoc(wholebytes, int64(bomlen), df.lineEndings, df.magic)); err != nil {
+				return diags, err
+			}
+		}
+		return diags, nil
+	}
+	deriveCorrectExit := func(err error) ([]domain.Diagnostic, error) {
 		// End of file isn't necessarily an error, more a signal that we're
 		// done here.
 		if errors.Is(err, io.EOF) {
-			return odocs, nil
-		}
-		return nil, err
-	}
-	rrg := func() ([]rune, string, error) {
-		rg, _err := rdr.ReadRuneGroup()
-		if _err != nil {
-			return nil, "", _err
+			return finish()
 		}
-		return rg, string(rg), nil
+		return diags, &RequiredParseError{inner: err}
 	}
 	for {
 	RESET_CONTINUE:
-		err := rdr.FFTillMagicCommon()
+		skipping = false
+		lineprefix, syn, err := rdr.FFTillMagicCommon()
 		if err != nil {
 			return deriveCorrectExit(err)
 		}
+		magicoffset := rdr.Offset - int64(len(syn.Prefix))
+		// markup is the comment markup to remove from the lines following
+		// the magic string. Without a lexer, that's whatever precedes the
+		// magic string on its line, so long as it looks like comment markup.
+		markup := lineprefix
+		if rdr.Lexer != nil {
+			markup = rdr.CommentPrefix
+		}
 		rg, err := rdr.ReadRuneGroup()
 		if err != nil {
 			return deriveCorrectExit(err)
 		}
-		if runesEqual(rg, IGNORDOC_MAGICRUNES) {
-			if len(odocs) == 0 {
-				return odocs, nil
+		if runesEqual(rg, syn.Ignore) {
+			if emitted == 0 && len(includes) == 0 {
+				return diags, nil
 			} else {
 				goto RESET_CONTINUE
 			}
-		} else if strings.HasPrefix(string(rg), string(BEGINDOC_MAGICRUNES)) {
-			var delimiting_ident []rune = []rune(strings.TrimPrefix(string(rg), string(BEGINDOC_MAGICRUNES)))
+		} else if runesEqual(rg, syn.Include) {
+			inc := includeDirective{
+				SourceFilePath:    srcpath,
+				LineNumber:        rdr.LineNumber(),
+				Column:            len(lineprefix),
+				HeaderStartOffset: magicoffset,
+			}
+			hl, err := readHeaderLines(rdr, continuationPrefix(markup))
+			if err != nil && !errors.Is(err, io.EOF) {
+				return deriveCorrectExit(err)
+			}
+			inc.LastLineNumber = hl.Segs[len(hl.Segs)-1].Line
+			inc.HeaderEndOffset = rdr.Offset
+			hdr, herr := parseHeader(trimCommentCloser(hl.Text, lineprefix))
+			if herr != nil {
+				var perr *headerError
+				if !errors.As(herr, &perr) {
+					return diags, herr
+				}
+				line, col := hl.Position(perr.Col)
+				diag(domain.SeverityError, perr.Code, line, col,
+					"when parsing include directive: %s", perr.Msg)
+			} else if len(hdr.DestFilePath) == 0 {
+				diag(domain.SeverityError, domain.DiagMissingDestPath, inc.LineNumber, len(lineprefix)+1,
+					"include directive has no output path")
+			} else {
+				inc.Attrs = hdr.Attrs
+				inc.DestFilePath = string(hdr.DestFilePath)
+				l.WithFields(log.Fields{
+					"line":           inc.LineNumber + 1,
+					"dest_file_path": inc.DestFilePath,
+				}).Debug("found include directive")
+				includes = append(includes, inc)
+			}
+			if err != nil {
+				return deriveCorrectExit(err)
+			}
+			goto RESET_CONTINUE
+		} else if runesEqual(rg, syn.IgnoreNext) {
+			l.WithField("line", rdr.LineNumber()+1).Debug("found ignore-next directive")
+			skipnext = true
+			goto RESET_CONTINUE
+		} else if runesEqual(rg, syn.IgnoreStart) {
+			startline, startcol := rdr.LineNumber(), len(lineprefix)+1
+			l.WithField("line", startline+1).Debug("found start of ignore region")
+			// Skip over everything, including opening statements and other
+			// directives, until the end of the ignore region. The region may be
+			// ended by the ignore-end directive of any syntax.
+			for {
+				_, endsyn, err := rdr.FFTillMagicCommon()
+				if err == nil {
+					rg, err = rdr.ReadRuneGroup()
+				}
+				ended := endsyn != nil && runesEqual(rg, endsyn.IgnoreEnd)
+				if errors.Is(err, io.EOF) && !ended {
+					diag(domain.SeverityWarning, domain.DiagUnterminatedIgnore, startline, startcol,
+						"ignore region is never ended; the rest of the file is ignored")
+				}
+				if err != nil {
+					return deriveCorrectExit(err)
+				}
+				if ended {
+					goto RESET_CONTINUE
+				}
+			}
+		} else if runesEqual(rg, syn.IgnoreEnd) {
+			diag(domain.SeverityWarning, domain.DiagUnmatchedIgnoreEnd, rdr.LineNumber(), len(lineprefix)+1,
+				"ignore-end directive found outside of an ignore region")
+			goto RESET_CONTINUE
+		} else if syn.isOpening(rg) {
+			var delimiting_ident []rune = rg[len(syn.Begin):]
+			openingcol := len(lineprefix) + 1
+			skipping, skipnext = skipnext, false
+			if syn.Spaced {
+				delimiting_ident, err = readSpacedDelimiter(rdr)
+				if err != nil && !errors.Is(err, io.EOF) {
+					return deriveCorrectExit(err)
+				}
+			}
+			if len(delimiting_ident) == 0 {
+				diag(domain.SeverityError, domain.DiagMissingDelimiter, rdr.LineNumber(), openingcol,
+					"opening statement has no delimiting identifier after %q", string(syn.Begin))
+				goto RESET_CONTINUE
+			}
+			curodoc = parseOdoc{
+				SourceFilePath: srcpath,
+			}
 			curodoc.StartLineNumber = rdr.LineNumber()
+			curodoc.StartColumn = len(lineprefix)
+			curodoc.HeaderStartOffset = magicoffset
 			l = l.WithFields(log.Fields{
 				"startline":        rdr.LineNumber(),
 				"delimiting_ident": string(delimiting_ident),
 			})
 			l.Debug("found beginning of document")
-			for {
-				rg, s, err := rrg()
-				if err != nil {
-					return deriveCorrectExit(err)
+			hl, err := readHeaderLines(rdr, continuationPrefix(markup))
+			if err != nil {
+				// Newline marks end of the opening statement and start of
+				// contents of the omegadoc, so an opening statement which isn't
+				// terminated by a newline defines no OmegaDoc.
+				if errors.Is(err, io.EOF) {
+					diag(domain.SeverityError, domain.DiagEOFInOpening, curodoc.StartLineNumber, openingcol,
+						"file ends before the opening statement is terminated by a newline")
 				}
-				if rg[0] == '\n' {
-					goto RESET_CONTINUE
+				return deriveCorrectExit(err)
+			}
+			curodoc.HeaderEndOffset = rdr.Offset
+			curodoc.BodyStartOffset = rdr.Offset
+			hdr, err := parseHeader(trimCommentCloser(hl.Text, lineprefix))
+			if err != nil {
+				var herr *headerError
+				if !errors.As(err, &herr) {
+					return diags, err
 				}
-				if !unicode.IsSpace(rg[0]) {
-					if !strings.Contains(s, ":") {
-						// Isn't an attribute, must be destination file path.
-						curodoc.AppDestFP(rg...)
-						l = l.WithFields(log.Fields{
-							"dest_file_path": string(curodoc.DestFilePath),
-						})
-						l.Debug("found destination file path")
-						for {
-							r, _, err := rdr.ReadRune()
-							if err != nil {
-								return deriveCorrectExit(err)
-							}
-							if r == '\n' {
-								// Newline marks end of file path and start of contents of the
-								// omegadoc. The end of the contents will be marked by the
-								// 'delimiting identifier' (or EOF) so read until that's reached.
-								contents, err := readTillSentinel(delimiting_ident, rdr)
-								curodoc.AppCont(contents...)
-								if errors.Is(err, io.EOF) {
-									// Ending the file in the middle of an OmegaDoc is considered a
-									// valid ending to the OmegaDoc.
-									odocs = append(odocs, curodoc.MakeOmegaDoc())
-									return odocs, nil
-								}
-								if err != nil {
-									return deriveCorrectExit(err)
-								}
-								// Found end of this current OmegaDoc, wrap it all up and reset
-								odocs = append(odocs, curodoc.MakeOmegaDoc())
-								curodoc = parseOdoc{
-									SourceFilePath: srcpath,
-								}
-								goto RESET_CONTINUE
-							} else {
-								curodoc.AppDestFP(r)
-							}
-						}
-					} else {
-						// This is an attribute, there could be many
-						split := strings.SplitN(s, ":", 2)
-						if len(split) != 2 {
-							return nil, fmt.Errorf("when parsing attribute on line %d of file %q, attribute split on ':' did not have length 2, had length %d: %v", rdr.LineNumber(), srcpath, len(split), split)
-						}
-						curodoc.AppAttr(split[0], split[1])
+				line, col := hl.Position(herr.Col)
+				diag(domain.SeverityError, herr.Code, line, col,
+					"when parsing opening statement: %s", herr.Msg)
+				goto RESET_CONTINUE
+			}
+			if len(hdr.DestFilePath) == 0 {
+				// Missing the output path means this isn't an OmegaDoc
+				diag(domain.SeverityError, domain.DiagMissingDestPath, curodoc.StartLineNumber, openingcol,
+					"opening statement with delimiting identifier %q has no output path", string(delimiting_ident))
+				goto RESET_CONTINUE
+			}
+			curodoc.Attrs = hdr.Attrs
+			curodoc.AppDestFP(hdr.DestFilePath...)
+			l = l.WithFields(log.Fields{
+				"dest_file_path": string(curodoc.DestFilePath),
+			})
+			l.Debug("found destination file path")
+
+			// The end of the contents will be marked by the 'delimiting
+			// identifier' (or EOF) so read until that's reached.
+			prefix := curodoc.LinePrefix(markup)
+			if len(prefix) > 0 {
+				l.WithField("line_prefix", string(prefix)).Debug("removing line prefix from contents")
+			}
+			contents, cend, err := readContents(rdr, delimiting_ident, prefix, df.substringDelims)
+			curodoc.EndLineNumber = cend.EndLineNumber
+			curodoc.BodyEndOffset = cend.BodyEndOffset
+			curodoc.DelimiterOffset = cend.DelimiterOffset
+			if cend.Mismatch != -1 {
+				diag(domain.SeverityWarning, domain.DiagDelimiterWithinLine, cend.Mismatch, 0,
+					"delimiting identifier %q appears within this line but isn't alone on it; "+
+						"the legacy substring rule and the own-line rule end this OmegaDoc in different places", string(delimiting_ident))
+			}
+			if curodoc.IndentMode() != INDENT_KEEP {
+				contents = dedent(contents)
+			}
+			if df.lineEndings == LineEndingsKeep {
+				contents = restoreCRLF(contents, cend.CRLF)
+			}
+			curodoc.AppCont(contents...)
+			if len(trimSpaceRunes(contents)) == 0 {
+				diag(domain.SeverityWarning, domain.DiagEmptyBody, curodoc.StartLineNumber, openingcol,
+					"OmegaDoc for %q has an empty body", string(curodoc.DestFilePath))
+			}
+			if errors.Is(err, io.EOF) {
+				// Ending the file in the middle of an OmegaDoc is considered a
+				// valid ending to the OmegaDoc, though likely a mistake.
+				diag(domain.SeverityWarning, domain.DiagEOFBeforeDelimiter, curodoc.StartLineNumber, openingcol,
+					"file ends before delimiting identifier %q; the OmegaDoc ends at the end of the file", string(delimiting_ident))
+				if !skipping {
+					if err := emitdoc(curodoc.MakeOmegaDoc()); err != nil {
+						return diags, err
 					}
 				}
+				return finish()
+			}
+			if err != nil {
+				return deriveCorrectExit(err)
+			}
+			// Found end of this current OmegaDoc, wrap it all up and reset
+			if skipping {
+				l.Debug("skipping document following ignore-next directive")
+			} else if err := emitdoc(curodoc.MakeOmegaDoc()); err != nil {
+				return diags, err
+			}
+			curodoc = parseOdoc{
+				SourceFilePath: srcpath,
 			}
 		}
 	}
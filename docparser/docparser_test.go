@@ -2,6 +2,8 @@ package docparser
 
 import (
 	//"fmt"
+	"errors"
+	"io"
 	"strings"
 	"testing"
 
@@ -23,7 +25,7 @@ this is a testing document
 EOOD
 other stuff`)
 	dp := NewDocParser()
-	odocs, err := dp.ParseDoc("tmp/testfile.md", rdr)
+	odocs, _, err := dp.ParseDoc("tmp/testfile.md", rdr)
 	require.NoError(t, err)
 	require.Len(t, odocs, 1)
 	require.Equal(t, odocs[0].Contents, "this is a testing document\n")
@@ -50,36 +52,36 @@ func TestParseAssorted(t *testing.T) {
 	}
 
 	var tests []tst = []tst{
-		{Def: "#!/usr/bin/env omegadoc <<EXT r/a.md\nfoobarEXT", Exps: []exp{{Contents: "foobar", DestFP: "r/a.md"}}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT r/a.md\nfoobar\nEXT", Exps: []exp{{Contents: "foobar\n", DestFP: "r/a.md"}}},
 		// Extra whitespace after the output path but before the newline should
 		// be interpreted as part of the output path.
-		{Def: "#!/usr/bin/env omegadoc <<EXT r/a.md \nfoobarEXT", Exps: []exp{{Contents: "foobar", DestFP: "r/a.md "}}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT r/a.md \nfoobar\nEXT", Exps: []exp{{Contents: "foobar\n", DestFP: "r/a.md "}}},
 		// Missing the output path means not parsed as an OmegaDoc.
-		{Def: "#!/usr/bin/env omegadoc <<EXT \nfoobarEXT", Exps: []exp{}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT \nfoobar\nEXT", Exps: []exp{}},
 		// Ending the file in the middle of an OmegaDoc is considered a valid way to end the OmegaDoc.
 		{Def: "#!/usr/bin/env omegadoc <<NLEXT r/a.md\nfoobar", Exps: []exp{{Contents: "foobar", DestFP: "r/a.md"}}},
 		// Including the ignore directive causes the file to be ignored
 		{Def: "#!/usr/bin/env omegadoc ignore-this-file\n\n" +
-			"#!/usr/bin/env omegadoc <<EXT r/a.md\nfoobarEXT", Exps: []exp{}},
+			"#!/usr/bin/env omegadoc <<EXT r/a.md\nfoobar\nEXT", Exps: []exp{}},
 		// Including an ignore directive _after_ a valid omegadoc definition
 		// causes nothing to happen; the ignore directive is itself ignored.
-		{Def: "#!/usr/bin/env omegadoc <<EXT r/a.md\nfoobarEXT]\n" +
-			"#!/usr/bin/env omegadoc ignore-this-file\n\n", Exps: []exp{{Contents: "foobar", DestFP: "r/a.md"}}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT r/a.md\nfoobar\nEXT\n" +
+			"#!/usr/bin/env omegadoc ignore-this-file\n\n", Exps: []exp{{Contents: "foobar\n", DestFP: "r/a.md"}}},
 		// Ensure destination file path can contain spaces.
-		{Def: "#!/usr/bin/env omegadoc <<EXT tmp/with spaces.md\nfoobarEXT",
-			Exps: []exp{{Contents: "foobar", DestFP: "tmp/with spaces.md"}}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT tmp/with spaces.md\nfoobar\nEXT",
+			Exps: []exp{{Contents: "foobar\n", DestFP: "tmp/with spaces.md"}}},
 		// Basic attributes are parsed
-		{Def: "#!/usr/bin/env omegadoc <<EXT fizz:pow r/a.md\nfoobarEXT",
-			Exps: []exp{{Contents: "foobar", DestFP: "r/a.md", Attrs: mkoat("fizz", "pow")}}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT fizz:pow r/a.md\nfoobar\nEXT",
+			Exps: []exp{{Contents: "foobar\n", DestFP: "r/a.md", Attrs: mkoat("fizz", "pow")}}},
 		// Duplicate attribute keys are allowed
-		{Def: "#!/usr/bin/env omegadoc <<EXT fizz:pow  fizz:wahoo r/a.md\nfoobarEXT",
-			Exps: []exp{{Contents: "foobar", DestFP: "r/a.md", Attrs: mkoat("fizz", "pow", "fizz", "wahoo")}}},
+		{Def: "#!/usr/bin/env omegadoc <<EXT fizz:pow  fizz:wahoo r/a.md\nfoobar\nEXT",
+			Exps: []exp{{Contents: "foobar\n", DestFP: "r/a.md", Attrs: mkoat("fizz", "pow", "fizz", "wahoo")}}},
 	}
 
 	dp := NewDocParser()
 	for tidx, test := range tests {
 		rdr := strings.NewReader(test.Def)
-		odocs, err := dp.ParseDoc("/tmp/testfile.md", rdr)
+		odocs, _, err := dp.ParseDoc("/tmp/testfile.md", rdr)
 		require.Lenf(t, odocs, len(test.Exps), "test #%d expects to have created %d OmegaDocs but instead created %d, err: %v", tidx, len(test.Exps), len(odocs), err)
 		for idx, expect := range test.Exps {
 			odoc := odocs[idx]
@@ -92,3 +94,599 @@ func TestParseAssorted(t *testing.T) {
 		}
 	}
 }
+
+func TestParseLinePrefix(t *testing.T) {
+	type tst struct {
+		Def      string
+		Contents string
+	}
+	for tidx, test := range []tst{
+		// The comment prefix on the line of the opening statement is removed
+		// from each line of the contents, including the line of the delimiter.
+		{Def: "// #!/usr/bin/env omegadoc <<EOD r/a.md\n// # Title\n//\n// body text\n// EOD\n",
+			Contents: "# Title\n\nbody text\n"},
+		{Def: "# #!/usr/bin/env omegadoc <<EOD r/a.md\n# hello\n#   indented\n# EOD\n",
+			Contents: "hello\n  indented\n"},
+		{Def: "-- #!/usr/bin/env omegadoc <<EOD r/a.md\n-- hello\n-- EOD\n",
+			Contents: "hello\n"},
+		{Def: "/*\n * #!/usr/bin/env omegadoc <<EOD r/a.md\n * hello\n *\n * world\n * EOD\n */\n",
+			Contents: "hello\n\nworld\n"},
+		// Indentation before the comment leader is part of the prefix.
+		{Def: "func x() {\n\t// #!/usr/bin/env omegadoc <<EOD r/a.md\n\t// hello\n\t// EOD\n}\n",
+			Contents: "hello\n"},
+		// Lines which lack the prefix are left as they are.
+		{Def: "// #!/usr/bin/env omegadoc <<EOD r/a.md\n// hello\nno prefix here\n// EOD\n",
+			Contents: "hello\nno prefix here\n"},
+		// Text which isn't a comment leader is not treated as a prefix.
+		{Def: "doc := `#!/usr/bin/env omegadoc <<EOD r/a.md\ndoc := `hello\nEOD\n",
+			Contents: "doc := `hello\n"},
+		// The "prefix" attribute overrides the detected prefix.
+		{Def: "#!/usr/bin/env omegadoc <<EOD prefix:;; r/a.md\n;; hello\n;; EOD\n",
+			Contents: "hello\n"},
+		{Def: "// #!/usr/bin/env omegadoc <<EOD prefix:none r/a.md\n// hello\n// EOD\nEOD\n",
+			Contents: "// hello\n// EOD\n"},
+	} {
+		dp := NewDocParser()
+		odocs, _, err := dp.ParseDoc("/tmp/testfile.go", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, test.Contents, odocs[0].Contents, "test #%d", tidx)
+		require.Equal(t, "r/a.md", odocs[0].DestFilePath, "test #%d", tidx)
+	}
+}
+
+func TestParseDedent(t *testing.T) {
+	type tst struct {
+		Def      string
+		Contents string
+	}
+	for tidx, test := range []tst{
+		// Common indentation is removed by default.
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\n    # Title\n\n    text\n      more\n    EOD\n",
+			Contents: "# Title\n\ntext\n  more\n"},
+		// Whitespace-only lines don't count towards the common indentation
+		// and are reduced to their newline.
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\n\tone\n \n\ttwo\nEOD",
+			Contents: "one\n\ntwo\n"},
+		// Tabs and spaces are never considered equal, so only the whitespace
+		// common to every line is removed.
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\n\t  one\n\t\ttwo\nEOD",
+			Contents: "  one\n\ttwo\n"},
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\n    one\n\ttwo\nEOD",
+			Contents: "    one\n\ttwo\n"},
+		// The "indent" attribute can turn off indentation removal.
+		{Def: "#!/usr/bin/env omegadoc <<EOD indent:keep r/a.md\n    one\n    two\nEOD",
+			Contents: "    one\n    two\n"},
+		// Indentation is removed after the line prefix.
+		{Def: "# #!/usr/bin/env omegadoc <<EOD r/a.md\n#     one\n#       two\n# EOD",
+			Contents: "one\n  two\n"},
+	} {
+		dp := NewDocParser()
+		odocs, _, err := dp.ParseDoc("/tmp/testfile.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, test.Contents, odocs[0].Contents, "test #%d", tidx)
+	}
+}
+
+func TestParseDedentLineNumber(t *testing.T) {
+	rdr := strings.NewReader("a\nb\n\tfunc x() {\n\t\t#!/usr/bin/env omegadoc <<EOD r/a.md\n\t\t  hi\n\t\tEOD\n")
+	odocs, _, err := NewDocParser().ParseDoc("/tmp/testfile.md", rdr)
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	require.Equal(t, "hi\n", odocs[0].Contents)
+	require.Equal(t, 3, odocs[0].StartLineNumber)
+}
+
+func TestParseHeader(t *testing.T) {
+	type tst struct {
+		Def    string
+		DestFP string
+		Attrs  []domain.OmegaAttribute
+		Diag   string
+	}
+	for tidx, test := range []tst{
+		{Def: "#!/usr/bin/env omegadoc <<EOD title:\"Payment service overview\" r/a.md\nEOD",
+			DestFP: "r/a.md", Attrs: mkoat("title", "Payment service overview")},
+		{Def: "#!/usr/bin/env omegadoc <<EOD a:b title:\"say \\\"hi\\\" \\\\ bye\" c:d r/a.md\nEOD",
+			DestFP: "r/a.md", Attrs: mkoat("a", "b", "title", "say \"hi\" \\ bye", "c", "d")},
+		{Def: "#!/usr/bin/env omegadoc <<EOD title:\"\" r/a.md\nEOD",
+			DestFP: "r/a.md", Attrs: mkoat("title", "")},
+		// Quoted destination paths may contain spaces, colons, and escapes.
+		{Def: "#!/usr/bin/env omegadoc <<EOD section:01 \"docs/my: file.md\"  \nEOD",
+			DestFP: "docs/my: file.md", Attrs: mkoat("section", "01")},
+		{Def: "#!/usr/bin/env omegadoc <<EOD \"docs/tab\\there.md\"\nEOD",
+			DestFP: "docs/tab\there.md", Attrs: mkoat()},
+		// Unquoted destination paths are the remainder of the line, verbatim.
+		{Def: "#!/usr/bin/env omegadoc <<EOD a:b tmp/with \"spaces\".md\nEOD",
+			DestFP: "tmp/with \"spaces\".md", Attrs: mkoat("a", "b")},
+		{Def: "#!/usr/bin/env omegadoc <<EOD title:\"unterminated r/a.md\nEOD",
+			Diag: `/tmp/testfile.md:1:37: error: when parsing opening statement: unterminated quoted string [malformed-attribute]`},
+		{Def: "#!/usr/bin/env omegadoc <<EOD \"r/a.md\nEOD",
+			Diag: `/tmp/testfile.md:1:31: error: when parsing opening statement: unterminated quoted string [malformed-destination-path]`},
+		{Def: "#!/usr/bin/env omegadoc <<EOD \"r/a.md\" extra\nEOD",
+			Diag: `/tmp/testfile.md:1:40: error: when parsing opening statement: unexpected text "extra" after quoted destination path [malformed-destination-path]`},
+		{Def: "#!/usr/bin/env omegadoc <<EOD title:\"a\\qb\" r/a.md\nEOD",
+			Diag: `/tmp/testfile.md:1:39: error: when parsing opening statement: unknown escape sequence \q in quoted string [malformed-attribute]`},
+		{Def: "#!/usr/bin/env omegadoc <<EOD title:\"a\"b r/a.md\nEOD",
+			Diag: `/tmp/testfile.md:1:40: error: when parsing opening statement: expected whitespace after quoted value of attribute "title", found 'b' [malformed-attribute]`},
+		// Attributes which the parser acts on must have values it knows.
+		{Def: "#!/usr/bin/env omegadoc <<EOD indent:tabs r/a.md\nEOD",
+			Diag: `/tmp/testfile.md:1:31: error: when parsing opening statement: unknown value "tabs" of attribute "indent"; expected "strip" or "keep" [malformed-attribute]`},
+		{Def: "#!/usr/bin/env omegadoc <<EOD a:b INDENT:\"\" r/a.md\nEOD",
+			Diag: `/tmp/testfile.md:1:35: error: when parsing opening statement: unknown value "" of attribute "INDENT"; expected "strip" or "keep" [malformed-attribute]`},
+		{Def: "#!/usr/bin/env omegadoc <<EOD indent:Keep r/a.md\nEOD",
+			DestFP: "r/a.md", Attrs: mkoat("indent", "Keep")},
+	} {
+		odocs, diags, err := NewDocParser().ParseDoc("/tmp/testfile.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		if test.Diag != "" {
+			require.Len(t, odocs, 0, "test #%d", tidx)
+			require.Len(t, diags, 1, "test #%d", tidx)
+			require.Equal(t, test.Diag, diags[0].String(), "test #%d", tidx)
+			continue
+		}
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, test.DestFP, odocs[0].DestFilePath, "test #%d", tidx)
+		require.Equal(t, test.Attrs, odocs[0].Attributes, "test #%d", tidx)
+	}
+}
+
+func TestParseDelimiterOwnLine(t *testing.T) {
+	type tst struct {
+		Def       string
+		Contents  string
+		Substring string
+	}
+	for tidx, test := range []tst{
+		// The delimiting identifier within a word doesn't end the OmegaDoc.
+		{Def: "#!/usr/bin/env omegadoc <<END r/a.md\nthe BACKEND service\nEND\n",
+			Contents: "the BACKEND service\n", Substring: "the BACK"},
+		// Whitespace around the delimiting identifier is allowed.
+		{Def: "#!/usr/bin/env omegadoc <<END r/a.md\nhello\n  END  \nafter",
+			Contents: "hello\n", Substring: "hello\n"},
+		{Def: "// #!/usr/bin/env omegadoc <<END r/a.md\n// hello\n//   END\n",
+			Contents: "hello\n", Substring: "hello\n"},
+		// Text on the delimiter line after the delimiting identifier means
+		// the line doesn't end the OmegaDoc.
+		{Def: "#!/usr/bin/env omegadoc <<END r/a.md\nhello\nEND of story\n",
+			Contents: "hello\nEND of story\n", Substring: "hello\n"},
+	} {
+		odocs, _, err := NewDocParser().ParseDoc("/tmp/testfile.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, test.Contents, odocs[0].Contents, "test #%d", tidx)
+
+		odocs, _, err = NewDocParser(WithSubstringDelimiters(true)).ParseDoc("/tmp/testfile.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, test.Substring, odocs[0].Contents, "test #%d", tidx)
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	type tst struct {
+		Def   string
+		Docs  int
+		Diags []string
+	}
+	for tidx, test := range []tst{
+		{Def: "#!/usr/bin/env omegadoc << r/a.md\nhello\n",
+			Diags: []string{`f.md:1:1: error: opening statement has no delimiting identifier after "<<" [missing-delimiter]`}},
+		{Def: "text\n  // #!/usr/bin/env omegadoc <<EOD  \nhello\nEOD\n",
+			Diags: []string{`f.md:2:6: error: opening statement with delimiting identifier "EOD" has no output path [missing-destination-path]`}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md",
+			Diags: []string{`f.md:1:1: error: file ends before the opening statement is terminated by a newline [eof-in-opening-statement]`}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD :b r/a.md\nEOD\n",
+			Diags: []string{`f.md:1:31: error: when parsing opening statement: attribute has an empty key [malformed-attribute]`}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\n", Docs: 1,
+			Diags: []string{`f.md:1:1: warning: file ends before delimiting identifier "EOD"; the OmegaDoc ends at the end of the file [eof-before-delimiter]`}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\n  \nEOD\n", Docs: 1,
+			Diags: []string{`f.md:1:1: warning: OmegaDoc for "r/a.md" has an empty body [empty-body]`}},
+		{Def: "#!/usr/bin/env omegadoc <<END r/a.md\nBACKEND\nEND\n", Docs: 1,
+			Diags: []string{`f.md:2: warning: delimiting identifier "END" appears within this line but isn't alone on it; ` +
+				`the legacy substring rule and the own-line rule end this OmegaDoc in different places [delimiter-within-line]`}},
+		// A broken OmegaDoc doesn't prevent the following OmegaDocs in the
+		// same file from being parsed.
+		{Def: "#!/usr/bin/env omegadoc <<EOD \"r/a.md\nEOD\n#!/usr/bin/env omegadoc <<EOD r/b.md\nhello\nEOD\n", Docs: 1,
+			Diags: []string{`f.md:1:31: error: when parsing opening statement: unterminated quoted string [malformed-destination-path]`}},
+	} {
+		odocs, diags, err := NewDocParser().ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, test.Docs, "test #%d", tidx)
+		strs := []string{}
+		for _, d := range diags {
+			strs = append(strs, d.String())
+		}
+		require.Equal(t, test.Diags, strs, "test #%d", tidx)
+	}
+}
+
+func TestParseIgnoreDirectives(t *testing.T) {
+	type tst struct {
+		Def   string
+		Dests []string
+		Diags []string
+	}
+	for tidx, test := range []tst{
+		// ignore-next skips only the next OmegaDoc, including its body.
+		{Def: "#!/usr/bin/env omegadoc ignore-next\n" +
+			"#!/usr/bin/env omegadoc <<EOD r/a.md\n#!/usr/bin/env omegadoc <<X r/inner.md\nX\nEOD\n" +
+			"#!/usr/bin/env omegadoc <<EOD r/b.md\nhello\nEOD\n",
+			Dests: []string{"r/b.md"}},
+		// Problems with a skipped OmegaDoc aren't diagnosed.
+		{Def: "// #!/usr/bin/env omegadoc ignore-next\n// #!/usr/bin/env omegadoc <<EOD\n",
+			Dests: []string{}},
+		// Everything within an ignore region is skipped.
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n" +
+			"#!/usr/bin/env omegadoc ignore-start\n" +
+			"#!/usr/bin/env omegadoc <<EOD r/b.md\nhello\nEOD\n" +
+			"#!/usr/bin/env omegadoc ignore-this-file\n" +
+			"#!/usr/bin/env omegadoc ignore-end\n" +
+			"#!/usr/bin/env omegadoc <<EOD r/c.md\nhello\nEOD\n",
+			Dests: []string{"r/a.md", "r/c.md"}},
+		// An ignore region before any OmegaDocs doesn't cause the file to be
+		// ignored.
+		{Def: "#!/usr/bin/env omegadoc ignore-start\n#!/usr/bin/env omegadoc ignore-end\n" +
+			"#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n",
+			Dests: []string{"r/a.md"}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n" +
+			"# #!/usr/bin/env omegadoc ignore-start\n#!/usr/bin/env omegadoc <<EOD r/b.md\nhello\nEOD\n",
+			Dests: []string{"r/a.md"},
+			Diags: []string{`f.md:4:3: warning: ignore region is never ended; the rest of the file is ignored [unterminated-ignore-region]`}},
+		{Def: "#!/usr/bin/env omegadoc ignore-end\n#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n",
+			Dests: []string{"r/a.md"},
+			Diags: []string{`f.md:1:1: warning: ignore-end directive found outside of an ignore region [unmatched-ignore-end]`}},
+	} {
+		odocs, diags, err := NewDocParser().ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		dests := []string{}
+		for _, od := range odocs {
+			dests = append(dests, od.DestFilePath)
+		}
+		require.Equal(t, test.Dests, dests, "test #%d", tidx)
+		strs := []string{}
+		for _, d := range diags {
+			strs = append(strs, d.String())
+		}
+		if test.Diags == nil {
+			test.Diags = []string{}
+		}
+		require.Equal(t, test.Diags, strs, "test #%d", tidx)
+	}
+}
+
+func TestParseIncludeDirective(t *testing.T) {
+	type tst struct {
+		Def   string
+		Exps  []domain.OmegaDoc
+		Diags []string
+	}
+	for tidx, test := range []tst{
+		{Def: "# Title\n#!/usr/bin/env omegadoc include-this-file docs/readme.md\nbody\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "docs/readme.md", Contents: "# Title\nbody\n", Attributes: mkoat()}}},
+		// Attributes are parsed as with opening statements, and block comment
+		// closers at the end of the line are removed.
+		{Def: "<!-- #!/usr/bin/env omegadoc include-this-file section:02 \"docs/read me.md\" -->\n# Title\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "docs/read me.md", Contents: "# Title\n", Attributes: mkoat("section", "02")}}},
+		{Def: "/* #!/usr/bin/env omegadoc include-this-file docs/a.md */\nint x;",
+			Exps: []domain.OmegaDoc{{DestFilePath: "docs/a.md", Contents: "int x;", Attributes: mkoat()}}},
+		// Include directives may be combined with ordinary OmegaDocs, and the
+		// whole file is included even if it ends in the middle of an OmegaDoc.
+		{Def: "a\n#!/usr/bin/env omegadoc <<EOD r/b.md\nb\nEOD\n#!/usr/bin/env omegadoc include-this-file r/a.md\n#!/usr/bin/env omegadoc <<EOD r/c.md\nc\n",
+			Exps: []domain.OmegaDoc{
+				{DestFilePath: "r/b.md", Contents: "b\n", Attributes: mkoat(), StartLineNumber: 1},
+				{DestFilePath: "r/c.md", Contents: "c\n", Attributes: mkoat(), StartLineNumber: 5},
+				{DestFilePath: "r/a.md", Contents: "a\n#!/usr/bin/env omegadoc <<EOD r/b.md\nb\nEOD\n#!/usr/bin/env omegadoc <<EOD r/c.md\nc\n", Attributes: mkoat()},
+			},
+			Diags: []string{`f.md:6:1: warning: file ends before delimiting identifier "EOD"; the OmegaDoc ends at the end of the file [eof-before-delimiter]`}},
+		// An ignore directive after an include directive is itself ignored.
+		{Def: "#!/usr/bin/env omegadoc include-this-file r/a.md\n#!/usr/bin/env omegadoc ignore-this-file\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Contents: "#!/usr/bin/env omegadoc ignore-this-file\n", Attributes: mkoat()}}},
+		{Def: "#!/usr/bin/env omegadoc include-this-file\nbody\n",
+			Exps:  []domain.OmegaDoc{},
+			Diags: []string{`f.md:1:1: error: include directive has no output path [missing-destination-path]`}},
+	} {
+		odocs, diags, err := NewDocParser().ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		for idx := range odocs {
+			require.Equal(t, "f.md", odocs[idx].SourceFilePath, "test #%d", tidx)
+		}
+		clearSource(odocs)
+		require.Equal(t, test.Exps, odocs, "test #%d", tidx)
+		strs := []string{}
+		for _, d := range diags {
+			strs = append(strs, d.String())
+		}
+		if test.Diags == nil {
+			test.Diags = []string{}
+		}
+		require.Equal(t, test.Diags, strs, "test #%d", tidx)
+	}
+}
+
+// clearSource zeroes the fields of each OmegaDoc which describe where it came
+// from, leaving only the fields produced from the text of the OmegaDoc.
+// StartLineNumber is kept since many tests care about it.
+func clearSource(odocs []domain.OmegaDoc) {
+	for idx := range odocs {
+		startline := odocs[idx].StartLineNumber
+		odocs[idx] = domain.OmegaDoc{
+			DestFilePath:    odocs[idx].DestFilePath,
+			Attributes:      odocs[idx].Attributes,
+			Contents:        odocs[idx].Contents,
+			StartLineNumber: startline,
+		}
+	}
+}
+
+func TestParseEscapedMagic(t *testing.T) {
+	type tst struct {
+		Def  string
+		Exps []domain.OmegaDoc
+	}
+	for tidx, test := range []tst{
+		// An escaped opening statement doesn't begin an OmegaDoc.
+		{Def: "\\#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n", Exps: []domain.OmegaDoc{}},
+		{Def: "// \\#!/usr/bin/env omegadoc ignore-this-file\n#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Contents: "hello\n", Attributes: mkoat(), StartLineNumber: 1}}},
+		// Within the contents, escaped magic strings become literal magic
+		// strings.
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\nExample:\n\n\t\\#!/usr/bin/env omegadoc <<END example.md\n\tEND\n" +
+			"Or \\\\#!/usr/bin/env omegadoc ignore-this-file\nEOD\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat(),
+				Contents: "Example:\n\n\t#!/usr/bin/env omegadoc <<END example.md\n\tEND\nOr \\#!/usr/bin/env omegadoc ignore-this-file\n"}}},
+		{Def: "\\#!/usr/bin/env omegadoc <<EOD x.md\n#!/usr/bin/env omegadoc include-this-file r/a.md\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat(), Contents: "#!/usr/bin/env omegadoc <<EOD x.md\n"}}},
+	} {
+		odocs, _, err := NewDocParser().ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		clearSource(odocs)
+		require.Equal(t, test.Exps, odocs, "test #%d", tidx)
+	}
+}
+
+func TestParseHeaderContinuation(t *testing.T) {
+	type tst struct {
+		Def   string
+		Exps  []domain.OmegaDoc
+		Diags []string
+	}
+	for tidx, test := range []tst{
+		{Def: "a\n// #!/usr/bin/env omegadoc <<EOD owner:payments \\\n//   title:\"Payment service\" \\\n//   docs/pay.md\n// hello\n// EOD\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "docs/pay.md", Attributes: mkoat("owner", "payments", "title", "Payment service"),
+				Contents: "hello\n", StartLineNumber: 1}}},
+		// Only a backslash at the very end of a line continues the header.
+		{Def: "#!/usr/bin/env omegadoc <<EOD a:b\\\nc:d r/a.md\nhello\nEOD\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat("a", "b", "c", "d"), Contents: "hello\n"}}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD a:b\\c r/a.md\nhello\nEOD\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat("a", "b\\c"), Contents: "hello\n"}}},
+		{Def: "#!/usr/bin/env omegadoc include-this-file a:b \\\n  r/a.md\nhello\n",
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat("a", "b"), Contents: "hello\n"}}},
+		// Problems on continuation lines are reported at their position.
+		{Def: "# #!/usr/bin/env omegadoc <<EOD a:b \\\n#    title:\"oops r/a.md\nhello\nEOD\n",
+			Exps:  []domain.OmegaDoc{},
+			Diags: []string{`f.md:2:12: error: when parsing opening statement: unterminated quoted string [malformed-attribute]`}},
+	} {
+		odocs, diags, err := NewDocParser().ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		clearSource(odocs)
+		require.Equal(t, test.Exps, odocs, "test #%d", tidx)
+		strs := []string{}
+		for _, d := range diags {
+			strs = append(strs, d.String())
+		}
+		if test.Diags == nil {
+			test.Diags = []string{}
+		}
+		require.Equal(t, test.Diags, strs, "test #%d", tidx)
+	}
+}
+
+func TestParsePositions(t *testing.T) {
+	type pos struct {
+		StartLine, StartCol, EndLine int
+		Header, Body                 [2]int64
+		Delim                        int64
+	}
+	open := domain.START_OMEGADOC
+	for tidx, test := range []struct {
+		Def       string
+		Substring bool
+		Exp       pos
+	}{
+		{Def: "a\n" + open + "EOD r/a.md\nhello\nEOD\nb\n",
+			Exp: pos{StartLine: 1, EndLine: 3, Header: [2]int64{2, 39}, Body: [2]int64{39, 45}, Delim: 45}},
+		{Def: "a\n// " + open + "EOD r/a.md\n// hello\n//   EOD\n",
+			Exp: pos{StartLine: 1, StartCol: 3, EndLine: 3, Header: [2]int64{5, 42}, Body: [2]int64{42, 51}, Delim: 56}},
+		// Multi-byte runes before the opening statement count as one column
+		// but several bytes.
+		{Def: "é " + open + "EOD r/a.md\nhéllo\nEOD\n",
+			Exp: pos{StartCol: 2, EndLine: 2, Header: [2]int64{3, 40}, Body: [2]int64{40, 47}, Delim: 47}},
+		{Def: open + "EOD r/a.md\nhello EOD after\n", Substring: true,
+			Exp: pos{EndLine: 1, Header: [2]int64{0, 37}, Body: [2]int64{37, 43}, Delim: 43}},
+		// Ended by the end of the file.
+		{Def: open + "EOD r/a.md\nhello\nworld\n",
+			Exp: pos{EndLine: 2, Header: [2]int64{0, 37}, Body: [2]int64{37, 49}, Delim: -1}},
+		{Def: open + "EOD r/a.md\nhello\nworld",
+			Exp: pos{EndLine: 2, Header: [2]int64{0, 37}, Body: [2]int64{37, 48}, Delim: -1}},
+	} {
+		odocs, _, err := NewDocParser(WithSubstringDelimiters(test.Substring)).ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		od := odocs[0]
+		got := pos{
+			StartLine: od.StartLineNumber, StartCol: od.StartColumn, EndLine: od.EndLineNumber,
+			Header: [2]int64{od.HeaderStartOffset, od.HeaderEndOffset},
+			Body:   [2]int64{od.BodyStartOffset, od.BodyEndOffset},
+			Delim:  od.DelimiterOffset,
+		}
+		require.Equal(t, test.Exp, got, "test #%d", tidx)
+		if od.DelimiterOffset >= 0 {
+			require.Equal(t, "EOD", test.Def[od.DelimiterOffset:od.DelimiterOffset+3], "test #%d", tidx)
+		}
+		require.Equal(t, open, test.Def[od.HeaderStartOffset:od.HeaderStartOffset+int64(len(open))], "test #%d", tidx)
+	}
+}
+
+func TestParseIncludePositions(t *testing.T) {
+	def := "# Title\n<!-- " + domain.INCLUDE_OMEGADOC + " r/a.md -->\nbody\n"
+	odocs, _, err := NewDocParser().ParseDoc("f.md", strings.NewReader(def))
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	od := odocs[0]
+	require.Equal(t, 0, od.StartLineNumber)
+	require.Equal(t, 2, od.EndLineNumber)
+	require.Equal(t, 5, od.StartColumn)
+	require.Equal(t, int64(13), od.HeaderStartOffset)
+	require.Equal(t, int64(strings.Index(def, "body")), od.HeaderEndOffset)
+	require.Equal(t, int64(0), od.BodyStartOffset)
+	require.Equal(t, int64(len(def)), od.BodyEndOffset)
+	require.Equal(t, int64(-1), od.DelimiterOffset)
+}
+
+func TestParseDocStream(t *testing.T) {
+	def := "#!/usr/bin/env omegadoc <<EOD r/a.md\na\nEOD\n" +
+		"#!/usr/bin/env omegadoc <<EOD r/b.md\nb\nEOD\n" +
+		"#!/usr/bin/env omegadoc <<EOD r/c.md\nc\nEOD\n"
+	dests := []string{}
+	diags, err := NewDocParser().ParseDocStream("f.md", strings.NewReader(def), func(od domain.OmegaDoc) error {
+		dests = append(dests, od.DestFilePath)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, diags)
+	require.Equal(t, []string{"r/a.md", "r/b.md", "r/c.md"}, dests)
+
+	// An error from emit stops the parse.
+	stop := errors.New("stop")
+	dests = []string{}
+	_, err = NewDocParser().ParseDocStream("f.md", strings.NewReader(def), func(od domain.OmegaDoc) error {
+		dests = append(dests, od.DestFilePath)
+		if len(dests) == 2 {
+			return stop
+		}
+		return nil
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, []string{"r/a.md", "r/b.md"}, dests)
+}
+
+func TestParseIncludeUnseekable(t *testing.T) {
+	// Whether or not the reader can seek, the whole file is included, even
+	// when it doesn't start at the beginning of the reader.
+	def := "# Title\n#!/usr/bin/env omegadoc include-this-file r/a.md\n" + strings.Repeat("body\n", 20000)
+	exp := "# Title\n" + strings.Repeat("body\n", 20000)
+	for tidx, rdr := range []io.Reader{
+		strings.NewReader(def),
+		onlyReader{strings.NewReader(def)},
+	} {
+		odocs, _, err := NewDocParser().ParseDoc("f.md", rdr)
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, exp, odocs[0].Contents, "test #%d", tidx)
+	}
+	rdr := strings.NewReader("skipped" + def)
+	rdr.Seek(int64(len("skipped")), io.SeekStart)
+	odocs, _, err := NewDocParser().ParseDoc("f.md", rdr)
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	require.Equal(t, exp, odocs[0].Contents)
+}
+
+func TestParseIncludeReopen(t *testing.T) {
+	// A reader which can't seek but can be reopened is read again for an
+	// include directive, and only then.
+	withinc := "# Title\n" + domain.INCLUDE_OMEGADOC + " r/a.md\nbody\n"
+	without := "# Title\n" + domain.START_OMEGADOC + "EOD r/b.md\nbody\nEOD\n"
+	type tst struct {
+		Def    string
+		Opened int
+		Dest   string
+	}
+	for tidx, test := range []tst{
+		{Def: withinc, Opened: 1, Dest: "r/a.md"},
+		{Def: without, Opened: 0, Dest: "r/b.md"},
+	} {
+		for _, dp := range []domain.DocParser{NewDocParser(), NewDefaultRegistry()} {
+			opened := 0
+			rdr := domain.NewReopener(onlyReader{strings.NewReader(test.Def)}, func() (io.ReadCloser, error) {
+				opened++
+				return io.NopCloser(strings.NewReader(test.Def)), nil
+			})
+			odocs, _, err := dp.ParseDoc("f.md", rdr)
+			require.NoError(t, err, "test #%d", tidx)
+			require.Len(t, odocs, 1, "test #%d", tidx)
+			require.Equal(t, test.Dest, odocs[0].DestFilePath, "test #%d", tidx)
+			require.Equal(t, test.Opened, opened, "test #%d", tidx)
+		}
+	}
+}
+
+func TestParseLongLines(t *testing.T) {
+	// The magic string may be found anywhere within lines far longer than
+	// the read buffer, and right after a stray '#'.
+	long := strings.Repeat("x", 3*readBufferSize)
+	def := long + "##!/usr/bin/env omegadoc <<EOD r/a.md\n" + long + "\nEOD\n"
+	odocs, _, err := NewDocParser().ParseDoc("f.md", strings.NewReader(def))
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	require.Equal(t, long+"\n", odocs[0].Contents)
+	require.Equal(t, int64(len(long)+1), odocs[0].HeaderStartOffset)
+}
+
+func TestParseMagicSyntaxes(t *testing.T) {
+	at, err := domain.ParseMagicSyntax("@omegadoc <<")
+	require.NoError(t, err)
+	colon, err := domain.ParseMagicSyntax("omegadoc:begin")
+	require.NoError(t, err)
+	type tst struct {
+		Def      string
+		Syntaxes []domain.MagicSyntax
+		Exps     []domain.OmegaDoc
+		Diags    []string
+	}
+	for tidx, test := range []tst{
+		{Def: "@omegadoc <<EOD r/a.md\nhello\nEOD\n", Syntaxes: []domain.MagicSyntax{at},
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat(), Contents: "hello\n"}}},
+		{Def: "-- omegadoc:begin EOD r/a.md\n-- hello\n-- EOD\n", Syntaxes: []domain.MagicSyntax{colon},
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat(), Contents: "hello\n"}}},
+		{Def: "omegadoc:begin   EOD  title:x r/a.md\nhello\nEOD\n", Syntaxes: []domain.MagicSyntax{colon},
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat("title", "x"), Contents: "hello\n"}}},
+		// A word-style opening must be followed by whitespace, and then the
+		// delimiting identifier on the same line.
+		{Def: "omegadoc:beginning EOD r/a.md\nhello\nEOD\n", Syntaxes: []domain.MagicSyntax{colon},
+			Exps: []domain.OmegaDoc{}},
+		{Def: "omegadoc:begin \nhello\nEOD\n", Syntaxes: []domain.MagicSyntax{colon},
+			Exps:  []domain.OmegaDoc{},
+			Diags: []string{`f.md:1:1: error: opening statement has no delimiting identifier after "begin" [missing-delimiter]`}},
+		// Only the configured syntaxes are recognized.
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\nhello\nEOD\n", Syntaxes: []domain.MagicSyntax{at},
+			Exps: []domain.OmegaDoc{}},
+		{Def: "#!/usr/bin/env omegadoc <<EOD r/a.md\na\nEOD\n@omegadoc <<EOD r/b.md\nb\nEOD\n",
+			Syntaxes: []domain.MagicSyntax{domain.DefaultMagicSyntax, at},
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat(), Contents: "a\n"},
+				{DestFilePath: "r/b.md", Attributes: mkoat(), Contents: "b\n", StartLineNumber: 3}}},
+		// Directives and escapes work the same way in every syntax.
+		{Def: "omegadoc:ignore-this-file\nomegadoc:begin EOD r/a.md\nhello\nEOD\n", Syntaxes: []domain.MagicSyntax{colon},
+			Exps: []domain.OmegaDoc{}},
+		{Def: "@omegadoc ignore-start\n#!/usr/bin/env omegadoc <<EOD r/a.md\nEOD\n#!/usr/bin/env omegadoc ignore-end\n@omegadoc <<EOD r/b.md\nb\nEOD\n",
+			Syntaxes: []domain.MagicSyntax{domain.DefaultMagicSyntax, at},
+			Exps:     []domain.OmegaDoc{{DestFilePath: "r/b.md", Attributes: mkoat(), Contents: "b\n", StartLineNumber: 4}}},
+		{Def: "@omegadoc <<EOD r/a.md\n\\@omegadoc <<END x.md\nEOD\n", Syntaxes: []domain.MagicSyntax{at},
+			Exps: []domain.OmegaDoc{{DestFilePath: "r/a.md", Attributes: mkoat(), Contents: "@omegadoc <<END x.md\n"}}},
+	} {
+		odocs, diags, err := NewDocParser(WithMagicSyntaxes(test.Syntaxes...)).ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		clearSource(odocs)
+		require.Equal(t, test.Exps, odocs, "test #%d", tidx)
+		strs := []string{}
+		for _, d := range diags {
+			strs = append(strs, d.String())
+		}
+		if test.Diags == nil {
+			test.Diags = []string{}
+		}
+		require.Equal(t, test.Diags, strs, "test #%d", tidx)
+	}
+}
@@ -0,0 +1,201 @@
+package docparser
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/lelandbatey/omegadoc/domain"
+)
+
+// readBufferSize is the size of the buffer with which sources are read.
+const readBufferSize = 64 << 10
+
+// sniffLen is the number of bytes examined when guessing the encoding of text
+// which doesn't start with a byte order mark, or which parser reads a file.
+const sniffLen = domain.SniffLen
+
+// detectEncoding determines the encoding of the text in br, as
+// domain.DetectEncoding does, without consuming anything except a byte order
+// mark, if there is one. The length of the byte order mark is returned
+// alongside the encoding.
+func detectEncoding(br *bufio.Reader) (domain.TextEncoding, int, error) {
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return domain.EncodingUTF8, 0, err
+	}
+	enc, bomlen := domain.DetectEncoding(head)
+	if bomlen > 0 {
+		if _, err := br.Discard(bomlen); err != nil {
+			return enc, bomlen, err
+		}
+	}
+	return enc, bomlen, nil
+}
+
+// utf16Reader transcodes UTF-16 text into UTF-8. Unpaired surrogates and a
+// trailing odd byte are replaced with the Unicode replacement character.
+type utf16Reader struct {
+	src   io.Reader
+	order binary.ByteOrder
+	out   []byte
+	err   error
+	// pending holds a code unit which was read while looking for the second
+	// half of a surrogate pair, but which turned out not to be part of it.
+	pending    uint16
+	hasPending bool
+
+	// runs map offsets within the transcoded text to offsets within the
+	// source, while outoff and srcoff are the offsets of what was transcoded
+	// so far.
+	runs           []offsetRun
+	outoff, srcoff int64
+}
+
+// offsetRun begins a run of characters which are each outw bytes long once
+// transcoded, and srcw bytes long in the source. Most text is made of only a
+// few long runs, such as a run of ASCII.
+type offsetRun struct {
+	out, src   int64
+	outw, srcw int64
+}
+
+// readUnit returns the next code unit, along with the number of bytes of the
+// source it was read from.
+func (u *utf16Reader) readUnit() (uint16, int64, error) {
+	if u.hasPending {
+		u.hasPending = false
+		return u.pending, 2, nil
+	}
+	var b [2]byte
+	n, err := io.ReadFull(u.src, b[:])
+	if err == io.ErrUnexpectedEOF && n == 1 {
+		return utf8.RuneError, 1, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return u.order.Uint16(b[:]), 2, nil
+}
+
+// advance records that a character srcw bytes long in the source was
+// transcoded into outw bytes.
+func (u *utf16Reader) advance(outw, srcw int64) {
+	if n := len(u.runs); n == 0 || u.runs[n-1].outw != outw || u.runs[n-1].srcw != srcw {
+		u.runs = append(u.runs, offsetRun{out: u.outoff, src: u.srcoff, outw: outw, srcw: srcw})
+	}
+	u.outoff += outw
+	u.srcoff += srcw
+}
+
+// sourceOffset returns the offset within the source of the character at
+// offset off within the transcoded text, or just past the end of the source
+// if off is just past the end of what was transcoded.
+func (u *utf16Reader) sourceOffset(off int64) int64 {
+	i := sort.Search(len(u.runs), func(i int) bool { return u.runs[i].out > off }) - 1
+	if i < 0 {
+		return off
+	}
+	run := u.runs[i]
+	return run.src + (off-run.out)/run.outw*run.srcw
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	var enc [utf8.UTFMax]byte
+	for len(u.out) < len(p) && u.err == nil {
+		unit, srcw, err := u.readUnit()
+		if err != nil {
+			u.err = err
+			break
+		}
+		r := rune(unit)
+		if utf16.IsSurrogate(r) {
+			next, nextw, err := u.readUnit()
+			if err != nil {
+				u.err = err
+				r = utf8.RuneError
+			} else if dec := utf16.DecodeRune(r, rune(next)); dec != utf8.RuneError {
+				r = dec
+				srcw += nextw
+			} else {
+				// Not a valid pair; the second unit may begin a pair of its
+				// own, so it has to be looked at again.
+				r = utf8.RuneError
+				u.pending, u.hasPending = next, true
+			}
+		}
+		n := utf8.EncodeRune(enc[:], r)
+		u.out = append(u.out, enc[:n]...)
+		u.advance(int64(n), srcw)
+	}
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	if n == 0 && u.err != nil {
+		return 0, u.err
+	}
+	return n, nil
+}
+
+// decodeText returns a reader of the text in r transcoded into UTF-8, without
+// any byte order mark. The detected encoding and the length of the byte order
+// mark which was removed are also returned.
+func decodeText(r io.Reader) (io.Reader, domain.TextEncoding, int, error) {
+	br := bufio.NewReaderSize(r, readBufferSize)
+	enc, bomlen, err := detectEncoding(br)
+	if err != nil {
+		return nil, enc, 0, err
+	}
+	switch enc {
+	case domain.EncodingUTF16LE:
+		return &utf16Reader{src: br, order: binary.LittleEndian}, enc, bomlen, nil
+	case domain.EncodingUTF16BE:
+		return &utf16Reader{src: br, order: binary.BigEndian}, enc, bomlen, nil
+	}
+	return br, enc, bomlen, nil
+}
+
+// LineEndings controls how the line endings of the contents of an OmegaDoc are
+// written.
+type LineEndings int
+
+const (
+	// LineEndingsNormalize writes every line ending as a single newline ("\n"),
+	// whatever line ending was used in the source file.
+	LineEndingsNormalize LineEndings = iota
+	// LineEndingsKeep writes each line ending of the contents exactly as it
+	// was in the source file, so CRLF line endings stay as CRLF.
+	LineEndingsKeep
+)
+
+// ParseLineEndings returns the LineEndings named by name, which must be either
+// "normalize" or "keep".
+func ParseLineEndings(name string) (LineEndings, error) {
+	switch name {
+	case "normalize":
+		return LineEndingsNormalize, nil
+	case "keep":
+		return LineEndingsKeep, nil
+	}
+	return LineEndingsNormalize, fmt.Errorf("unknown line endings %q, must be one of \"normalize\" or \"keep\"", name)
+}
+
+// restoreCRLF replaces the newline ending each line of contents with a CRLF
+// where the corresponding entry in crlf is true.
+func restoreCRLF(contents []rune, crlf []bool) []rune {
+	out := make([]rune, 0, len(contents)+len(crlf))
+	line := 0
+	for _, r := range contents {
+		if r == '\n' {
+			if line < len(crlf) && crlf[line] {
+				out = append(out, '\r')
+			}
+			line++
+		}
+		out = append(out, r)
+	}
+	return out
+}
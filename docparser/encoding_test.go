@@ -0,0 +1,171 @@
+package docparser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// toUTF16 encodes s as UTF-16 in the given byte order, optionally preceded by
+// a byte order mark.
+func toUTF16(s string, order binary.ByteOrder, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xFEFF}, units...)
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, order, units)
+	return buf.Bytes()
+}
+
+func TestParseEncodings(t *testing.T) {
+	header := domain.START_OMEGADOC + "EOD r/a.md\n"
+	src := "é\n" + header + "héllo 🌍\nEOD\n"
+	utf8 := func(s string) []byte { return []byte(s) }
+	utf16le := func(s string) []byte { return toUTF16(s, binary.LittleEndian, false) }
+	utf16be := func(s string) []byte { return toUTF16(s, binary.BigEndian, false) }
+	for tidx, test := range []struct {
+		Name   string
+		BOM    []byte
+		Encode func(string) []byte
+	}{
+		{"utf-8", nil, utf8},
+		{"utf-8 bom", []byte{0xEF, 0xBB, 0xBF}, utf8},
+		{"utf-16le bom", []byte{0xFF, 0xFE}, utf16le},
+		{"utf-16be bom", []byte{0xFE, 0xFF}, utf16be},
+		{"utf-16le", nil, utf16le},
+		{"utf-16be", nil, utf16be},
+	} {
+		data := append(append([]byte{}, test.BOM...), test.Encode(src)...)
+		odocs, diags, err := NewDocParser().ParseDoc("f.md", bytes.NewReader(data))
+		require.NoError(t, err, "test #%d %s", tidx, test.Name)
+		require.Empty(t, diags, "test #%d %s", tidx, test.Name)
+		require.Len(t, odocs, 1, "test #%d %s", tidx, test.Name)
+		od := odocs[0]
+		require.Equal(t, "r/a.md", od.DestFilePath, "test #%d %s", tidx, test.Name)
+		require.Equal(t, "héllo 🌍\n", od.Contents, "test #%d %s", tidx, test.Name)
+		require.Equal(t, 1, od.StartLineNumber, "test #%d %s", tidx, test.Name)
+		// Offsets are of the bytes of the file, whatever its encoding.
+		require.Equal(t, test.Encode(header), data[od.HeaderStartOffset:od.HeaderEndOffset], "test #%d %s", tidx, test.Name)
+		require.Equal(t, test.Encode("héllo 🌍\n"), data[od.BodyStartOffset:od.BodyEndOffset], "test #%d %s", tidx, test.Name)
+		require.Equal(t, test.Encode("EOD\n"), data[od.DelimiterOffset:], "test #%d %s", tidx, test.Name)
+	}
+}
+
+func TestParseIncludeUTF16Offsets(t *testing.T) {
+	src := "<!-- " + domain.INCLUDE_OMEGADOC + " r/a.md -->\n# Tïtle 🌍\n"
+	data := toUTF16(src, binary.LittleEndian, true)
+	for tidx, rdr := range []io.Reader{bytes.NewReader(data), io.MultiReader(bytes.NewReader(data))} {
+		odocs, _, err := NewDocParser().ParseDoc("f.md", rdr)
+		require.NoError(t, err, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, int64(2+2*len("<!-- ")), odocs[0].HeaderStartOffset, "test #%d", tidx)
+		require.Equal(t, int64(2), odocs[0].BodyStartOffset, "test #%d", tidx)
+		require.Equal(t, int64(len(data)), odocs[0].BodyEndOffset, "test #%d", tidx)
+	}
+}
+
+func TestParseByteOrderMarkNotInContents(t *testing.T) {
+	// The byte order mark must not end up in the first line of an included
+	// file, but offsets still count it.
+	src := "<!-- " + domain.INCLUDE_OMEGADOC + " r/a.md -->\n# Title\n"
+	data := append([]byte{0xEF, 0xBB, 0xBF}, src...)
+	odocs, _, err := NewDocParser().ParseDoc("f.md", bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	require.Equal(t, "# Title\n", odocs[0].Contents)
+	require.Equal(t, int64(3+5), odocs[0].HeaderStartOffset)
+	require.Equal(t, int64(len(data)), odocs[0].BodyEndOffset)
+}
+
+func TestParseCRLF(t *testing.T) {
+	open := domain.START_OMEGADOC
+	for tidx, test := range []struct {
+		Def      string
+		Endings  LineEndings
+		DestFP   string
+		Contents string
+	}{
+		{Def: open + "EOD r/a.md\r\nhello\r\nworld\r\nEOD\r\n",
+			DestFP: "r/a.md", Contents: "hello\nworld\n"},
+		{Def: open + "EOD r/a.md\r\nhello\r\nworld\r\nEOD\r\n", Endings: LineEndingsKeep,
+			DestFP: "r/a.md", Contents: "hello\r\nworld\r\n"},
+		// Mixed line endings are kept line by line.
+		{Def: open + "EOD r/a.md\r\nhello\nworld\r\nEOD\r\n", Endings: LineEndingsKeep,
+			DestFP: "r/a.md", Contents: "hello\nworld\r\n"},
+		// Quoted values, continuations, line prefixes and dedent all see
+		// plain newlines.
+		{Def: "// " + open + "EOD title:\"A B\" \\\r\n//   r/a.md\r\n//   hello\r\n//\r\n//     world\r\n// EOD\r\n",
+			DestFP: "r/a.md", Contents: "hello\n\n  world\n"},
+		{Def: "// " + open + "EOD r/a.md\r\n//   hello\r\n//\r\n//     world\r\n// EOD\r\n", Endings: LineEndingsKeep,
+			DestFP: "r/a.md", Contents: "hello\r\n\r\n  world\r\n"},
+		// A lone carriage return isn't a line ending.
+		{Def: open + "EOD r/a.md\r\nhello\rworld\r\nEOD\r\n",
+			DestFP: "r/a.md", Contents: "hello\rworld\n"},
+		{Def: "<!-- " + domain.INCLUDE_OMEGADOC + " r/a.md -->\r\n# Title\r\nbody\r\n",
+			DestFP: "r/a.md", Contents: "# Title\nbody\n"},
+		{Def: "<!-- " + domain.INCLUDE_OMEGADOC + " r/a.md -->\r\n# Title\r\nbody\r\n", Endings: LineEndingsKeep,
+			DestFP: "r/a.md", Contents: "# Title\r\nbody\r\n"},
+	} {
+		odocs, diags, err := NewDocParser(WithLineEndings(test.Endings)).ParseDoc("f.md", strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Empty(t, diags, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, test.DestFP, odocs[0].DestFilePath, "test #%d", tidx)
+		require.Equal(t, test.Contents, odocs[0].Contents, "test #%d", tidx)
+	}
+}
+
+func TestParseCRLFPositions(t *testing.T) {
+	def := "a\r\n" + domain.START_OMEGADOC + "EOD r/a.md\r\nhello\r\nEOD more\r\nEOD\r\n"
+	odocs, _, err := NewDocParser().ParseDoc("f.md", strings.NewReader(def))
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	od := odocs[0]
+	require.Equal(t, 1, od.StartLineNumber)
+	require.Equal(t, 4, od.EndLineNumber)
+	require.Equal(t, int64(3), od.HeaderStartOffset)
+	require.Equal(t, int64(strings.Index(def, "hello")), od.HeaderEndOffset)
+	require.Equal(t, int64(strings.LastIndex(def, "EOD\r\n")), od.DelimiterOffset)
+	require.Equal(t, od.DelimiterOffset, od.BodyEndOffset)
+
+	// Text after the delimiting identifier is re-read by the substring rule,
+	// and the CRLF which is unread along with it must still be counted as
+	// two bytes.
+	def = domain.START_OMEGADOC + "EOD r/a.md\r\nhello EOD\r\n" + domain.START_OMEGADOC + "END r/b.md\r\nhi\r\nEND\r\n"
+	odocs, _, err = NewDocParser(WithSubstringDelimiters(true)).ParseDoc("f.md", strings.NewReader(def))
+	require.NoError(t, err)
+	require.Len(t, odocs, 2)
+	require.Equal(t, "hello ", odocs[0].Contents)
+	require.Equal(t, "hi\n", odocs[1].Contents)
+	require.Equal(t, int64(strings.LastIndex(def, domain.START_OMEGADOC)), odocs[1].HeaderStartOffset)
+	require.Equal(t, int64(strings.LastIndex(def, "END")), odocs[1].DelimiterOffset)
+}
+
+func TestUTF16ReaderInvalid(t *testing.T) {
+	// An unpaired high surrogate followed by an ordinary character, then a
+	// trailing odd byte.
+	data := []byte{0x00, 0xD8, 'a', 0x00, 'b'}
+	rdr := &utf16Reader{src: bytes.NewReader(data), order: binary.LittleEndian}
+	out, err := io.ReadAll(rdr)
+	require.NoError(t, err)
+	require.Equal(t, "�a�", string(out))
+	require.Equal(t, int64(2), rdr.sourceOffset(int64(len("�"))))
+	require.Equal(t, int64(4), rdr.sourceOffset(int64(len("�a"))))
+	require.Equal(t, int64(5), rdr.sourceOffset(int64(len(out))))
+}
+
+func TestDetectEncodingBinary(t *testing.T) {
+	// Scattered NULs, as in a binary file, don't look like UTF-16.
+	data := []byte("\x7fELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00")
+	_, enc, bomlen, err := decodeText(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, domain.EncodingUTF8, enc)
+	require.Equal(t, 0, bomlen)
+}
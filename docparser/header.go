@@ -0,0 +1,246 @@
+package docparser
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/lelandbatey/omegadoc/domain"
+)
+
+// header holds the attributes and destination file path found in the
+// opening statement of an OmegaDoc, after the delimiting identifier.
+type header struct {
+	Attrs        []oatt
+	DestFilePath []rune
+}
+
+// headerError describes a problem found while parsing the header of an
+// opening statement. Col is the index of the offending rune within the
+// header, and Code is the code of the Diagnostic describing the problem.
+type headerError struct {
+	Col  int
+	Code string
+	Msg  string
+}
+
+func (e *headerError) Error() string {
+	return e.Msg
+}
+
+// parseHeader parses the portion of an opening statement which follows the
+// delimiting identifier. The grammar is a series of whitespace-separated
+// attributes followed by a destination file path:
+//
+//	key:value key:"quoted value" path/to/output.md
+//	key:value "quoted/path to/output.md"
+//
+// Attribute keys are any run of non-whitespace runes preceding a ':'. Values
+// and destination paths may be double-quoted, in which case they may contain
+// whitespace and the escape sequences \" \\ \n and \t. An unquoted
+// destination path is the remainder of the line, verbatim. A header without a
+// destination path returns an empty DestFilePath and no error.
+func parseHeader(line []rune) (header, error) {
+	hdr := header{}
+	// The trailing newline isn't part of the header
+	if len(line) > 0 && line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	pos := 0
+	for {
+		for pos < len(line) && unicode.IsSpace(line[pos]) {
+			pos++
+		}
+		if pos == len(line) {
+			return hdr, nil
+		}
+		if line[pos] == '"' {
+			dest, end, err := readQuoted(line, pos, domain.DiagMalformedDestPath)
+			if err != nil {
+				return hdr, err
+			}
+			for i := end; i < len(line); i++ {
+				if !unicode.IsSpace(line[i]) {
+					return hdr, &headerError{Col: i, Code: domain.DiagMalformedDestPath, Msg: fmt.Sprintf("unexpected text %q after quoted destination path", string(line[i:]))}
+				}
+			}
+			hdr.DestFilePath = dest
+			return hdr, nil
+		}
+
+		// Determine if this token is an attribute by searching for a ':'
+		// before the end of the token.
+		keyend := -1
+		for i := pos; i < len(line); i++ {
+			if unicode.IsSpace(line[i]) || line[i] == '"' {
+				break
+			}
+			if line[i] == ':' {
+				keyend = i
+				break
+			}
+		}
+		if keyend == -1 {
+			// Isn't an attribute, must be destination file path.
+			hdr.DestFilePath = line[pos:]
+			return hdr, nil
+		}
+
+		// This is an attribute, there could be many
+		attrstart := pos
+		key := string(line[pos:keyend])
+		if key == "" {
+			return hdr, &headerError{Col: pos, Code: domain.DiagMalformedAttribute, Msg: "attribute has an empty key"}
+		}
+		pos = keyend + 1
+		if pos < len(line) && line[pos] == '"' {
+			val, end, err := readQuoted(line, pos, domain.DiagMalformedAttribute)
+			if err != nil {
+				return hdr, err
+			}
+			if end < len(line) && !unicode.IsSpace(line[end]) {
+				return hdr, &headerError{Col: end, Code: domain.DiagMalformedAttribute, Msg: fmt.Sprintf("expected whitespace after quoted value of attribute %q, found %q", key, line[end])}
+			}
+			if err := checkAttribute(key, string(val), attrstart); err != nil {
+				return hdr, err
+			}
+			hdr.Attrs = append(hdr.Attrs, oatt{Key: key, Value: string(val)})
+			pos = end
+			continue
+		}
+		valstart := pos
+		for pos < len(line) && !unicode.IsSpace(line[pos]) {
+			pos++
+		}
+		if err := checkAttribute(key, string(line[valstart:pos]), attrstart); err != nil {
+			return hdr, err
+		}
+		hdr.Attrs = append(hdr.Attrs, oatt{Key: key, Value: string(line[valstart:pos])})
+	}
+}
+
+// checkAttribute returns an error if value isn't allowed for the attribute
+// key, which begins at column col. Attributes which the parser itself acts
+// on, such as INDENT_ATTR, are checked, while any other attribute may have
+// any value.
+func checkAttribute(key, value string, col int) error {
+	if strings.ToLower(key) == INDENT_ATTR && !validIndentMode(value) {
+		return &headerError{Col: col, Code: domain.DiagMalformedAttribute, Msg: fmt.Sprintf("unknown value %q of attribute %q; expected %q or %q", value, key, INDENT_STRIP, INDENT_KEEP)}
+	}
+	return nil
+}
+
+// readQuoted reads a double-quoted string beginning at line[start], returning
+// the unescaped contents and the index just after the closing quote. Errors
+// are reported with the given Diagnostic code.
+func readQuoted(line []rune, start int, code string) ([]rune, int, error) {
+	buf := []rune{}
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			return buf, i + 1, nil
+		case '\\':
+			if i+1 == len(line) {
+				return nil, 0, &headerError{Col: i, Code: code, Msg: "escape sequence at end of line"}
+			}
+			i++
+			switch line[i] {
+			case '"', '\\':
+				buf = append(buf, line[i])
+			case 'n':
+				buf = append(buf, '\n')
+			case 't':
+				buf = append(buf, '\t')
+			default:
+				return nil, 0, &headerError{Col: i - 1, Code: code, Msg: fmt.Sprintf("unknown escape sequence \\%c in quoted string", line[i])}
+			}
+		default:
+			buf = append(buf, line[i])
+		}
+	}
+	return nil, 0, &headerError{Col: start, Code: code, Msg: "unterminated quoted string"}
+}
+
+// headerLines holds the header of an opening statement or directive, which
+// may be continued across several lines by ending each line but the last with
+// a backslash. Text holds the header with the lines joined by single spaces,
+// while Segs records where each line's portion of Text came from so that
+// positions within Text can be mapped back to the source.
+type headerLines struct {
+	Text []rune
+	Segs []headerSegment
+}
+
+type headerSegment struct {
+	// Line is the 0-based line number of this segment
+	Line int
+	// Col is the 0-based column on Line at which this segment starts
+	Col int
+	// Start is the index within headerLines.Text at which this segment starts
+	Start int
+}
+
+// Position returns the 0-based line and 1-based column within the source of
+// the rune at index idx of the header.
+func (hl headerLines) Position(idx int) (int, int) {
+	seg := hl.Segs[0]
+	for _, s := range hl.Segs {
+		if s.Start <= idx {
+			seg = s
+		}
+	}
+	return seg.Line, seg.Col + (idx - seg.Start) + 1
+}
+
+// continuationPrefix returns the prefix to be removed from the start of each
+// continuation line of a header, which is the text preceding the magic string
+// on the first line of the header so long as it looks like a comment leader.
+func continuationPrefix(lineprefix []rune) []rune {
+	if isCommentPrefix(lineprefix) {
+		return lineprefix
+	}
+	return nil
+}
+
+// readHeaderLines reads the remainder of the current line as a header. If the
+// line ends with a backslash, the backslash is removed and the following line
+// (minus prefix) is read as a continuation of the header, and so on. This
+// allows headers with many attributes to be split across lines:
+//
+//	<<EOD owner:payments \
+//	      title:"Payment service overview" \
+//	      docs/payments/index.md
+func readHeaderLines(ods *odScanner, prefix []rune) (headerLines, error) {
+	hl := headerLines{}
+	for {
+		line, col := ods.LineNumber(), len(ods.Line)
+		text, err := ods.ReadLine()
+		if len(hl.Segs) > 0 {
+			stripped := stripLinePrefix(text, prefix)
+			col += len(text) - len(stripped)
+			text = stripped
+			hl.Text = append(hl.Text, ' ')
+		}
+		if len(text) > 0 && text[len(text)-1] == '\n' {
+			text = text[:len(text)-1]
+		}
+		trimmed := trimRightSpaceRunes(text)
+		cont := len(trimmed) > 0 && trimmed[len(trimmed)-1] == '\\'
+		if cont {
+			text = trimmed[:len(trimmed)-1]
+		}
+		hl.Segs = append(hl.Segs, headerSegment{Line: line, Col: col, Start: len(hl.Text)})
+		hl.Text = append(hl.Text, text...)
+		if err != nil || !cont {
+			return hl, err
+		}
+	}
+}
+
+func trimRightSpaceRunes(rs []rune) []rune {
+	end := len(rs)
+	for end > 0 && unicode.IsSpace(rs[end-1]) {
+		end--
+	}
+	return rs[:end]
+}
@@ -0,0 +1,101 @@
+package docparser
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/lelandbatey/omegadoc/domain"
+)
+
+// includeDirective records an "include directive" found while parsing a file.
+// The OmegaDoc for it can only be made once the whole file has been read.
+type includeDirective struct {
+	SourceFilePath string
+	DestFilePath   string
+	Attrs          []oatt
+	// LineNumber is the line of the include directive, and LastLineNumber
+	// the last line of its header (which differ if the header is continued
+	// across lines). These lines are left out of the contents of the
+	// OmegaDoc.
+	LineNumber     int
+	LastLineNumber int
+	// Column is the column at which the include directive begins.
+	Column int
+	// HeaderStartOffset and HeaderEndOffset are the byte offsets of the
+	// include directive.
+	HeaderStartOffset int64
+	HeaderEndOffset   int64
+}
+
+// MakeOmegaDoc creates the OmegaDoc for the include directive from the
+// contents of the whole file. The OmegaDoc starts at the first line of the
+// file, so that links back to the source point at the top of the file, and
+// its body is the whole file. The whole file is expected to have already been
+// transcoded to UTF-8, with its byte order mark of length bomlen removed.
+func (inc includeDirective) MakeOmegaDoc(whole []byte, bomlen int64, endings LineEndings, magic magicSet) domain.OmegaDoc {
+	attrs := []domain.OmegaAttribute{}
+	for _, att := range inc.Attrs {
+		attrs = append(attrs, domain.OmegaAttribute(att))
+	}
+	lines := bytes.SplitAfter(whole, []byte("\n"))
+	contents := []byte{}
+	for idx, line := range lines {
+		if idx >= inc.LineNumber && idx <= inc.LastLineNumber {
+			continue
+		}
+		if endings == LineEndingsNormalize && bytes.HasSuffix(line, []byte("\r\n")) {
+			line = append(line[:len(line)-2:len(line)-2], '\n')
+		}
+		contents = append(contents, string(magic.unescape([]rune(string(line))))...)
+	}
+	lastline := len(lines) - 1
+	if lastline > 0 && len(lines[lastline]) == 0 {
+		// The file ended with a newline, so the last line is the one before
+		lastline--
+	}
+	return domain.OmegaDoc{
+		SourceFilePath:  inc.SourceFilePath,
+		DestFilePath:    inc.DestFilePath,
+		Contents:        string(contents),
+		Attributes:      attrs,
+		StartLineNumber: 0,
+		StartColumn:     inc.Column,
+		EndLineNumber:   lastline,
+
+		HeaderStartOffset: inc.HeaderStartOffset,
+		HeaderEndOffset:   inc.HeaderEndOffset,
+		BodyStartOffset:   bomlen,
+		BodyEndOffset:     bomlen + int64(len(whole)),
+		DelimiterOffset:   -1,
+	}
+}
+
+// commentClosers maps the openers of block comments to their closers.
+var commentClosers = map[string]string{
+	"<!--": "-->",
+	"/*":   "*/",
+	"{-":   "-}",
+	"(*":   "*)",
+}
+
+// trimCommentCloser removes the closer of a block comment from the end of the
+// remainder of the line of a directive or opening statement, if the text
+// preceding the magic string on that line opened the same kind of block
+// comment. This allows directives and opening statements to be written
+// within a single-line block comment, such as the following
+// (escaped here, so that this file isn't itself included anywhere):
+//
+//	<!-- \#!/usr/bin/env omegadoc include-this-file docs/readme.md -->
+func trimCommentCloser(line []rune, lineprefix []rune) []rune {
+	prefix := string(lineprefix)
+	for opener, closer := range commentClosers {
+		if !strings.Contains(prefix, opener) {
+			continue
+		}
+		trimmed := strings.TrimRight(string(line), " \t\r\n")
+		if strings.HasSuffix(trimmed, closer) {
+			return []rune(strings.TrimRight(strings.TrimSuffix(trimmed, closer), " \t"))
+		}
+	}
+	return line
+}
@@ -0,0 +1,351 @@
+package docparser
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// lineComment is the leader of a comment which runs to the end of the line.
+type lineComment struct {
+	Leader string
+	// Spaced is true when the leader only begins a comment at the start of a
+	// line or after whitespace, as with "#" in shell and YAML.
+	Spaced bool
+}
+
+// blockComment is a comment which runs from Open to Close, possibly across
+// several lines.
+type blockComment struct {
+	Open  string
+	Close string
+	// Leader is the text conventionally written at the start of each line
+	// within the comment, if there is one, such as the "*" of C-style
+	// comments.
+	Leader string
+}
+
+// stringLiteral is a kind of string literal, within which comment markup
+// doesn't begin a comment.
+type stringLiteral struct {
+	Open  string
+	Close string
+	// Escape is true when a backslash escapes the next character.
+	Escape bool
+	// Multiline is true when the literal may continue across lines; otherwise
+	// the literal ends at the end of its line even if it isn't closed.
+	Multiline bool
+}
+
+// commentSyntax describes the comments and string literals of a language.
+type commentSyntax struct {
+	Name    string
+	Line    []lineComment
+	Block   []blockComment
+	Strings []stringLiteral
+}
+
+var (
+	cStyleBlock   = blockComment{Open: "/*", Close: "*/", Leader: "*"}
+	doubleQuoted  = stringLiteral{Open: `"`, Close: `"`, Escape: true}
+	singleQuoted  = stringLiteral{Open: `'`, Close: `'`, Escape: true}
+	backtickMulti = stringLiteral{Open: "`", Close: "`", Multiline: true}
+
+	goSyntax = commentSyntax{
+		Name:    "Go",
+		Line:    []lineComment{{Leader: "//"}},
+		Block:   []blockComment{cStyleBlock},
+		Strings: []stringLiteral{doubleQuoted, singleQuoted, backtickMulti},
+	}
+	cSyntax = commentSyntax{
+		Name:    "C-family",
+		Line:    []lineComment{{Leader: "//"}},
+		Block:   []blockComment{cStyleBlock},
+		Strings: []stringLiteral{doubleQuoted, singleQuoted},
+	}
+	jsSyntax = commentSyntax{
+		Name:  "JavaScript",
+		Line:  []lineComment{{Leader: "//"}},
+		Block: []blockComment{cStyleBlock},
+		Strings: []stringLiteral{doubleQuoted, singleQuoted,
+			{Open: "`", Close: "`", Escape: true, Multiline: true}},
+	}
+	pythonSyntax = commentSyntax{
+		Name: "Python",
+		Line: []lineComment{{Leader: "#"}},
+		// Triple quotes come first so that they're matched before the
+		// single quotes they begin with.
+		Strings: []stringLiteral{
+			{Open: `"""`, Close: `"""`, Escape: true, Multiline: true},
+			{Open: `'''`, Close: `'''`, Escape: true, Multiline: true},
+			doubleQuoted, singleQuoted},
+	}
+	shellSyntax = commentSyntax{
+		Name: "shell",
+		Line: []lineComment{{Leader: "#", Spaced: true}},
+		Strings: []stringLiteral{
+			{Open: `"`, Close: `"`, Escape: true, Multiline: true},
+			{Open: `'`, Close: `'`, Multiline: true}},
+	}
+	sqlSyntax = commentSyntax{
+		Name:  "SQL",
+		Line:  []lineComment{{Leader: "--"}},
+		Block: []blockComment{cStyleBlock},
+		// Quotes within SQL strings are escaped by doubling them, which
+		// works out the same as closing and reopening the string.
+		Strings: []stringLiteral{{Open: `'`, Close: `'`, Multiline: true}, {Open: `"`, Close: `"`}},
+	}
+	yamlSyntax = commentSyntax{
+		Name:    "YAML",
+		Line:    []lineComment{{Leader: "#", Spaced: true}},
+		Strings: []stringLiteral{doubleQuoted, {Open: `'`, Close: `'`}},
+	}
+	htmlSyntax = commentSyntax{
+		Name:  "HTML",
+		Block: []blockComment{{Open: "<!--", Close: "-->"}},
+	}
+)
+
+// commentSyntaxes maps lowercase file extensions to the comment syntax of the
+// language of files with that extension.
+var commentSyntaxes = map[string]*commentSyntax{
+	".go":    &goSyntax,
+	".c":     &cSyntax,
+	".h":     &cSyntax,
+	".cc":    &cSyntax,
+	".cpp":   &cSyntax,
+	".cxx":   &cSyntax,
+	".hpp":   &cSyntax,
+	".cs":    &cSyntax,
+	".java":  &cSyntax,
+	".kt":    &cSyntax,
+	".rs":    &cSyntax,
+	".swift": &cSyntax,
+	".proto": &cSyntax,
+	".js":    &jsSyntax,
+	".jsx":   &jsSyntax,
+	".ts":    &jsSyntax,
+	".tsx":   &jsSyntax,
+	".py":    &pythonSyntax,
+	".sh":    &shellSyntax,
+	".bash":  &shellSyntax,
+	".zsh":   &shellSyntax,
+	".sql":   &sqlSyntax,
+	".yaml":  &yamlSyntax,
+	".yml":   &yamlSyntax,
+	".html":  &htmlSyntax,
+	".htm":   &htmlSyntax,
+	".xml":   &htmlSyntax,
+}
+
+// commentSyntaxNames maps the lowercase names of files which have no
+// extension to the comment syntax of their language.
+var commentSyntaxNames = map[string]*commentSyntax{
+	"makefile":   &shellSyntax,
+	"dockerfile": &shellSyntax,
+}
+
+// commentSyntaxFor returns the comment syntax of the language of the file at
+// path, or nil if the language isn't known.
+func commentSyntaxFor(path string) *commentSyntax {
+	base := strings.ToLower(filepath.Base(path))
+	if cs, ok := commentSyntaxNames[base]; ok {
+		return cs
+	}
+	return commentSyntaxes[filepath.Ext(base)]
+}
+
+// commentLexer tracks whether text is within a comment as the lines of a file
+// are fed to it. It only understands comments and string literals, which is
+// all that's needed to tell whether a magic string is within a comment.
+type commentLexer struct {
+	Syntax *commentSyntax
+	// line is true within a line comment.
+	line bool
+	// block and str are the indexes within Syntax of the block comment or
+	// string literal the lexer is within, or -1.
+	block int
+	str   int
+	// escaped is true when the previous character was an escaping backslash
+	// within a string literal.
+	escaped bool
+	// start is the index within the current line at which the current
+	// comment began, or -1 if it began on an earlier line.
+	start int
+	// lineno is the line being lexed, and pos the index within that line up
+	// to which it has been lexed.
+	lineno int
+	pos    int
+}
+
+func newCommentLexer(cs *commentSyntax) *commentLexer {
+	return &commentLexer{Syntax: cs, block: -1, str: -1, start: -1}
+}
+
+// seek tells the lexer that the scanner is at byte pos of line lineno. Any
+// text which was skipped over without being lexed, such as the contents of an
+// OmegaDoc, is assumed not to have changed whether the lexer is within a
+// block comment or multi-line string literal. Moving to a new line ends line
+// comments and any string literals which can't span lines.
+func (lx *commentLexer) seek(lineno, pos int) {
+	if lineno != lx.lineno {
+		lx.newline()
+		lx.lineno = lineno
+	}
+	if pos > lx.pos {
+		lx.pos = pos
+	}
+}
+
+func (lx *commentLexer) newline() {
+	lx.pos = 0
+	lx.line = false
+	lx.escaped = false
+	lx.start = -1
+	if lx.str >= 0 && !lx.Syntax.Strings[lx.str].Multiline {
+		lx.str = -1
+	}
+}
+
+// lineLeaderAt returns the line comment which begins at line[i], if any.
+func (lx *commentLexer) lineLeaderAt(line []byte, i int) *lineComment {
+	for k := range lx.Syntax.Line {
+		lc := &lx.Syntax.Line[k]
+		if !bytes.HasPrefix(line[i:], []byte(lc.Leader)) {
+			continue
+		}
+		if lc.Spaced && i > 0 && line[i-1] != ' ' && line[i-1] != '\t' {
+			continue
+		}
+		return lc
+	}
+	return nil
+}
+
+// advance feeds the lexer the current line up to line[to], from wherever it
+// last left off. line is the whole of the current line so far.
+func (lx *commentLexer) advance(line []byte, to int) {
+	i := lx.pos
+	defer func() {
+		if i > lx.pos {
+			lx.pos = i
+		}
+	}()
+	for i < to {
+		switch {
+		case lx.line:
+			i = to
+		case lx.block >= 0:
+			closer := []byte(lx.Syntax.Block[lx.block].Close)
+			if bytes.HasPrefix(line[i:], closer) {
+				lx.block = -1
+				lx.start = -1
+				i += len(closer)
+			} else {
+				i++
+			}
+		case lx.str >= 0:
+			sl := lx.Syntax.Strings[lx.str]
+			if lx.escaped {
+				lx.escaped = false
+				i++
+			} else if sl.Escape && line[i] == '\\' {
+				lx.escaped = true
+				i++
+			} else if bytes.HasPrefix(line[i:], []byte(sl.Close)) {
+				lx.str = -1
+				i += len(sl.Close)
+			} else {
+				i++
+			}
+		default:
+			if lc := lx.lineLeaderAt(line, i); lc != nil {
+				lx.line = true
+				lx.start = i
+				i = to
+				continue
+			}
+			opened := false
+			for k, bc := range lx.Syntax.Block {
+				if bytes.HasPrefix(line[i:], []byte(bc.Open)) {
+					lx.block, lx.start, opened = k, i, true
+					i += len(bc.Open)
+					break
+				}
+			}
+			if opened {
+				continue
+			}
+			for k, sl := range lx.Syntax.Strings {
+				if bytes.HasPrefix(line[i:], []byte(sl.Open)) {
+					lx.str, opened = k, true
+					i += len(sl.Open)
+					break
+				}
+			}
+			if !opened {
+				i++
+			}
+		}
+	}
+}
+
+// leadingSpaceBytes returns the leading spaces and tabs of line.
+func leadingSpaceBytes(line []byte) []byte {
+	end := 0
+	for end < len(line) && (line[end] == ' ' || line[end] == '\t') {
+		end++
+	}
+	return line[:end]
+}
+
+// trailingSpaceEnd returns the index just past the spaces and tabs which
+// begin at line[i].
+func trailingSpaceEnd(line []byte, i int) int {
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// magicComment checks whether a magic string beginning at line[idx] is
+// within a comment, after the lexer has been advanced up to idx. If it is, the
+// comment markup to remove from each line of an OmegaDoc opened there is
+// returned as well.
+func (lx *commentLexer) magicComment(line []byte, idx int) (bool, []rune) {
+	// The lines following the magic string are expected to be indented like
+	// the line of the magic string, even when the comment follows code.
+	indent := string(leadingSpaceBytes(line[:idx]))
+	switch {
+	case lx.line:
+		// The comment markup is the leader and the whitespace after it.
+		lc := lx.lineLeaderAt(line, lx.start)
+		end := trailingSpaceEnd(line, lx.start+len(lc.Leader))
+		if end > idx {
+			end = idx
+		}
+		return true, []rune(indent + string(line[lx.start:end]))
+	case lx.block >= 0 && lx.start >= 0:
+		// The block comment was opened on this line, so the following lines
+		// are marked only by the conventional leader of the comment, if any.
+		bc := lx.Syntax.Block[lx.block]
+		if bc.Leader == "" {
+			return true, nil
+		}
+		return true, []rune(indent + " " + bc.Leader + " ")
+	case lx.block >= 0:
+		// Within a block comment opened on an earlier line, whatever
+		// precedes the magic string on its line is the markup.
+		return true, []rune(string(line[:idx]))
+	case lx.str < 0:
+		// The magic string may itself begin a line comment, as
+		// "#!/usr/bin/env" does for languages where "#" begins a comment.
+		// Subsequent lines are then expected to begin with the same leader.
+		if lc := lx.lineLeaderAt(line, idx); lc != nil {
+			lx.line = true
+			lx.start = idx
+			return true, []rune(indent + lc.Leader + " ")
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,105 @@
+package docparser
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLanguageAware(t *testing.T) {
+	open := domain.START_OMEGADOC
+	ignore := domain.IGNORE_OMEGADOC
+	type tst struct {
+		Path     string
+		Def      string
+		Exps     []domain.OmegaDoc
+		Contents []string
+	}
+	for tidx, test := range []tst{
+		// Go
+		{Path: "a.go", Def: "s := \"" + open + "EOD r/a.md\\nhi\\nEOD\"\n// " + open + "EOD r/b.md\n// hello\n// EOD\n",
+			Contents: []string{"hello\n"}},
+		{Path: "a.go", Def: "s := `\n" + open + "EOD r/a.md\nhi\nEOD\n`\n",
+			Contents: []string{}},
+		{Path: "a.go", Def: "x := 1 // " + open + "EOD r/a.md\n// hello\n// EOD\n",
+			Contents: []string{"hello\n"}},
+		{Path: "a.go", Def: "/* " + open + "EOD r/a.md\n * hello\n *   world\n EOD\n*/\n",
+			Contents: []string{"hello\n  world\n"}},
+		{Path: "a.go", Def: "/*\n" + open + "EOD r/a.md\nhello\nEOD\n*/\ns := \"" + open + "EOD r/b.md\"\n",
+			Contents: []string{"hello\n"}},
+		{Path: "a.go", Def: "/*\n * " + open + "EOD r/a.md\n * hello\n * EOD\n */\n",
+			Contents: []string{"hello\n"}},
+		// An ignore directive within a string literal is ignored as well.
+		{Path: "a_test.go", Def: "s := \"" + ignore + "\"\n\t// " + open + "EOD r/a.md\n\t// hello\n\t// EOD\n",
+			Contents: []string{"hello\n"}},
+		// Python
+		{Path: "a.py", Def: open + "EOD r/a.md\n# hello\n#   world\n# EOD\n",
+			Contents: []string{"hello\n  world\n"}},
+		{Path: "a.py", Def: "def f():\n    \"\"\"\n    " + open + "EOD r/a.md\n    \"\"\"\n    x = 1  # " + open + "EOD r/b.md\n    # hello\n    # EOD\n",
+			Contents: []string{"hello\n"}},
+		// Shell only begins a comment at a "#" which follows whitespace.
+		{Path: "run.sh", Def: "echo a" + open + "EOD r/a.md\nhi\nEOD\n  " + open + "EOD r/b.md\n  # hello\n  # EOD\n",
+			Contents: []string{"hello\n"}},
+		{Path: "Makefile", Def: "# " + open + "EOD r/a.md\n# hello\n# EOD\n",
+			Contents: []string{"hello\n"}},
+		// SQL
+		{Path: "m.sql", Def: "SELECT '" + open + "EOD r/a.md';\n-- " + open + "EOD r/b.md\n-- hello\n-- EOD\n",
+			Contents: []string{"hello\n"}},
+		// YAML
+		{Path: "c.yaml", Def: "key: \"" + open + "EOD r/a.md\"\n# " + open + "EOD r/b.md\n# hello\n# EOD\n",
+			Contents: []string{"hello\n"}},
+		// HTML
+		{Path: "i.html", Def: "<p>" + open + "EOD r/a.md</p>\n<!--\n" + open + "EOD r/b.md\nhello\nEOD\n-->\n",
+			Contents: []string{"hello\n"}},
+		{Path: "i.html", Def: "<!-- " + open + "EOD r/a.md\nhello\nEOD\n-->\n",
+			Contents: []string{"hello\n"}},
+		// Files of unknown languages are parsed as usual.
+		{Path: "a.md", Def: "s := \"" + open + "EOD r/a.md\nhi\nEOD\n",
+			Contents: []string{"hi\n"}},
+	} {
+		odocs, diags, err := NewDocParser(WithLanguageAware(true)).ParseDoc(test.Path, strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Empty(t, diags, "test #%d", tidx)
+		contents := []string{}
+		for _, od := range odocs {
+			contents = append(contents, od.Contents)
+		}
+		require.Equal(t, test.Contents, contents, "test #%d", tidx)
+	}
+}
+
+// TestParseLanguageAwareCommentCloser checks that the closer of a block
+// comment opened before the magic string isn't part of the output path.
+func TestParseLanguageAwareCommentCloser(t *testing.T) {
+	open := domain.START_OMEGADOC
+	type tst struct {
+		Path string
+		Def  string
+	}
+	for tidx, test := range []tst{
+		{Path: "i.html", Def: "<!-- " + open + "EOD r/a.md -->\nhello\nEOD\n"},
+		{Path: "i.html", Def: "<!-- " + open + "EOD r/a.md\t-->  \nhello\nEOD\n"},
+		{Path: "a.c", Def: "/* " + open + "EOD r/a.md */\nhello\nEOD\n"},
+		{Path: "a.c", Def: "/* " + open + "EOD r/a.md*/\nhello\nEOD\n"},
+	} {
+		odocs, diags, err := NewDocParser(WithLanguageAware(true)).ParseDoc(test.Path, strings.NewReader(test.Def))
+		require.NoError(t, err, "test #%d", tidx)
+		require.Empty(t, diags, "test #%d", tidx)
+		require.Len(t, odocs, 1, "test #%d", tidx)
+		require.Equal(t, "r/a.md", odocs[0].DestFilePath, "test #%d", tidx)
+		require.Equal(t, "hello\n", odocs[0].Contents, "test #%d", tidx)
+	}
+}
+
+func TestParseLanguageAwareDisabled(t *testing.T) {
+	// Without language awareness, magic strings in string literals count.
+	def := "s := \"" + domain.START_OMEGADOC + "EOD r/a.md\"\nhi\nEOD\n"
+	odocs, _, err := NewDocParser().ParseDoc("a.go", strings.NewReader(def))
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	odocs, _, err = NewDocParser(WithLanguageAware(true)).ParseDoc("a.go", strings.NewReader(def))
+	require.NoError(t, err)
+	require.Len(t, odocs, 0)
+}
@@ -0,0 +1,98 @@
+package docparser
+
+import (
+	"strings"
+	"unicode"
+)
+
+// PREFIX_ATTR is the attribute which explicitly sets the line prefix to be
+// removed from each line of the contents of an OmegaDoc. Setting it to the
+// value of PREFIX_NONE disables line prefix removal entirely.
+const PREFIX_ATTR string = "prefix"
+const PREFIX_NONE string = "none"
+
+// LinePrefix returns the prefix which should be removed from the start of each
+// line of the contents of this OmegaDoc. A "prefix" attribute takes precedence;
+// otherwise the text preceding the magic string on the line of the opening
+// statement is used, so long as that text looks like the start of a comment
+// (e.g. "// ", "# ", "-- ", or " * ").
+func (po *parseOdoc) LinePrefix(openingprefix []rune) []rune {
+	for _, att := range po.Attrs {
+		if strings.ToLower(att.Key) != PREFIX_ATTR {
+			continue
+		}
+		if att.Value == PREFIX_NONE {
+			return nil
+		}
+		return []rune(att.Value)
+	}
+	if isCommentPrefix(openingprefix) {
+		return openingprefix
+	}
+	return nil
+}
+
+// isCommentPrefix reports whether the runes preceding an opening statement on
+// its line look like the leader of a comment. Only whitespace and punctuation
+// are allowed; letters, digits, and quotes mean the opening statement is
+// probably within code (such as a string literal) instead of a comment.
+func isCommentPrefix(prefix []rune) bool {
+	for _, r := range prefix {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+		if strings.ContainsRune("\"'`", r) {
+			return false
+		}
+		if !unicode.IsSpace(r) && !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// stripLinePrefix removes prefix from the start of line. The whitespace
+// surrounding the non-whitespace "core" of the prefix is matched leniently:
+// as much of it as is present on the line is removed, so that a line like
+// "//\n" still has its comment leader removed with a prefix of "// ". Lines
+// which don't contain the core of the prefix are returned unchanged.
+func stripLinePrefix(line, prefix []rune) []rune {
+	if len(prefix) == 0 {
+		return line
+	}
+	lead, core, trail := splitPrefix(prefix)
+	pos := 0
+	for _, r := range lead {
+		if pos < len(line) && line[pos] == r {
+			pos++
+		} else {
+			break
+		}
+	}
+	if len(line[pos:]) < len(core) || !runesEqual(line[pos:pos+len(core)], core) {
+		return line
+	}
+	pos += len(core)
+	for _, r := range trail {
+		if pos < len(line) && line[pos] == r {
+			pos++
+		} else {
+			break
+		}
+	}
+	return line[pos:]
+}
+
+// splitPrefix splits a prefix into its leading whitespace, its
+// non-whitespace core, and its trailing whitespace.
+func splitPrefix(prefix []rune) (lead, core, trail []rune) {
+	start := 0
+	for start < len(prefix) && unicode.IsSpace(prefix[start]) {
+		start++
+	}
+	end := len(prefix)
+	for end > start && unicode.IsSpace(prefix[end-1]) {
+		end--
+	}
+	return prefix[:start], prefix[start:end], prefix[end:]
+}
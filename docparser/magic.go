@@ -0,0 +1,135 @@
+package docparser
+
+import (
+	"bytes"
+
+	"github.com/lelandbatey/omegadoc/domain"
+)
+
+// magicSyntax is a domain.MagicSyntax prepared for matching against the text
+// of a source file.
+type magicSyntax struct {
+	Prefix      []byte
+	PrefixRunes []rune
+	Begin       []rune
+	Ignore      []rune
+	Include     []rune
+	IgnoreNext  []rune
+	IgnoreStart []rune
+	IgnoreEnd   []rune
+	// Spaced is true when the delimiting identifier follows Begin after
+	// whitespace instead of immediately.
+	Spaced bool
+}
+
+func newMagicSyntax(ms domain.MagicSyntax) magicSyntax {
+	return magicSyntax{
+		Prefix:      []byte(ms.Prefix),
+		PrefixRunes: []rune(ms.Prefix),
+		Begin:       []rune(ms.Start),
+		Ignore:      []rune(ms.Ignore),
+		Include:     []rune(ms.Include),
+		IgnoreNext:  []rune(ms.IgnoreNext),
+		IgnoreStart: []rune(ms.IgnoreStart),
+		IgnoreEnd:   []rune(ms.IgnoreEnd),
+		Spaced:      ms.SpacedDelimiter(),
+	}
+}
+
+// isOpening reports whether the rune group following the prefix of this
+// syntax begins an opening statement.
+func (syn *magicSyntax) isOpening(rg []rune) bool {
+	if syn.Spaced {
+		return runesEqual(rg, syn.Begin)
+	}
+	return len(rg) >= len(syn.Begin) && runesEqual(rg[:len(syn.Begin)], syn.Begin)
+}
+
+// readSpacedDelimiter reads the delimiting identifier of an opening statement
+// of a syntax where it's separated from the magic string by whitespace. If
+// the line ends before a delimiting identifier, nothing is read and an empty
+// delimiting identifier is returned.
+func readSpacedDelimiter(ods *odScanner) ([]rune, error) {
+	rg, err := ods.ReadRuneGroup()
+	if err != nil {
+		return nil, err
+	}
+	if rg[0] == '\n' {
+		ods.Unread(rg)
+		return nil, nil
+	}
+	ws := rg
+	if rg, err = ods.ReadRuneGroup(); err != nil && len(rg) == 0 {
+		return nil, err
+	}
+	if rg[0] == '\n' {
+		ods.Unread(append(ws, rg...))
+		return nil, nil
+	}
+	return rg, err
+}
+
+// magicSet is every magic syntax recognized by a DocParser.
+type magicSet []magicSyntax
+
+func newMagicSet(syntaxes []domain.MagicSyntax) magicSet {
+	ms := magicSet{}
+	for _, syn := range syntaxes {
+		ms = append(ms, newMagicSyntax(syn))
+	}
+	return ms
+}
+
+// index returns the position of the first unescaped prefix of any syntax in
+// line at or after from, and the index within the magicSet of that syntax. If
+// the prefixes of several syntaxes begin at the same position, the longest
+// wins. If no prefix is found, index returns -1 for both.
+func (ms magicSet) index(line []byte, from int) (int, int) {
+	for {
+		best, which := -1, -1
+		for i, syn := range ms {
+			idx := bytes.Index(line[from:], syn.Prefix)
+			if idx == -1 {
+				continue
+			}
+			idx += from
+			if best == -1 || idx < best || (idx == best && len(syn.Prefix) > len(ms[which].Prefix)) {
+				best, which = idx, i
+			}
+		}
+		if best == -1 {
+			return -1, -1
+		}
+		if best > 0 && rune(line[best-1]) == MAGIC_ESCAPE {
+			from = best + 1
+			continue
+		}
+		return best, which
+	}
+}
+
+// unescape removes the escaping backslash from each escaped occurrence of
+// the prefix of any syntax in line.
+func (ms magicSet) unescape(line []rune) []rune {
+	out := []rune{}
+	start := 0
+	found := false
+	for i := 0; i < len(line); i++ {
+		if line[i] != MAGIC_ESCAPE {
+			continue
+		}
+		for _, syn := range ms {
+			if i+1+len(syn.PrefixRunes) <= len(line) && runesEqual(line[i+1:i+1+len(syn.PrefixRunes)], syn.PrefixRunes) {
+				out = append(out, line[start:i]...)
+				start = i + 1
+				found = true
+				i += len(syn.PrefixRunes)
+				break
+			}
+		}
+	}
+	if !found {
+		return line
+	}
+	return append(out, line[start:]...)
+}
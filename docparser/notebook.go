@@ -0,0 +1,156 @@
+package docparser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lelandbatey/omegadoc/domain"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notebook is the part of a Jupyter notebook (nbformat 4) which is needed to
+// find the OmegaDocs within it.
+type notebook struct {
+	NBFormat int `json:"nbformat"`
+	Metadata struct {
+		LanguageInfo struct {
+			Name          string `json:"name"`
+			FileExtension string `json:"file_extension"`
+		} `json:"language_info"`
+		KernelSpec struct {
+			Language string `json:"language"`
+		} `json:"kernelspec"`
+	} `json:"metadata"`
+	Cells []notebookCell `json:"cells"`
+}
+
+type notebookCell struct {
+	CellType string     `json:"cell_type"`
+	Source   cellSource `json:"source"`
+}
+
+// cellSource is the source of a notebook cell. nbformat allows the source to
+// be either a single string or a list of strings (usually one per line) which
+// are joined together.
+type cellSource string
+
+func (cs *cellSource) UnmarshalJSON(b []byte) error {
+	var lines []string
+	if err := json.Unmarshal(b, &lines); err == nil {
+		*cs = cellSource(strings.Join(lines, ""))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*cs = cellSource(s)
+	return nil
+}
+
+// kernelLanguages maps the lowercase names of the languages of notebook
+// kernels to an extension of files in that language.
+var kernelLanguages = map[string]string{
+	"python":     ".py",
+	"python3":    ".py",
+	"javascript": ".js",
+	"typescript": ".ts",
+	"go":         ".go",
+	"bash":       ".sh",
+	"sql":        ".sql",
+	"c":          ".c",
+	"c++":        ".cpp",
+	"java":       ".java",
+	"rust":       ".rs",
+}
+
+// language returns the comment syntax of the code cells of the notebook, or
+// nil if the language isn't known.
+func (nb *notebook) language() *commentSyntax {
+	info := nb.Metadata.LanguageInfo
+	if info.FileExtension != "" {
+		if cs := commentSyntaxFor("cell" + info.FileExtension); cs != nil {
+			return cs
+		}
+	}
+	for _, name := range []string{info.Name, nb.Metadata.KernelSpec.Language} {
+		if ext, ok := kernelLanguages[strings.ToLower(name)]; ok {
+			return commentSyntaxFor("cell" + ext)
+		}
+	}
+	return nil
+}
+
+// notebookParser finds the OmegaDocs within the markdown and code cells of a
+// Jupyter notebook. The source of each cell is parsed as if it were a file of
+// its own, so an OmegaDoc can't span several cells and directives such as
+// "ignore this file" only apply to the cell they're in.
+type notebookParser struct {
+	df docfinder
+}
+
+// NewNotebookParser returns a DocParser for Jupyter notebooks (.ipynb files)
+// accepting the same options as NewDocParser. The OmegaDocs and Diagnostics
+// it returns have their Cell set, and their line numbers, columns and offsets
+// are relative to the source of that cell. When language-aware parsing is
+// enabled, magic strings in code cells are only recognized within comments of
+// the language of the notebook's kernel.
+func NewNotebookParser(opts ...Option) domain.DocParser {
+	return notebookParser{df: newDocfinder(opts...)}
+}
+
+func (np notebookParser) ParseDoc(srcpath string, data io.Reader) ([]domain.OmegaDoc, []domain.Diagnostic, error) {
+	return collectDocs(np.ParseDocStream, srcpath, data)
+}
+
+func (np notebookParser) ParseDocStream(srcpath string, data io.Reader, emit func(domain.OmegaDoc) error) ([]domain.Diagnostic, error) {
+	l := log.WithField("srcpath", srcpath)
+	diags := []domain.Diagnostic{}
+	rev := domain.ReaderRevision(data)
+	// Notebooks are meant to be UTF-8, but any byte order mark or UTF-16 is
+	// handled just as it is for other files.
+	text, _, _, err := decodeText(data)
+	if err != nil {
+		return diags, &RequiredParseError{inner: err}
+	}
+	nb := notebook{}
+	if err := json.NewDecoder(text).Decode(&nb); err != nil {
+		return diags, &RequiredParseError{inner: fmt.Errorf("cannot decode notebook: %w", err)}
+	}
+	if nb.NBFormat < 4 {
+		return diags, &RequiredParseError{inner: fmt.Errorf("notebook format version %d is not supported; only version 4 and later are", nb.NBFormat)}
+	}
+	code := np.df
+	code.language = nb.language()
+	for idx, cell := range nb.Cells {
+		var df docfinder
+		switch cell.CellType {
+		case "markdown":
+			df = np.df
+		case "code":
+			df = code
+		default:
+			continue
+		}
+		nc := &domain.NotebookCell{Index: idx, Type: cell.CellType}
+		celldiags, err := df.parseDoc(srcpath, strings.NewReader(string(cell.Source)), func(od domain.OmegaDoc) error {
+			od.Cell = nc
+			od.Revision = rev
+			// Line anchors would point into the JSON of the notebook rather
+			// than the cell, so the URL is of the whole notebook.
+			np.df.setURL(l, &od, -1, -1)
+			return emit(od)
+		})
+		for _, d := range celldiags {
+			d.Cell = nc
+			diags = append(diags, d)
+		}
+		if err != nil {
+			return diags, err
+		}
+	}
+	return diags, nil
+}
@@ -0,0 +1,115 @@
+package docparser
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+// makeNotebook returns the JSON of a notebook with the given cells, each of
+// which is a cell type followed by the source of the cell. Markdown cells
+// have their source split into a list of lines, as Jupyter writes them.
+func makeNotebook(t *testing.T, language string, cells ...[2]string) string {
+	nbcells := []map[string]interface{}{}
+	for _, c := range cells {
+		var src interface{} = c[1]
+		if c[0] == "markdown" {
+			lines := strings.SplitAfter(c[1], "\n")
+			if lines[len(lines)-1] == "" {
+				lines = lines[:len(lines)-1]
+			}
+			src = lines
+		}
+		nbcells = append(nbcells, map[string]interface{}{
+			"cell_type": c[0],
+			"metadata":  map[string]interface{}{},
+			"source":    src,
+		})
+	}
+	nb := map[string]interface{}{
+		"nbformat":       4,
+		"nbformat_minor": 5,
+		"metadata": map[string]interface{}{
+			"kernelspec": map[string]interface{}{"language": language},
+		},
+		"cells": nbcells,
+	}
+	b, err := json.MarshalIndent(nb, "", " ")
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestParseNotebook(t *testing.T) {
+	open := domain.START_OMEGADOC
+	nb := makeNotebook(t, "python",
+		[2]string{"markdown", "# Title\n\n" + open + "EOD docs/a.md\nhello\nworld\nEOD\n"},
+		[2]string{"raw", open + "EOD docs/raw.md\nraw\nEOD\n"},
+		[2]string{"code", "x = 1\n# " + open + "EOD docs/b.md\n# code docs\n# EOD"},
+	)
+	odocs, diags, err := NewNotebookParser().ParseDoc("/nonexistent/nb.ipynb", strings.NewReader(nb))
+	require.NoError(t, err)
+	require.Empty(t, diags)
+	require.Len(t, odocs, 2)
+
+	require.Equal(t, "docs/a.md", odocs[0].DestFilePath)
+	require.Equal(t, "hello\nworld\n", odocs[0].Contents)
+	require.Equal(t, &domain.NotebookCell{Index: 0, Type: "markdown"}, odocs[0].Cell)
+	require.Equal(t, 2, odocs[0].StartLineNumber)
+	require.Equal(t, 5, odocs[0].EndLineNumber)
+	require.Equal(t, int64(len("# Title\n\n")), odocs[0].HeaderStartOffset)
+
+	require.Equal(t, "docs/b.md", odocs[1].DestFilePath)
+	require.Equal(t, "code docs\n", odocs[1].Contents)
+	require.Equal(t, &domain.NotebookCell{Index: 2, Type: "code"}, odocs[1].Cell)
+	require.Equal(t, 1, odocs[1].StartLineNumber)
+	require.Equal(t, 2, odocs[1].StartColumn)
+}
+
+func TestParseNotebookDocsDontSpanCells(t *testing.T) {
+	open := domain.START_OMEGADOC
+	nb := makeNotebook(t, "python",
+		[2]string{"markdown", "intro\n" + open + "EOD docs/a.md\nhello\n"},
+		[2]string{"markdown", "EOD\n"},
+	)
+	odocs, diags, err := NewNotebookParser().ParseDoc("/nonexistent/nb.ipynb", strings.NewReader(nb))
+	require.NoError(t, err)
+	require.Len(t, odocs, 1)
+	require.Equal(t, "hello\n", odocs[0].Contents)
+	require.Len(t, diags, 1)
+	require.Equal(t, domain.DiagEOFBeforeDelimiter, diags[0].Code)
+	require.Equal(t, &domain.NotebookCell{Index: 0, Type: "markdown"}, diags[0].Cell)
+	require.Equal(t, 2, diags[0].Line)
+	require.True(t, strings.HasPrefix(diags[0].String(), "/nonexistent/nb.ipynb:cells[0]:2:1: "), diags[0].String())
+}
+
+func TestParseNotebookLanguageAware(t *testing.T) {
+	open := domain.START_OMEGADOC
+	nb := makeNotebook(t, "python",
+		[2]string{"code", "s = \"" + open + "EOD docs/a.md\"\n# " + open + "EOD docs/b.md\n# hello\n# EOD\n"},
+		// Markdown cells have no comments, so any magic string counts.
+		[2]string{"markdown", open + "EOD docs/c.md\nworld\nEOD\n"},
+	)
+	odocs, diags, err := NewNotebookParser(WithLanguageAware(true)).ParseDoc("/nonexistent/nb.ipynb", strings.NewReader(nb))
+	require.NoError(t, err)
+	require.Empty(t, diags)
+	dests := []string{}
+	for _, od := range odocs {
+		dests = append(dests, od.DestFilePath)
+	}
+	require.Equal(t, []string{"docs/b.md", "docs/c.md"}, dests)
+}
+
+func TestParseNotebookInvalid(t *testing.T) {
+	for _, nb := range []string{
+		`{"cells": [`,
+		`{"nbformat": 3, "worksheets": []}`,
+		`{"nbformat": 4, "cells": [{"cell_type": "code", "source": 12}]}`,
+	} {
+		_, _, err := NewNotebookParser().ParseDoc("/nonexistent/nb.ipynb", strings.NewReader(nb))
+		var rperr *RequiredParseError
+		require.ErrorAs(t, err, &rperr, "notebook %q", nb)
+	}
+}
@@ -0,0 +1,219 @@
+package docparser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/lelandbatey/omegadoc/domain"
+)
+
+// Sniffer reports whether a file should be parsed by a particular DocParser,
+// given up to the first 512 bytes of the file.
+type Sniffer func(head []byte) bool
+
+type sniffer struct {
+	sniff  Sniffer
+	parser domain.DocParser
+}
+
+// Registry is a DocParser which chooses the DocParser for each file it parses.
+// A DocParser registered for the extension of the file is chosen first. Files
+// with no registered extension are offered to each sniffer in the order they
+// were registered, and the first to accept the file chooses the DocParser.
+// All other files are parsed by the fallback DocParser.
+type Registry struct {
+	fallback   domain.DocParser
+	extensions map[string]domain.DocParser
+	sniffers   []sniffer
+}
+
+// NewRegistry returns an empty Registry which parses every file with
+// fallback.
+func NewRegistry(fallback domain.DocParser) *Registry {
+	return &Registry{
+		fallback:   fallback,
+		extensions: map[string]domain.DocParser{},
+	}
+}
+
+// NewDefaultRegistry returns a Registry with every built in DocParser
+// registered, each created with opts. Plain text is parsed by NewDocParser,
+// and Jupyter notebooks, recognized by their extension or their contents, by
+// NewNotebookParser.
+func NewDefaultRegistry(opts ...Option) *Registry {
+	reg := NewRegistry(NewDocParser(opts...))
+	notebooks := NewNotebookParser(opts...)
+	reg.RegisterExtension(".ipynb", notebooks)
+	reg.RegisterSniffer(SniffNotebook, notebooks)
+	return reg
+}
+
+// normalizeExtension lowercases ext and adds the leading "." if it's missing.
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// RegisterExtension parses files with the extension ext, such as ".ipynb",
+// with dp, replacing any DocParser already registered for ext. Extensions are
+// matched without regard to case.
+func (reg *Registry) RegisterExtension(ext string, dp domain.DocParser) {
+	reg.extensions[normalizeExtension(ext)] = dp
+}
+
+// RegisterSniffer parses files which have no registered extension and which
+// are accepted by sniff with dp.
+func (reg *Registry) RegisterSniffer(sniff Sniffer, dp domain.DocParser) {
+	reg.sniffers = append(reg.sniffers, sniffer{sniff: sniff, parser: dp})
+}
+
+// SetFallback parses files which aren't chosen by extension or sniffer with
+// dp.
+func (reg *Registry) SetFallback(dp domain.DocParser) {
+	reg.fallback = dp
+}
+
+// choose returns the DocParser for the file at srcpath, and a reader of all
+// the data of the file to give that DocParser in place of data.
+func (reg *Registry) choose(srcpath string, data io.Reader) (domain.DocParser, io.Reader, error) {
+	if dp, ok := reg.extensions[strings.ToLower(filepath.Ext(srcpath))]; ok {
+		return dp, data, nil
+	}
+	if len(reg.sniffers) == 0 {
+		return reg.fallback, data, nil
+	}
+	head, data, err := peekHead(data, sniffLen)
+	if err != nil {
+		return nil, data, err
+	}
+	for _, s := range reg.sniffers {
+		if s.sniff(head) {
+			return s.parser, data, nil
+		}
+	}
+	return reg.fallback, data, nil
+}
+
+// revisionReader gives a reader wrapping a domain.RevisionReader the same
+// revision.
+type revisionReader struct {
+	io.Reader
+	revision string
+}
+
+func (rr revisionReader) Revision() string {
+	return rr.revision
+}
+
+// peekHead returns up to the first n bytes of data, along with a reader which
+// still reads all of data. A seekable reader is returned to where it was, so
+// that it remains seekable for the DocParser. The revision of a
+// domain.RevisionReader, and the Reopen of a domain.Reopener, are kept as
+// well.
+func peekHead(data io.Reader, n int) ([]byte, io.Reader, error) {
+	if rs, ok := data.(io.ReadSeeker); ok {
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			head := make([]byte, n)
+			read, err := io.ReadFull(rs, head)
+			if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, data, err
+			}
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return nil, data, err
+			}
+			return head[:read], data, nil
+		}
+	}
+	br := bufio.NewReaderSize(data, readBufferSize)
+	var rdr io.Reader = br
+	if rev := domain.ReaderRevision(data); rev != "" {
+		rdr = revisionReader{Reader: br, revision: rev}
+	}
+	if reopen := domain.ReaderReopen(data); reopen != nil {
+		rdr = domain.NewReopener(rdr, reopen)
+	}
+	head, err := br.Peek(n)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, rdr, err
+	}
+	return head, rdr, nil
+}
+
+func (reg *Registry) ParseDoc(srcpath string, data io.Reader) ([]domain.OmegaDoc, []domain.Diagnostic, error) {
+	return collectDocs(reg.ParseDocStream, srcpath, data)
+}
+
+func (reg *Registry) ParseDocStream(srcpath string, data io.Reader, emit func(domain.OmegaDoc) error) ([]domain.Diagnostic, error) {
+	dp, data, err := reg.choose(srcpath, data)
+	if err != nil {
+		return []domain.Diagnostic{}, &RequiredParseError{inner: err}
+	}
+	return dp.ParseDocStream(srcpath, data, emit)
+}
+
+// SniffNotebook accepts files which look like Jupyter notebooks: a JSON object
+// whose first key is "cells" (as Jupyter writes them) and which contains a
+// cell_type.
+func SniffNotebook(head []byte) bool {
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if !bytes.HasPrefix(head, []byte("{")) {
+		return false
+	}
+	head = bytes.TrimLeft(head[1:], " \t\r\n")
+	return bytes.HasPrefix(head, []byte(`"cells"`)) && bytes.Contains(head, []byte(`"cell_type"`))
+}
+
+// namedParsers are the built in DocParsers which may be chosen by name, as
+// from the command line.
+var namedParsers = map[string]func(...Option) domain.DocParser{
+	"text":     NewDocParser,
+	"notebook": NewNotebookParser,
+}
+
+// ParserNames returns the names accepted by NewNamedParser, sorted.
+func ParserNames() []string {
+	names := []string{}
+	for name := range namedParsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewNamedParser returns the built in DocParser called name, created with
+// opts. The names are "text", for NewDocParser, and "notebook", for
+// NewNotebookParser.
+func NewNamedParser(name string, opts ...Option) (domain.DocParser, error) {
+	newparser, ok := namedParsers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser %q, must be one of %q", name, ParserNames())
+	}
+	return newparser(opts...), nil
+}
+
+// ParseParserMapping parses a mapping of a file extension to the name of a
+// parser, written as "EXT=NAME", such as ".nb=notebook". The name is checked
+// against ParserNames.
+func ParseParserMapping(mapping string) (string, string, error) {
+	eq := strings.Index(mapping, "=")
+	if eq < 0 {
+		return "", "", fmt.Errorf("parser mapping %q must be of the form EXT=NAME, such as \".nb=notebook\"", mapping)
+	}
+	ext, name := strings.TrimSpace(mapping[:eq]), strings.TrimSpace(mapping[eq+1:])
+	if ext == "" || ext == "." {
+		return "", "", fmt.Errorf("parser mapping %q has no file extension", mapping)
+	}
+	if _, ok := namedParsers[name]; !ok {
+		return "", "", fmt.Errorf("parser mapping %q has unknown parser %q, must be one of %q", mapping, name, ParserNames())
+	}
+	return normalizeExtension(ext), name, nil
+}
@@ -0,0 +1,97 @@
+package docparser
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lelandbatey/omegadoc/domain"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	open := domain.START_OMEGADOC
+	nb := makeNotebook(t, "python", [2]string{"markdown", open + "EOD docs/a.md\nhello\nEOD\n"})
+	text := open + "EOD docs/a.md\nhello\nEOD\n"
+	type tst struct {
+		Path string
+		Def  string
+		// Cell is true when the notebook parser is expected to be chosen.
+		Cell bool
+	}
+	for tidx, test := range []tst{
+		{Path: "/nonexistent/nb.ipynb", Def: nb, Cell: true},
+		{Path: "/nonexistent/NB.IPYNB", Def: nb, Cell: true},
+		// Notebooks are recognized by their contents as well.
+		{Path: "/nonexistent/nb.json", Def: nb, Cell: true},
+		{Path: "/nonexistent/nb", Def: "\ufeff" + nb, Cell: true},
+		{Path: "/nonexistent/a.md", Def: text},
+		{Path: "/nonexistent/a.json", Def: `{"key": "` + open + `EOD docs/a.md"}` + "\nhello\nEOD\n"},
+	} {
+		for _, rdr := range []io.Reader{strings.NewReader(test.Def), onlyReader{strings.NewReader(test.Def)}} {
+			odocs, _, err := NewDefaultRegistry().ParseDoc(test.Path, rdr)
+			require.NoError(t, err, "test #%d", tidx)
+			require.Len(t, odocs, 1, "test #%d", tidx)
+			require.Equal(t, "hello\n", odocs[0].Contents, "test #%d", tidx)
+			require.Equal(t, test.Cell, odocs[0].Cell != nil, "test #%d", tidx)
+		}
+	}
+}
+
+func TestRegistrySniffedInclude(t *testing.T) {
+	// Sniffing the head of a file mustn't lose it from what's parsed, which
+	// matters most for the include directive that emits the whole file.
+	reg := NewRegistry(NewDocParser())
+	reg.RegisterSniffer(func(head []byte) bool { return false }, NewNotebookParser())
+	def := "line one\n" + domain.INCLUDE_OMEGADOC + " docs/whole.md\n" + strings.Repeat("body\n", 200)
+	exp := "line one\n" + strings.Repeat("body\n", 200)
+	for _, rdr := range []io.Reader{strings.NewReader(def), onlyReader{strings.NewReader(def)}} {
+		odocs, _, err := reg.ParseDoc("/nonexistent/a.txt", rdr)
+		require.NoError(t, err)
+		require.Len(t, odocs, 1)
+		require.Equal(t, exp, odocs[0].Contents)
+	}
+}
+
+func TestRegistryOverride(t *testing.T) {
+	open := domain.START_OMEGADOC
+	reg := NewDefaultRegistry()
+	ext, name, err := ParseParserMapping("IPYNB=text")
+	require.NoError(t, err)
+	require.Equal(t, ".ipynb", ext)
+	dp, err := NewNamedParser(name)
+	require.NoError(t, err)
+	reg.RegisterExtension(ext, dp)
+	// Parsed as text, the JSON string of the cell is all on one line.
+	nb := makeNotebook(t, "python", [2]string{"code", open + "EOD docs/a.md\nhello\nEOD\n"})
+	odocs, _, err := reg.ParseDoc("/nonexistent/nb.ipynb", strings.NewReader(nb))
+	require.NoError(t, err)
+	for _, od := range odocs {
+		require.Nil(t, od.Cell)
+	}
+
+	for _, mapping := range []string{"ipynb", "=text", ".nb=nope"} {
+		_, _, err := ParseParserMapping(mapping)
+		require.Error(t, err, "mapping %q", mapping)
+	}
+}
+
+// revReader is a domain.RevisionReader which can't seek.
+type revReader struct {
+	onlyReader
+	rev string
+}
+
+func (rr revReader) Revision() string { return rr.rev }
+
+func TestRegistryRevision(t *testing.T) {
+	// The revision of the source must survive the registry's sniffing.
+	open := domain.START_OMEGADOC
+	nb := makeNotebook(t, "python", [2]string{"markdown", open + "EOD docs/a.md\nhello\nEOD\n"})
+	for _, def := range []string{nb, open + "EOD docs/a.md\nhello\nEOD\n"} {
+		odocs, _, err := NewDefaultRegistry().ParseDoc("/nonexistent/a", revReader{onlyReader{strings.NewReader(def)}, "abc123"})
+		require.NoError(t, err)
+		require.Len(t, odocs, 1)
+		require.Equal(t, "abc123", odocs[0].Revision)
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 
 	git "github.com/go-git/go-git/v5"
+	"github.com/lelandbatey/omegadoc/domain"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,15 +26,47 @@ type gitURLFinder struct {
 	// holds all the paths we've checked before to see if they contain .git
 	// folders
 	checkedpaths map[string]bool
+	// mu guards checkedpaths, as files may be parsed concurrently. It's a
+	// pointer since the gitURLFinder is copied along with the DocParser.
+	mu *sync.Mutex
 }
 
 func newGitURLFinder() gitURLFinder {
 	return gitURLFinder{
 		checkedpaths: map[string]bool{},
+		mu:           &sync.Mutex{},
 	}
 }
 
-func (guf *gitURLFinder) GetURL(filepath string, lineno int) (string, error) {
+// isGitRepo reports whether the directory pth contains a .git folder,
+// remembering the answer for next time.
+func (guf *gitURLFinder) isGitRepo(pth string) (bool, error) {
+	guf.mu.Lock()
+	defer guf.mu.Unlock()
+	if isgit, ok := guf.checkedpaths[pth]; ok {
+		return isgit, nil
+	}
+	lookp := path.Join(pth, ".git")
+	_, err := os.Stat(lookp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("cannot inspect folder %q, err: %w", lookp, err)
+	}
+	guf.checkedpaths[pth] = err == nil
+	return err == nil, nil
+}
+
+// GetURL returns the URL of a file within its git repository, with an anchor
+// highlighting the lines from startline to endline (both counting from 0). If
+// startline is negative, the URL has no anchor. The URL is of the file at the
+// commit with the hash revision, or at the commit of HEAD if revision is "".
+// The URL of a file within an archive is that of the archive, without an
+// anchor.
+func (guf *gitURLFinder) GetURL(filepath, revision string, startline, endline int) (string, error) {
+	if i := strings.Index(filepath, domain.ArchiveSeparator); i != -1 {
+		if info, err := os.Stat(filepath[:i]); err == nil && info.Mode().IsRegular() {
+			filepath, startline = filepath[:i], -1
+		}
+	}
 	var pth string = filepath
 	var repourl string = ""
 	var hash string = ""
@@ -47,19 +81,10 @@ func (guf *gitURLFinder) GetURL(filepath string, lineno int) (string, error) {
 		pth, _ = path.Split(pth)
 		pth = strings.TrimSuffix(pth, "/")
 		lookp := path.Join(pth, ".git")
-		if _, ok := guf.checkedpaths[pth]; !ok {
-			_, err := os.Stat(lookp)
-			if err != nil && !errors.Is(err, os.ErrNotExist) {
-				return "", fmt.Errorf("cannot inspect folder %q, err: %w", lookp, err)
-			}
-			if err == nil {
-				guf.checkedpaths[pth] = true
-			} else {
-				guf.checkedpaths[pth] = false
-			}
+		isgit, err := guf.isGitRepo(pth)
+		if err != nil {
+			return "", err
 		}
-
-		isgit := guf.checkedpaths[pth]
 		log.Infof("is %q a git repo?: %v", pth, isgit)
 		if !isgit {
 			continue
@@ -71,11 +96,15 @@ func (guf *gitURLFinder) GetURL(filepath string, lineno int) (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("cannot PlainOpen git repo on disk at path %q, error: %w", lookp, err)
 		}
-		ref, err := r.Head()
-		if err != nil {
-			return "", fmt.Errorf("cannot access HEAD of repository at path %q, error: %w", lookp, err)
+		if revision != "" {
+			hash = revision
+		} else {
+			ref, err := r.Head()
+			if err != nil {
+				return "", fmt.Errorf("cannot access HEAD of repository at path %q, error: %w", lookp, err)
+			}
+			hash = ref.Hash().String()
 		}
-		hash = ref.Hash().String()
 
 		remotes, err := r.Remotes()
 		if err != nil {
@@ -103,7 +132,13 @@ func (guf *gitURLFinder) GetURL(filepath string, lineno int) (string, error) {
 	if repourl != "" && hash != "" && gitfilepath != "" {
 		// have to add 1 to the line numbers because when displaying code you
 		// start from line 1, not line 0
-		return fmt.Sprintf("%s/tree/%s%s#L%d", repourl, hash, gitfilepath, lineno+1), nil
+		if startline < 0 {
+			return fmt.Sprintf("%s/tree/%s%s", repourl, hash, gitfilepath), nil
+		}
+		if endline > startline {
+			return fmt.Sprintf("%s/tree/%s%s#L%d-L%d", repourl, hash, gitfilepath, startline+1, endline+1), nil
+		}
+		return fmt.Sprintf("%s/tree/%s%s#L%d", repourl, hash, gitfilepath, startline+1), nil
 	}
 	return "", fmt.Errorf("cannot create URL to this file hosted online; file %q probably not in git repo or git repo not configured in way which supports creating HTTP links to files", filepath)
 }
@@ -0,0 +1,320 @@
+package docparser
+
+import (
+	"bufio"
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// odScanner reads the source of an OmegaDoc while tracking line numbers and
+// byte offsets. It reads bytes from Rdr a whole line at a time, converting to
+// runes only the lines which are actually part of a magic string or an
+// OmegaDoc; the text between OmegaDocs is searched for the common prefix of
+// the magic strings as bytes, without ever being converted to runes.
+type odScanner struct {
+	Rdr *bufio.Reader
+	// Magic holds the syntaxes of the magic strings searched for by
+	// FFTillMagicCommon.
+	Magic magicSet
+	// Lexer, if set, restricts FFTillMagicCommon to magic strings within
+	// comments. CommentPrefix is then set to the comment markup which should
+	// be removed from the lines following the magic string last found.
+	Lexer         *commentLexer
+	CommentPrefix []rune
+	LineNo        int
+	Prior         rune
+	// Line holds the runes of the current line which have been read so far,
+	// and PrevLine the runes of the line before it. They're tracked so that
+	// the text preceding a magic string on its line can be recovered.
+	Line     []rune
+	PrevLine []rune
+	// Pending holds bytes which have been "unread" and which will be read
+	// before reading from Rdr again.
+	Pending []byte
+	// Offset is the number of bytes which have been read.
+	Offset int64
+	// CRLF records the lines which were ended by a CRLF instead of just a
+	// newline. ReadRune and ReadLine return each CRLF as a single newline, so
+	// the rest of the parser only ever deals with newlines.
+	CRLF map[int]bool
+
+	// linebuf is reused for reading lines as bytes.
+	linebuf []byte
+}
+
+func (ods *odScanner) setCRLF(lineno int) {
+	if ods.CRLF == nil {
+		ods.CRLF = map[int]bool{}
+	}
+	ods.CRLF[lineno] = true
+}
+
+// readRawRune returns the next rune of Pending, or of Rdr once Pending is
+// empty, without any bookkeeping.
+func (ods *odScanner) readRawRune() (rune, int, error) {
+	if len(ods.Pending) > 0 {
+		r, s := utf8.DecodeRune(ods.Pending)
+		ods.Pending = ods.Pending[s:]
+		return r, s, nil
+	}
+	return ods.Rdr.ReadRune()
+}
+
+// peekByte returns the next byte which would be read, if there is one.
+func (ods *odScanner) peekByte() (byte, bool) {
+	if len(ods.Pending) > 0 {
+		return ods.Pending[0], true
+	}
+	b, err := ods.Rdr.Peek(1)
+	if err != nil {
+		return 0, false
+	}
+	return b[0], true
+}
+
+// readRawLine appends to dst the bytes of Pending and Rdr up to and including
+// the next newline. If the reader ends before a newline is found, the bytes
+// read so far are returned alongside the error. No bookkeeping is done.
+func (ods *odScanner) readRawLine(dst []byte) ([]byte, error) {
+	if len(ods.Pending) > 0 {
+		if idx := bytes.IndexByte(ods.Pending, '\n'); idx >= 0 {
+			dst = append(dst, ods.Pending[:idx+1]...)
+			ods.Pending = ods.Pending[idx+1:]
+			return dst, nil
+		}
+		dst = append(dst, ods.Pending...)
+		ods.Pending = nil
+	}
+	for {
+		chunk, err := ods.Rdr.ReadSlice('\n')
+		dst = append(dst, chunk...)
+		if err != bufio.ErrBufferFull {
+			return dst, err
+		}
+	}
+}
+
+func (ods *odScanner) ReadRune() (rune, int, error) {
+	r, s, err := ods.readRawRune()
+	if err != nil {
+		return r, s, err
+	}
+	if r == '\r' {
+		if next, ok := ods.peekByte(); ok && next == '\n' {
+			ods.readRawRune()
+			ods.setCRLF(ods.LineNo)
+			r, s = '\n', 2
+		}
+	}
+	ods.Prior = r
+	ods.Offset += int64(s)
+	if r == '\n' {
+		ods.LineNo++
+		ods.PrevLine = ods.Line
+		ods.Line = nil
+	} else {
+		ods.Line = append(ods.Line, r)
+	}
+	return r, s, err
+}
+
+func (ods *odScanner) UnreadRune() error {
+	if ods.Prior == rune(0) {
+		return bufio.ErrInvalidUnreadRune
+	}
+	ods.Unread([]rune{ods.Prior})
+	return nil
+}
+
+// Unread pushes runes back onto the odScanner so that they'll be read again
+// by subsequent calls to ReadRune, in the same order in which they're given.
+func (ods *odScanner) Unread(rs []rune) {
+	enc := []byte{}
+	for i := len(rs) - 1; i >= 0; i-- {
+		r := rs[i]
+		if r == '\n' {
+			ods.LineNo -= 1
+			ods.Line = ods.PrevLine
+			ods.PrevLine = nil
+			if ods.CRLF[ods.LineNo] {
+				enc = append(enc, '\n', '\r')
+				continue
+			}
+		} else if len(ods.Line) > 0 {
+			ods.Line = ods.Line[:len(ods.Line)-1]
+		}
+		var b [utf8.UTFMax]byte
+		n := utf8.EncodeRune(b[:], r)
+		for j := n - 1; j >= 0; j-- {
+			enc = append(enc, b[j])
+		}
+	}
+	// enc was built back to front
+	for i, j := 0, len(enc)-1; i < j; i, j = i+1, j-1 {
+		enc[i], enc[j] = enc[j], enc[i]
+	}
+	ods.Offset -= int64(len(enc))
+	ods.Pending = append(enc, ods.Pending...)
+	ods.Prior = rune(0)
+}
+
+func (ods *odScanner) LineNumber() int {
+	return ods.LineNo
+}
+
+// ReadLine returns all runes up to and including the next newline. If the
+// reader ends before a newline is found, the runes read so far are returned
+// alongside the error.
+func (ods *odScanner) ReadLine() ([]rune, error) {
+	raw, err := ods.readRawLine(ods.linebuf[:0])
+	ods.linebuf = raw
+	ods.Offset += int64(len(raw))
+	ended := len(raw) > 0 && raw[len(raw)-1] == '\n'
+	if ended && len(raw) > 1 && raw[len(raw)-2] == '\r' {
+		ods.setCRLF(ods.LineNo)
+		raw = append(raw[:len(raw)-2], '\n')
+	}
+	buf := []rune(string(raw))
+	if len(buf) > 0 {
+		ods.Prior = buf[len(buf)-1]
+	}
+	if ended {
+		ods.LineNo++
+		ods.PrevLine = append(ods.Line, buf[:len(buf)-1]...)
+		ods.Line = nil
+	} else {
+		ods.Line = append(ods.Line, buf...)
+	}
+	return buf, err
+}
+
+// Returns the next group of runes in a logical group. There are three possible
+// groups: a group of non-whitespace characters, a single newline, and a group
+// of non-newline whitespace characters.
+func (ods *odScanner) ReadRuneGroup() ([]rune, error) {
+	buf := []rune{}
+
+	ch, _, err := ods.ReadRune()
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, ch)
+	if ch == '\n' {
+		// A single newline
+		return buf, nil
+	} else if unicode.IsSpace(ch) {
+		// A group of non-newline whitespace characters
+		for {
+			ch, _, err = ods.ReadRune()
+			if err != nil {
+				return buf, err
+			}
+			if !unicode.IsSpace(ch) || ch == '\n' {
+				err = ods.UnreadRune()
+				if err != nil {
+					return buf, err
+				}
+				return buf, nil
+			} else {
+				buf = append(buf, ch)
+			}
+		}
+	} else {
+		// A group of non-whitespace characters
+		for {
+			ch, _, err = ods.ReadRune()
+			if err != nil {
+				return buf, err
+			}
+			if unicode.IsSpace(ch) {
+				err = ods.UnreadRune()
+				if err != nil {
+					return buf, err
+				}
+				return buf, nil
+			}
+			buf = append(buf, ch)
+		}
+	}
+}
+
+// FFTillMagicCommon moves through the odScanner till the underlying reader is
+// just after the common prefix of the magic strings of one of the syntaxes in
+// Magic, such as "#!/usr/bin/env omegadoc ", which is the common prefix to
+// all the "magic strings" of the default syntax, such as the 'ignore
+// directive' and the 'opening statement'. Occurrences of a common prefix
+// which are escaped by a preceding backslash are skipped over. The text on
+// the same line preceding the common prefix is returned, along with the
+// syntax which was found.
+//
+// This is where nearly all of the time of parsing is spent, since most text
+// isn't part of any OmegaDoc, so the search is done a line at a time on bytes.
+// Only the line on which the common prefix is found is converted to runes.
+func (ods *odScanner) FFTillMagicCommon() ([]rune, *magicSyntax, error) {
+	// Part of the current line may already have been read, in which case the
+	// common prefix may begin within that part, but must end after it.
+	line := append(ods.linebuf[:0], string(ods.Line)...)
+	for {
+		consumed := len(line)
+		raw, err := ods.readRawLine(line)
+		ods.linebuf = raw
+		ods.Offset += int64(len(raw) - consumed)
+		// The search starts early enough to find the longest prefix ending
+		// just after what had already been read.
+		from := consumed - 1
+		for _, syn := range ods.Magic {
+			if f := consumed - len(syn.Prefix) + 1; f < from {
+				from = f
+			}
+		}
+		if from < 0 {
+			from = 0
+		}
+		if ods.Lexer != nil {
+			ods.Lexer.seek(ods.LineNo, consumed)
+		}
+		for {
+			idx, which := ods.Magic.index(raw, from)
+			if idx == -1 {
+				break
+			}
+			syn := &ods.Magic[which]
+			end := idx + len(syn.Prefix)
+			if end <= consumed {
+				from = idx + 1
+				continue
+			}
+			if ods.Lexer != nil {
+				ods.Lexer.advance(raw, idx)
+				incomment, markup := ods.Lexer.magicComment(raw, idx)
+				if !incomment {
+					from = idx + 1
+					continue
+				}
+				ods.CommentPrefix = markup
+				ods.Lexer.pos = end
+			}
+			// Everything after the common prefix is put back to be read
+			// again.
+			rest := raw[end:]
+			ods.Offset -= int64(len(rest))
+			ods.Pending = append(append([]byte{}, rest...), ods.Pending...)
+			ods.Line = []rune(string(raw[:end]))
+			ods.Prior = ods.Line[len(ods.Line)-1]
+			return []rune(string(raw[:idx])), syn, nil
+		}
+		if ods.Lexer != nil {
+			ods.Lexer.advance(raw, len(raw))
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		// The text between OmegaDocs is never read again, so there's no need
+		// to remember it.
+		ods.LineNo++
+		ods.Line = nil
+		ods.PrevLine = nil
+		line = raw[:0]
+	}
+}
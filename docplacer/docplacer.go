@@ -12,8 +12,29 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func NewDocPlacer() domain.DocPlacer {
-	return docPlacer{}
+// Option configures optional behavior of the DocPlacer returned by
+// NewDocPlacer.
+type Option func(*docPlacer)
+
+// WithOverwrite enables (or disables) overwriting files which already exist
+// at the output paths of OmegaDocs. By default an existing file isn't
+// overwritten, and placing the OmegaDoc is an error.
+func WithOverwrite(enabled bool) Option {
+	return func(dpl *docPlacer) {
+		if enabled {
+			dpl.handle_existing = "yes-overwrite"
+		} else {
+			dpl.handle_existing = "do-not-overwrite"
+		}
+	}
+}
+
+func NewDocPlacer(opts ...Option) domain.DocPlacer {
+	dpl := docPlacer{}
+	for _, opt := range opts {
+		opt(&dpl)
+	}
+	return dpl
 }
 
 type docPlacer struct {
@@ -27,11 +48,7 @@ func (dpl docPlacer) PlaceDoc(outpath string, odoc domain.OmegaDoc) error {
 	if dpl.handle_existing == "" {
 		dpl.handle_existing = "do-not-overwrite"
 	}
-	reltpath := odoc.DestFilePath
-	if reltpath[0] == '/' {
-		reltpath = strings.TrimPrefix(reltpath, "/")
-	}
-	finpath := path.Join(outpath, reltpath)
+	finpath := destPath(outpath, odoc)
 	finbase := path.Dir(finpath)
 	log.WithFields(log.Fields{
 		"finpath": finpath,
@@ -63,3 +80,32 @@ func (dpl docPlacer) PlaceDoc(outpath string, odoc domain.OmegaDoc) error {
 	}
 	return nil
 }
+
+// destPath returns the path within outpath at which odoc is placed.
+func destPath(outpath string, odoc domain.OmegaDoc) string {
+	reltpath := odoc.DestFilePath
+	if reltpath[0] == '/' {
+		reltpath = strings.TrimPrefix(reltpath, "/")
+	}
+	return path.Join(outpath, reltpath)
+}
+
+// RemoveDoc removes the file placed for odoc, along with any directories
+// within outpath which are left empty. A file which is already gone isn't an
+// error.
+func (dpl docPlacer) RemoveDoc(outpath string, odoc domain.OmegaDoc) error {
+	finpath := destPath(outpath, odoc)
+	log.WithField("finpath", finpath).Info("removing omegadoc from output")
+	err := os.Remove(finpath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for dir := path.Dir(finpath); strings.HasPrefix(dir, strings.TrimSuffix(outpath, "/")+"/"); dir = path.Dir(dir) {
+		// Removing a directory which isn't empty fails, which ends the
+		// cleanup.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
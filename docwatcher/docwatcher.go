@@ -0,0 +1,191 @@
+// docwatcher watches files and directories on disk, reporting which paths
+// changed in batches, so that OmegaDocs can be found and placed again as
+// their sources change.
+package docwatcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDebounce is how long a Watcher waits by default after a change for
+// further changes before reporting them.
+const DefaultDebounce = 200 * time.Millisecond
+
+// Option configures optional behavior of the Watcher returned by NewWatcher.
+type Option func(*Watcher)
+
+// WithDebounce sets how long the Watcher waits after each change for further
+// changes before reporting them all in one batch; each change restarts the
+// wait.
+func WithDebounce(debounce time.Duration) Option {
+	return func(w *Watcher) {
+		w.debounce = debounce
+	}
+}
+
+// WithIgnorePaths sets absolute paths which, along with everything beneath
+// them, are not watched, such as the directory OmegaDocs are placed in.
+func WithIgnorePaths(ignorepaths ...string) Option {
+	return func(w *Watcher) {
+		w.ignorepaths = ignorepaths
+	}
+}
+
+// Watcher watches files and directories, recursively, for changes, using the
+// notifications of the operating system, such as inotify on Linux.
+type Watcher struct {
+	debounce    time.Duration
+	ignorepaths []string
+
+	fsw     *fsnotify.Watcher
+	changes chan []string
+}
+
+// NewWatcher returns a Watcher of the files and directories at paths, and of
+// everything beneath the directories. Directories created later beneath them
+// are watched too. A path which is a file is watched through its directory,
+// so that it's noticed when the file is replaced.
+func NewWatcher(paths []string, opts ...Option) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		debounce: DefaultDebounce,
+		fsw:      fsw,
+		changes:  make(chan []string),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			fsw.Close()
+			return nil, err
+		}
+		if !info.IsDir() {
+			err = fsw.Add(filepath.Dir(p))
+		} else {
+			err = w.addTree(p)
+		}
+		if err != nil {
+			fsw.Close()
+			return nil, err
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// isIgnored reports whether path is one of the ignored paths or is beneath
+// one.
+func (w *Watcher) isIgnored(path string) bool {
+	for _, ip := range w.ignorepaths {
+		if path == ip || strings.HasPrefix(path, ip+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addTree watches the directory at root and every directory beneath it,
+// except for .git directories and ignored paths.
+func (w *Watcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			// A directory removed while walking is noticed by its parent.
+			if path != root && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if (path != root && d.Name() == ".git") || w.isIgnored(path) {
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(path)
+	})
+}
+
+// run collects the paths of changes, reporting them once no change has been
+// seen for the debounce duration and the previous batch has been received.
+func (w *Watcher) run() {
+	defer close(w.changes)
+	pending := map[string]bool{}
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	// ready is the batch waiting to be received, and out is w.changes only
+	// while there's such a batch.
+	var ready []string
+	var out chan []string
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Op == fsnotify.Chmod || w.isIgnored(ev.Name) {
+				continue
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					if err := w.addTree(ev.Name); err != nil {
+						log.WithField("path", ev.Name).Warnf("cannot watch directory: %v", err)
+					}
+				}
+			}
+			pending[ev.Name] = true
+			// A tick which fired while this change was being handled
+			// mustn't flush the batch before the debounce is over.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(w.debounce)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Warnf("error watching files: %v", err)
+		case <-timer.C:
+			for _, p := range ready {
+				pending[p] = true
+			}
+			ready = make([]string, 0, len(pending))
+			for p := range pending {
+				ready = append(ready, p)
+			}
+			sort.Strings(ready)
+			pending = map[string]bool{}
+			out = w.changes
+		case out <- ready:
+			ready, out = nil, nil
+		}
+	}
+}
+
+// Changes returns the channel on which batches of the paths of files and
+// directories which were created, written, removed or renamed are sent. The
+// channel is closed once the Watcher is closed.
+func (w *Watcher) Changes() <-chan []string {
+	return w.changes
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	return w.fsw.Close()
+}
@@ -0,0 +1,58 @@
+package docwatcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatcher(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	for _, d := range []string{"sub", ".git", "out"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, d), 0755))
+	}
+	w, err := NewWatcher([]string{dir}, WithDebounce(50*time.Millisecond), WithIgnorePaths(out))
+	require.NoError(t, err)
+	defer w.Close()
+
+	next := func() []string {
+		select {
+		case changed := <-w.Changes():
+			return changed
+		case <-time.After(5 * time.Second):
+			t.Fatal("no changes reported")
+			return nil
+		}
+	}
+	write := func(parts ...string) string {
+		p := filepath.Join(append([]string{dir}, parts...)...)
+		require.NoError(t, os.WriteFile(p, []byte("x"), 0644))
+		return p
+	}
+
+	// Changes close together are reported together, while changes to
+	// ignored paths and within .git aren't reported at all.
+	write(".git", "HEAD")
+	write("out", "a.md")
+	a := write("a.go")
+	b := write("sub", "b.go")
+	require.Equal(t, []string{a, b}, next())
+
+	// Directories created after watching began are watched too.
+	newdir := filepath.Join(dir, "new")
+	require.NoError(t, os.Mkdir(newdir, 0755))
+	require.Equal(t, []string{newdir}, next())
+	c := write("new", "c.go")
+	require.Equal(t, []string{c}, next())
+
+	require.NoError(t, os.Remove(a))
+	require.Equal(t, []string{a}, next())
+
+	require.NoError(t, w.Close())
+	_, ok := <-w.Changes()
+	require.False(t, ok)
+}
@@ -8,6 +8,12 @@ const (
 	// followed by a "delimiting identifier", together those form an "opening
 	// statement" of an OmegaDoc.
 	START_OMEGADOC = "#!/usr/bin/env" + " omegadoc <<"
+	// ESCAPE_OMEGADOC is the escape character for magic strings. A magic
+	// string immediately preceded by ESCAPE_OMEGADOC is not treated as an
+	// opening statement or directive, and within the contents of an OmegaDoc
+	// the escape character is removed so that the literal magic string
+	// remains. This allows OmegaDocs to contain examples of OmegaDocs.
+	ESCAPE_OMEGADOC = `\`
 	// IGNORE_OMEGADOC is a magic string which acts as an "ignore directive"
 	// for an OmegaDoc. If a file contains an "ignore directive" in its bytes
 	// before an OmegaDoc opening statement, then that file will be considered
@@ -16,4 +22,23 @@ const (
 	// more valid OmegaDoc directives, then that "ignore directive" will itself
 	// be ignored.
 	IGNORE_OMEGADOC = "#!/usr/bin/env" + " omegadoc ignore-this-file"
+	// INCLUDE_OMEGADOC is a magic string which acts as an "include directive".
+	// It's followed by attributes and an output path in the same way as an
+	// opening statement. The entire file containing an "include directive",
+	// minus the line of the directive itself, is extracted as a single
+	// OmegaDoc with that output path.
+	INCLUDE_OMEGADOC = "#!/usr/bin/env" + " omegadoc include-this-file"
+	// IGNORE_NEXT_OMEGADOC is a magic string which acts as an "ignore next"
+	// directive. The first OmegaDoc whose opening statement follows an
+	// "ignore next" directive is skipped entirely, up to and including its
+	// delimiting identifier. Later OmegaDocs are unaffected.
+	IGNORE_NEXT_OMEGADOC = "#!/usr/bin/env" + " omegadoc ignore-next"
+	// IGNORE_START_OMEGADOC is a magic string which begins an "ignore
+	// region". Everything following it, including any opening statements and
+	// directives, is skipped until an IGNORE_END_OMEGADOC directive (or the end
+	// of the file) is reached.
+	IGNORE_START_OMEGADOC = "#!/usr/bin/env" + " omegadoc ignore-start"
+	// IGNORE_END_OMEGADOC is a magic string which ends an "ignore region"
+	// begun by IGNORE_START_OMEGADOC.
+	IGNORE_END_OMEGADOC = "#!/usr/bin/env" + " omegadoc ignore-end"
 )
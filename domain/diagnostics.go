@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Severity indicates how serious a Diagnostic is.
+type Severity int
+
+const (
+	// SeverityWarning marks a Diagnostic for something which is probably a
+	// mistake, but which still allowed the OmegaDoc to be extracted.
+	SeverityWarning Severity = iota
+	// SeverityError marks a Diagnostic for something which prevented an
+	// OmegaDoc (or an entire file) from being extracted.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// Codes identifying the kind of problem a Diagnostic describes.
+const (
+	// DiagMissingDelimiter is for an opening statement with no delimiting
+	// identifier following the magic string.
+	DiagMissingDelimiter = "missing-delimiter"
+	// DiagMissingDestPath is for an opening statement without an output path.
+	DiagMissingDestPath = "missing-destination-path"
+	// DiagMalformedAttribute is for an attribute which couldn't be parsed.
+	DiagMalformedAttribute = "malformed-attribute"
+	// DiagMalformedDestPath is for an output path which couldn't be parsed.
+	DiagMalformedDestPath = "malformed-destination-path"
+	// DiagEOFInOpening is for a file which ends before the opening statement
+	// is terminated by a newline.
+	DiagEOFInOpening = "eof-in-opening-statement"
+	// DiagEOFBeforeDelimiter is for an OmegaDoc whose file ends before the
+	// delimiting identifier is found.
+	DiagEOFBeforeDelimiter = "eof-before-delimiter"
+	// DiagEmptyBody is for an OmegaDoc with no contents besides whitespace.
+	DiagEmptyBody = "empty-body"
+	// DiagDelimiterWithinLine is for a delimiting identifier which appears
+	// within a line of an OmegaDoc without being alone on that line.
+	DiagDelimiterWithinLine = "delimiter-within-line"
+	// DiagUnterminatedIgnore is for an "ignore region" which is never ended.
+	DiagUnterminatedIgnore = "unterminated-ignore-region"
+	// DiagUnmatchedIgnoreEnd is for an "ignore-end" directive outside of an
+	// "ignore region".
+	DiagUnmatchedIgnoreEnd = "unmatched-ignore-end"
+	// DiagReadError is for a file which couldn't be read.
+	DiagReadError = "read-error"
+	// DiagPlaceError is for an OmegaDoc which couldn't be written to the
+	// output directory.
+	DiagPlaceError = "place-error"
+)
+
+// Diagnostic describes a problem found at a particular position within a
+// source file while extracting OmegaDocs.
+type Diagnostic struct {
+	SourceFilePath string
+	// Line is the 1-based line number within SourceFilePath, or 0 if the
+	// Diagnostic applies to the whole file.
+	Line int
+	// Column is the 1-based column (counted in runes) within Line, or 0 if
+	// the Diagnostic applies to the whole line.
+	Column int
+	// Cell is set when SourceFilePath is a Jupyter notebook, in which case
+	// Line and Column are within the source of that cell.
+	Cell     *NotebookCell
+	Severity Severity
+	Code     string
+	Message  string
+}
+
+// String formats the Diagnostic in the style of a compiler message, e.g.:
+//
+//	path/to/file.go:12:4: error: opening statement has no output path [missing-destination-path]
+//
+// The cell of a notebook is given like a JSON path, before the line:
+//
+//	path/to/notebook.ipynb:cells[3]:2:1: warning: ...
+func (d Diagnostic) String() string {
+	pos := d.SourceFilePath
+	if d.Cell != nil {
+		pos = fmt.Sprintf("%s:cells[%d]", pos, d.Cell.Index)
+	}
+	if d.Line > 0 {
+		pos = fmt.Sprintf("%s:%d", pos, d.Line)
+		if d.Column > 0 {
+			pos = fmt.Sprintf("%s:%d", pos, d.Column)
+		}
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", pos, d.Severity, d.Message, d.Code)
+}
+
+// SortDiagnostics sorts diagnostics by their position.
+func SortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		if a.SourceFilePath != b.SourceFilePath {
+			return a.SourceFilePath < b.SourceFilePath
+		}
+		if ca, cb := cellIndex(a.Cell), cellIndex(b.Cell); ca != cb {
+			return ca < cb
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// cellIndex returns the index of cell, or -1 if there's no cell.
+func cellIndex(cell *NotebookCell) int {
+	if cell == nil {
+		return -1
+	}
+	return cell.Index
+}
@@ -0,0 +1,82 @@
+package domain
+
+import "bytes"
+
+// TextEncoding is an encoding of text in which OmegaDocs may be written.
+type TextEncoding int
+
+const (
+	EncodingUTF8 TextEncoding = iota
+	EncodingUTF16LE
+	EncodingUTF16BE
+)
+
+func (e TextEncoding) String() string {
+	switch e {
+	case EncodingUTF16LE:
+		return "UTF-16LE"
+	case EncodingUTF16BE:
+		return "UTF-16BE"
+	default:
+		return "UTF-8"
+	}
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// SniffLen is the number of bytes at the start of a text which DetectEncoding
+// examines when the text doesn't start with a byte order mark.
+const SniffLen = 512
+
+// DetectEncoding returns the encoding of the text which begins with head,
+// along with the length of the byte order mark the text begins with, if any.
+// head should hold the first SniffLen bytes of the text, or all of it if it's
+// shorter.
+//
+// Text without a byte order mark is assumed to be UTF-8 unless it looks like
+// mostly-ASCII UTF-16; that is, unless nearly every other byte is zero.
+func DetectEncoding(head []byte) (TextEncoding, int) {
+	boms := []struct {
+		bom []byte
+		enc TextEncoding
+	}{
+		{bomUTF8, EncodingUTF8},
+		{bomUTF16LE, EncodingUTF16LE},
+		{bomUTF16BE, EncodingUTF16BE},
+	}
+	for _, b := range boms {
+		if bytes.HasPrefix(head, b.bom) {
+			return b.enc, len(b.bom)
+		}
+	}
+	if len(head) > SniffLen {
+		head = head[:SniffLen]
+	}
+	pairs := len(head) / 2
+	if pairs < 2 {
+		return EncodingUTF8, 0
+	}
+	evenzero, oddzero := 0, 0
+	for i := 0; i+1 < len(head); i += 2 {
+		if head[i] == 0 {
+			evenzero++
+		}
+		if head[i+1] == 0 {
+			oddzero++
+		}
+	}
+	// Text in UTF-8 essentially never contains NUL bytes, while ASCII text in
+	// UTF-16 has a NUL in every code unit. Require a strong majority so that
+	// binary files with scattered NULs are still read as bytes.
+	switch {
+	case oddzero*10 >= pairs*9 && evenzero == 0:
+		return EncodingUTF16LE, 0
+	case evenzero*10 >= pairs*9 && oddzero == 0:
+		return EncodingUTF16BE, 0
+	}
+	return EncodingUTF8, 0
+}
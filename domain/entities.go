@@ -1,5 +1,10 @@
 package domain
 
+import (
+	"io"
+	"os"
+)
+
 type OmegaAttribute struct {
 	Key   string
 	Value string
@@ -16,8 +21,46 @@ type OmegaDoc struct {
 	// The contents of the OmegaDoc, found between the opening statement (which
 	// defines the delimiting identifier) and the delimiting identifier.
 	Contents string
-	// The line within SourceFilePath on which the OmegaDoc starts
+	// The line within SourceFilePath on which the OmegaDoc starts. Like all
+	// line numbers in an OmegaDoc, this counts from 0.
 	StartLineNumber int
+	// StartColumn is the column (counted in runes from 0) within
+	// StartLineNumber at which the magic string of the opening statement
+	// begins.
+	StartColumn int
+	// EndLineNumber is the line within SourceFilePath on which the OmegaDoc
+	// ends. This is the line of the delimiting identifier, or the last line of
+	// the file if the file ended before the delimiting identifier.
+	EndLineNumber int
+
+	// The following are byte offsets within SourceFilePath describing the
+	// span of each part of the OmegaDoc. Each pair of Start and End offsets
+	// is half-open; the End offset is just past the last byte of that part.
+	// The offsets are of the bytes of the file as it is, even when its text
+	// is transcoded to be parsed, as text in UTF-16 is.
+	//
+	// The header spans from the first byte of the magic string through the
+	// newline ending the opening statement.
+	HeaderStartOffset int64
+	HeaderEndOffset   int64
+	// The body spans the original bytes of the contents in SourceFilePath,
+	// before any line prefixes or indentation are removed.
+	BodyStartOffset int64
+	BodyEndOffset   int64
+	// DelimiterOffset is the offset of the first byte of the delimiting
+	// identifier, or -1 if the OmegaDoc was ended by the end of the file.
+	DelimiterOffset int64
+	// Cell is set when SourceFilePath is a Jupyter notebook, to the cell of
+	// the notebook in which the OmegaDoc was found. Line numbers, columns and
+	// offsets are then relative to the source of that cell rather than to
+	// the notebook file.
+	Cell *NotebookCell
+	// Revision is the hash of the git commit SourceFilePath was read from,
+	// when it was read from a commit rather than from the working tree.
+	Revision string
+	// Root is the input root beneath which SourceFilePath was found, and
+	// whose Prefix begins DestFilePath.
+	Root *InputRoot
 	// HTTPURL contains a single full HTTP URL where you can read the source of
 	// this OmegaDoc in your web-browser. This URL is not present in the
 	// original document and if present will have been derived from the git
@@ -28,6 +71,105 @@ type OmegaDoc struct {
 	HTTPUrl string
 }
 
+// DocSource is a file which may contain OmegaDocs, which is opened only when
+// it's about to be read.
+type DocSource struct {
+	// Path is the absolute on-disk path of the file, which becomes the
+	// SourceFilePath of its OmegaDocs. A file within an archive has the path
+	// of the archive joined to its path within the archive by
+	// ArchiveSeparator.
+	Path string
+	// Open opens the file for reading. The caller must close what's returned
+	// once it's done reading.
+	Open func() (io.ReadCloser, error)
+	// Stat describes the file on disk which Open reads, so that it can be
+	// told whether the file changed since it was last read. It's nil for
+	// sources which aren't read from a file on disk of their own, such as
+	// files within archives or files read from a git commit.
+	Stat func() (os.FileInfo, error)
+	// Close releases what the source keeps open for Open to read, such as
+	// the temporary file which the files within archives are copied into.
+	// It's nil for sources which keep nothing open. Once it's called, Open
+	// mustn't be called again.
+	Close func() error
+}
+
+// ArchiveSeparator separates the path of an archive from the path of a file
+// within it, as in "/src/handoff.zip!/docs/a.md". Files within archives
+// nested within archives have several, as in "/src/a.zip!/b.tar!/c.md".
+const ArchiveSeparator = "!/"
+
+// IgnoreFileNames are the names of the files holding patterns, in gitignore
+// syntax, of paths which aren't searched. Patterns in files later in this list
+// take priority over those in earlier files in the same directory, so an
+// .omegadocignore may re-include ("!path") what a .gitignore excludes.
+var IgnoreFileNames = []string{".gitignore", ".omegadocignore"}
+
+// RevisionReader is implemented by the readers of DocSources which are read
+// from a commit of a git repository rather than from the working tree, so
+// that the OmegaDocs within can refer to that commit.
+type RevisionReader interface {
+	io.Reader
+	// Revision returns the hash of the commit.
+	Revision() string
+}
+
+// ReaderRevision returns the revision of r if it's a RevisionReader, and
+// otherwise "".
+func ReaderRevision(r io.Reader) string {
+	if rr, ok := r.(RevisionReader); ok {
+		return rr.Revision()
+	}
+	return ""
+}
+
+// Reopener is implemented by the readers of sources which can't seek but can
+// be opened again, such as files within archives, so that a DocParser which
+// has to read a source twice needn't keep a copy of what it has read.
+type Reopener interface {
+	io.Reader
+	// Reopen returns a new reader of the source, from its start.
+	Reopen() (io.ReadCloser, error)
+}
+
+// reopenReader is a Reopener which keeps the revision of the reader it wraps.
+type reopenReader struct {
+	io.Reader
+	reopen func() (io.ReadCloser, error)
+}
+
+func (rr reopenReader) Reopen() (io.ReadCloser, error) {
+	return rr.reopen()
+}
+
+func (rr reopenReader) Revision() string {
+	return ReaderRevision(rr.Reader)
+}
+
+// NewReopener returns a Reopener reading r, whose source is opened again by
+// reopen. The revision of r, if it's a RevisionReader, is kept.
+func NewReopener(r io.Reader, reopen func() (io.ReadCloser, error)) Reopener {
+	return reopenReader{Reader: r, reopen: reopen}
+}
+
+// ReaderReopen returns the Reopen method of r if it's a Reopener, and
+// otherwise nil.
+func ReaderReopen(r io.Reader) func() (io.ReadCloser, error) {
+	if ro, ok := r.(Reopener); ok {
+		return ro.Reopen
+	}
+	return nil
+}
+
+// NotebookCell identifies a cell of a Jupyter notebook.
+type NotebookCell struct {
+	// Index is the index (counting from 0) of the cell within the "cells" of
+	// the notebook.
+	Index int
+	// Type is the cell_type of the cell, such as "markdown" or "code".
+	Type string
+}
+
 /*
 #!/usr/bin/env omegadoc <<ENDDOC omegadoc/index.md
 # Narrative Purpose of OmegaDoc
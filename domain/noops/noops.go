@@ -5,11 +5,12 @@ package noops
 import (
 	"github.com/lelandbatey/omegadoc/domain"
 	"io"
+	"os"
 )
 
 type NoOpDocFinder struct{}
 
-func (ndf NoOpDocFinder) FindReaders(path string) (map[string]io.Reader, error) {
+func (ndf NoOpDocFinder) FindSources(path string) ([]domain.DocSource, error) {
 	return nil, nil
 }
 
@@ -25,7 +26,11 @@ var _ domain.DocFinder = NoOpDocFinder{}
 
 type NoOpDocParser struct{}
 
-func (nde NoOpDocParser) ParseDoc(srcpath string, contents io.Reader) ([]domain.OmegaDoc, error) {
+func (nde NoOpDocParser) ParseDoc(srcpath string, contents io.Reader) ([]domain.OmegaDoc, []domain.Diagnostic, error) {
+	return nil, nil, nil
+}
+
+func (nde NoOpDocParser) ParseDocStream(srcpath string, contents io.Reader, emit func(domain.OmegaDoc) error) ([]domain.Diagnostic, error) {
 	return nil, nil
 }
 
@@ -37,4 +42,23 @@ func (nde NoOpDocPlacer) PlaceDoc(outpath string, odoc domain.OmegaDoc) error {
 	return nil
 }
 
+func (nde NoOpDocPlacer) RemoveDoc(outpath string, odoc domain.OmegaDoc) error {
+	return nil
+}
+
 var _ domain.DocPlacer = NoOpDocPlacer{}
+
+type NoOpDocCache struct{}
+
+func (ndc NoOpDocCache) Lookup(path string, info os.FileInfo, hash string) ([]domain.OmegaDoc, []domain.Diagnostic, bool) {
+	return nil, nil, false
+}
+
+func (ndc NoOpDocCache) Store(path string, info os.FileInfo, hash string, odocs []domain.OmegaDoc, diags []domain.Diagnostic) {
+}
+
+func (ndc NoOpDocCache) Save() error {
+	return nil
+}
+
+var _ domain.DocCache = NoOpDocCache{}
@@ -2,27 +2,71 @@ package domain
 
 import (
 	"io"
+	"os"
 )
 
 // DocFinder finds the on-disk files which contain Omegadoc documents and
-// returns them as a slice of io.Readers. While the goal is to find actual
+// returns them as a slice of DocSources. While the goal is to find actual
 // files on the disk, implementations of DocFinder could return whatever
-// io.Readers they want, which is useful for internal testing.
+// DocSources they want, which is useful for internal testing.
 type DocFinder interface {
-	// FindReaders returns a map of absolute on-disk paths to io.Readers of
-	// each file containing at least one Omegadoc in the filesystem at
-	// 'path'. The filesystem at 'path' is searched recursively for files
-	// containing Omegadocs.
-	FindReaders(path string) (map[string]io.Reader, error)
+	// FindSources returns a DocSource for each file containing at least one
+	// Omegadoc in the filesystem at 'path', sorted by their Path. The
+	// filesystem at 'path' is searched recursively for files containing
+	// Omegadocs. No file is left open, except by DocSources with a Close,
+	// which must be called once they're read; each file is otherwise only
+	// opened once its DocSource is opened.
+	FindSources(path string) ([]DocSource, error)
+}
+
+// PathFinder is a DocFinder which can search only some of the filesystem at
+// a path, so that when only a few files change, the rest needn't be
+// searched again.
+type PathFinder interface {
+	DocFinder
+	// FindSourcesWithin returns the DocSources which FindSources(path) would
+	// return which are, or are beneath, any of within. Ignore files and
+	// patterns apply just as they do to FindSources.
+	FindSourcesWithin(path string, within []string) ([]DocSource, error)
 }
 
 // Parses the contents of the file to extract all the OmegaDocs in that file.
+// Problems with individual OmegaDocs are reported as Diagnostics without
+// stopping the parse; the returned error is reserved for problems which
+// prevent the file from being parsed at all, such as failing to read it.
+// data which can seek, or which is a Reopener, may be read again rather than
+// copied as it's read.
 type DocParser interface {
-	ParseDoc(srcpath string, data io.Reader) ([]OmegaDoc, error)
+	ParseDoc(srcpath string, data io.Reader) ([]OmegaDoc, []Diagnostic, error)
+	// ParseDocStream parses the same OmegaDocs as ParseDoc, but passes each
+	// one to emit as soon as it's parsed instead of collecting them all in
+	// memory. An error returned by emit stops the parse and is returned.
+	ParseDocStream(srcpath string, data io.Reader, emit func(OmegaDoc) error) ([]Diagnostic, error)
+}
+
+// DocCache remembers the OmegaDocs and Diagnostics parsed from files on disk,
+// so that files which haven't changed since they were last parsed needn't be
+// read or parsed again.
+type DocCache interface {
+	// Lookup returns what was parsed from the file at path, if it's known
+	// that the file hasn't changed since. When hash is "", the file is only
+	// known to be unchanged if info, as returned by os.Stat, shows the same
+	// size and modification time as when it was parsed. Otherwise hash is
+	// the hash of the file's contents, and the file is unchanged if the hash
+	// is the same, whatever info shows.
+	Lookup(path string, info os.FileInfo, hash string) ([]OmegaDoc, []Diagnostic, bool)
+	// Store remembers what was parsed from the file at path, which info
+	// describes and whose contents have the given hash.
+	Store(path string, info os.FileInfo, hash string, odocs []OmegaDoc, diags []Diagnostic)
+	// Save writes what's remembered to wherever it persists.
+	Save() error
 }
 
 type DocPlacer interface {
 	PlaceDoc(outpath string, odoc OmegaDoc) error
+	// RemoveDoc removes the file placed for odoc within outpath, once no
+	// OmegaDoc is placed there any longer.
+	RemoveDoc(outpath string, odoc OmegaDoc) error
 }
 
 // Postprocessors act as a kind of "super-middleware", an interface for things
@@ -0,0 +1,58 @@
+package domain
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// InputRoot is a path searched for OmegaDocs. When several are searched at
+// once, each may place its OmegaDocs beneath a prefix of its own, so that
+// OmegaDocs with the same DestFilePath from different roots don't collide.
+type InputRoot struct {
+	// Path is the file or directory searched.
+	Path string
+	// Prefix is a relative, slash separated path which begins the
+	// DestFilePath of every OmegaDoc found beneath Path, or "" for none.
+	Prefix string
+}
+
+// ParseInputRoot parses an input root written as "PATH" or "PATH=PREFIX",
+// such as "../payments=payments/". Since the prefix follows the last "=",
+// a path containing "=" must be followed by a prefix, even an empty one.
+// The prefix may not be absolute nor lead outside of the output directory.
+func ParseInputRoot(s string) (InputRoot, error) {
+	ir := InputRoot{Path: s}
+	if eq := strings.LastIndex(s, "="); eq >= 0 {
+		ir.Path, ir.Prefix = s[:eq], s[eq+1:]
+	}
+	if ir.Path == "" {
+		return InputRoot{}, fmt.Errorf("input root %q has no path", s)
+	}
+	if ir.Prefix == "" {
+		return ir, nil
+	}
+	prefix := filepath.ToSlash(ir.Prefix)
+	if path.IsAbs(prefix) || filepath.IsAbs(ir.Prefix) {
+		return InputRoot{}, fmt.Errorf("input root %q has an absolute prefix, it must be relative to the output path", s)
+	}
+	prefix = path.Clean(prefix)
+	if prefix == ".." || strings.HasPrefix(prefix, "../") {
+		return InputRoot{}, fmt.Errorf("input root %q has a prefix leading outside of the output path", s)
+	}
+	if prefix == "." {
+		prefix = ""
+	}
+	ir.Prefix = prefix
+	return ir, nil
+}
+
+// Name returns a short name for the root: its prefix, or else the last
+// element of its path.
+func (ir InputRoot) Name() string {
+	if ir.Prefix != "" {
+		return ir.Prefix
+	}
+	return filepath.Base(ir.Path)
+}
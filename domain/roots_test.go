@@ -0,0 +1,36 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInputRoot(t *testing.T) {
+	for tidx, test := range []struct {
+		Def  string
+		Exp  InputRoot
+		Name string
+		Err  bool
+	}{
+		{Def: "../payments", Exp: InputRoot{Path: "../payments"}, Name: "payments"},
+		{Def: "../payments=pay/", Exp: InputRoot{Path: "../payments", Prefix: "pay"}, Name: "pay"},
+		{Def: "src=vendor/./a//b", Exp: InputRoot{Path: "src", Prefix: "vendor/a/b"}, Name: "vendor/a/b"},
+		{Def: "a=b=c", Exp: InputRoot{Path: "a=b", Prefix: "c"}, Name: "c"},
+		{Def: "a=b=", Exp: InputRoot{Path: "a=b"}, Name: "a=b"},
+		{Def: "src=./", Exp: InputRoot{Path: "src"}, Name: "src"},
+		{Def: "=pay", Err: true},
+		{Def: "src=/abs", Err: true},
+		{Def: "src=../up", Err: true},
+		{Def: "src=a/../..", Err: true},
+	} {
+		ir, err := ParseInputRoot(test.Def)
+		if test.Err {
+			require.Error(t, err, "test #%d", tidx)
+			continue
+		}
+		require.NoError(t, err, "test #%d", tidx)
+		require.Equal(t, test.Exp, ir, "test #%d", tidx)
+		require.Equal(t, test.Name, ir.Name(), "test #%d", tidx)
+	}
+}
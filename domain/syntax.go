@@ -0,0 +1,104 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// MagicSyntax is one spelling of the magic strings of OmegaDoc. Every magic
+// string of a MagicSyntax is its Prefix followed by one of its directive
+// words, so for the default syntax the opening statement is
+// "#!/usr/bin/env omegadoc " followed by "<<", and the ignore directive is
+// the same prefix followed by "ignore-this-file".
+//
+// Alternate syntaxes exist for file types where the default magic strings are
+// rejected or mangled, such as JSON, SQL checked by strict linters, or
+// Markdown tables.
+type MagicSyntax struct {
+	// Prefix is the text which begins every magic string of this syntax.
+	Prefix string
+	// Start completes the opening statement. If Start ends in punctuation, as
+	// "<<" does, the delimiting identifier follows it immediately (<<EOD).
+	// If Start ends in a letter or digit, as "begin" does, the delimiting
+	// identifier follows it after whitespace (begin EOD).
+	Start       string
+	Ignore      string
+	Include     string
+	IgnoreNext  string
+	IgnoreStart string
+	IgnoreEnd   string
+}
+
+// DefaultMagicSyntax is the syntax of the START_OMEGADOC family of magic
+// strings.
+var DefaultMagicSyntax = MagicSyntax{
+	Prefix:      strings.TrimSuffix(START_OMEGADOC, "<<"),
+	Start:       "<<",
+	Ignore:      "ignore-this-file",
+	Include:     "include-this-file",
+	IgnoreNext:  "ignore-next",
+	IgnoreStart: "ignore-start",
+	IgnoreEnd:   "ignore-end",
+}
+
+// StartString returns the magic string of the opening statement.
+func (ms MagicSyntax) StartString() string {
+	return ms.Prefix + ms.Start
+}
+
+// SpacedDelimiter reports whether the delimiting identifier is separated
+// from the opening statement's magic string by whitespace.
+func (ms MagicSyntax) SpacedDelimiter() bool {
+	rs := []rune(ms.Start)
+	return len(rs) > 0 && isWordRune(rs[len(rs)-1])
+}
+
+// Validate checks that the syntax is usable, returning an error describing
+// the first problem found.
+func (ms MagicSyntax) Validate() error {
+	if ms.Prefix == "" {
+		return fmt.Errorf("magic syntax has an empty prefix")
+	}
+	if strings.ContainsAny(ms.Prefix, "\r\n") {
+		return fmt.Errorf("magic syntax prefix %q contains a line break", ms.Prefix)
+	}
+	words := []string{ms.Start, ms.Ignore, ms.Include, ms.IgnoreNext, ms.IgnoreStart, ms.IgnoreEnd}
+	for _, w := range words {
+		if w == "" || strings.IndexFunc(w, unicode.IsSpace) != -1 {
+			return fmt.Errorf("magic syntax %q has a directive word %q which is empty or contains whitespace", ms.StartString(), w)
+		}
+	}
+	return nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_'
+}
+
+// ParseMagicSyntax creates a MagicSyntax from the magic string of its opening
+// statement, such as "@omegadoc <<" or "omegadoc:begin". The last run of
+// punctuation, or else the last word, of the opening becomes Start and the
+// rest becomes Prefix. The directive words are the same as those of
+// DefaultMagicSyntax, so "@omegadoc <<" gives an ignore directive of
+// "@omegadoc ignore-this-file" and "omegadoc:begin" gives one of
+// "omegadoc:ignore-this-file".
+func ParseMagicSyntax(opening string) (MagicSyntax, error) {
+	rs := []rune(opening)
+	end := len(rs)
+	if end == 0 || unicode.IsSpace(rs[end-1]) {
+		return MagicSyntax{}, fmt.Errorf("magic syntax %q must not be empty or end in whitespace", opening)
+	}
+	word := isWordRune(rs[end-1])
+	start := end
+	for start > 0 && !unicode.IsSpace(rs[start-1]) && isWordRune(rs[start-1]) == word {
+		start--
+	}
+	ms := DefaultMagicSyntax
+	ms.Prefix = string(rs[:start])
+	ms.Start = string(rs[start:])
+	if err := ms.Validate(); err != nil {
+		return MagicSyntax{}, fmt.Errorf("cannot use magic syntax %q: %w", opening, err)
+	}
+	return ms, nil
+}
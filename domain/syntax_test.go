@@ -0,0 +1,38 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMagicSyntax(t *testing.T) {
+	for tidx, test := range []struct {
+		Opening string
+		Prefix  string
+		Start   string
+		Spaced  bool
+		Err     bool
+	}{
+		{Opening: START_OMEGADOC, Prefix: DefaultMagicSyntax.Prefix, Start: "<<"},
+		{Opening: "@omegadoc <<", Prefix: "@omegadoc ", Start: "<<"},
+		{Opening: "omegadoc:begin", Prefix: "omegadoc:", Start: "begin", Spaced: true},
+		{Opening: "-- omegadoc begin-doc", Prefix: "-- omegadoc ", Start: "begin-doc", Spaced: true},
+		{Opening: "<<", Err: true},
+		{Opening: "begin", Err: true},
+		{Opening: "omegadoc ", Err: true},
+		{Opening: "", Err: true},
+	} {
+		ms, err := ParseMagicSyntax(test.Opening)
+		if test.Err {
+			require.Error(t, err, "test #%d", tidx)
+			continue
+		}
+		require.NoError(t, err, "test #%d", tidx)
+		require.Equal(t, test.Prefix, ms.Prefix, "test #%d", tidx)
+		require.Equal(t, test.Start, ms.Start, "test #%d", tidx)
+		require.Equal(t, test.Spaced, ms.SpacedDelimiter(), "test #%d", tidx)
+		require.Equal(t, test.Opening, ms.StartString(), "test #%d", tidx)
+		require.Equal(t, "ignore-this-file", ms.Ignore, "test #%d", tidx)
+	}
+}
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/Kunde21/markdownfmt/v2 v2.1.1-0.20210819095016-f85609284a50 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-git/go-git/v5 v5.4.2 // indirect
 	github.com/sirupsen/logrus v1.8.1 // indirect
 	github.com/spf13/cobra v1.2.1 // indirect
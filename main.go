@@ -5,11 +5,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/lelandbatey/omegadoc/application"
+	"github.com/lelandbatey/omegadoc/doccache"
 	"github.com/lelandbatey/omegadoc/docfinder"
 	"github.com/lelandbatey/omegadoc/docparser"
 	"github.com/lelandbatey/omegadoc/docplacer"
+	"github.com/lelandbatey/omegadoc/docwatcher"
+	"github.com/lelandbatey/omegadoc/domain"
 	"github.com/lelandbatey/omegadoc/postprocess"
 
 	log "github.com/sirupsen/logrus"
@@ -19,7 +23,22 @@ import (
 var (
 	defaultOmegadocOut = path.Join(os.TempDir(), "omegadoc")
 	outputpath         = pflag.StringP("output-path", "o", "", "Path to the directory in which to collect all found OmegaDocs")
-	scanpath           = pflag.StringP("input-search-path", "i", "", "Path to the file or directory to search for OmegaDocs")
+	scanpaths          = pflag.StringArrayP("input-search-path", "i", nil, "Path to the file or directory to search for OmegaDocs, optionally written as PATH=PREFIX to place the OmegaDocs found there beneath PREFIX in the output; may be given more than once")
+	substringDelims    = pflag.Bool("substring-delimiters", false, "Use the legacy behavior where a delimiting identifier ends an OmegaDoc wherever it appears, instead of only when alone on its own line")
+	lineEndings        = pflag.String("line-endings", "normalize", "How to write the line endings of extracted OmegaDocs; \"normalize\" writes every line ending as a newline, \"keep\" keeps CRLFs as they were in the source")
+	magicSyntaxes      = pflag.StringArray("magic-syntax", nil, "An additional opening statement magic string to recognize, such as \"@omegadoc <<\" or \"omegadoc:begin\"; may be given more than once")
+	languageAware      = pflag.Bool("language-aware", false, "In files of known languages (by file extension), only recognize magic strings within comments and remove the comment markup from OmegaDocs")
+	parserMappings     = pflag.StringArray("parser", nil, "Parse files with a file extension using a particular parser, written as EXT=NAME such as \".nb=notebook\"; NAME is one of "+strings.Join(docparser.ParserNames(), ", ")+"; may be given more than once")
+	excludeGlobs       = pflag.StringArray("exclude", nil, "A pattern, in .gitignore syntax and relative to the search path, of files or directories not to search; may be given more than once")
+	includeGlobs       = pflag.StringArray("include", nil, "A pattern, in .gitignore syntax and relative to the search path, of files to search; when given, files matching no --include aren't searched; may be given more than once")
+	noIgnoreFiles      = pflag.Bool("no-ignore", false, "Search files even if they're excluded by .gitignore or .omegadocignore files")
+	followSymlinks     = pflag.Bool("follow-symlinks", false, "Search what symbolic links beneath the search path point to; each file is searched once, by its path with all links resolved")
+	finderName         = pflag.String("finder", "native", "How to search files for OmegaDocs; one of "+strings.Join(docfinder.SearchFuncNames, ", ")+"; \"auto\" uses rg or grep if found on the PATH, and otherwise native; native is the default since only it finds UTF-16 files")
+	archiveDepth       = pflag.Int("archive-depth", 1, "Search the files within tar, .tar.gz and zip archives, opening archives nested within up to this many others; 1 doesn't open archives within archives, and 0 doesn't open archives at all")
+	gitRef             = pflag.String("git-ref", "", "Search the files of this commit, branch or tag of the git repository containing the search path, rather than the files on disk")
+	cacheDir           = pflag.String("cache-dir", "", "Directory in which to remember what was parsed from each file, so that unchanged files aren't parsed again; defaults to omegadoc within the user's cache directory")
+	noCache            = pflag.Bool("no-cache", false, "Parse every file, neither using nor updating the cache of parsed files")
+	debounce           = pflag.Duration("debounce", docwatcher.DefaultDebounce, "With watch, how long to wait after a file changes for further changes before updating the output")
 	helpFlag           = pflag.BoolP("help", "h", false, "Print usage")
 	binName            = filepath.Base(os.Args[0])
 	longDesc           = `OmegaDoc provides one solution to the documentation problems even medium-size
@@ -72,8 +91,9 @@ a file:
 
 func init() {
 	pflag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "\nUsage: %s --input-search-path SEARCHPATH --output-path OUTPUTPATH\n", binName)
+		fmt.Fprintf(os.Stderr, "\nUsage: %s [watch] --input-search-path SEARCHPATH --output-path OUTPUTPATH\n", binName)
 		fmt.Fprintf(os.Stderr, "\nA documentation extraction and collection program.\n")
+		fmt.Fprintf(os.Stderr, "\nWith watch, the input search paths are watched after the OmegaDocs are placed,\nand the output is updated as files change until interrupted.\n")
 		fmt.Fprintf(os.Stderr, "\n%s", longDesc)
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		pflag.PrintDefaults()
@@ -88,44 +108,152 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *scanpath == "" && *outputpath == "" {
+	watch := pflag.NArg() > 0 && pflag.Arg(0) == "watch"
+	if watch && *gitRef != "" {
+		fmt.Fprintf(os.Stderr, "\nError: watch cannot be used with --git-ref\n")
+		os.Exit(1)
+	}
+	if watch && *followSymlinks {
+		fmt.Fprintf(os.Stderr, "\nError: watch cannot be used with --follow-symlinks\n")
+		os.Exit(1)
+	}
+
+	if len(*scanpaths) == 0 && *outputpath == "" {
 		fmt.Fprintf(os.Stderr, "\nError: you must provide at least one of --input-search-path or --output-path\n")
 		pflag.Usage()
 		os.Exit(0)
 	}
 
-	if *scanpath == "" {
-		*scanpath = "./"
-		log.Infof("--input-search-path not provided, defaulting to %s", *scanpath)
+	if len(*scanpaths) == 0 {
+		*scanpaths = []string{"./"}
+		log.Infof("--input-search-path not provided, defaulting to %s", (*scanpaths)[0])
 	}
 	if *outputpath == "" {
 		*outputpath = defaultOmegadocOut
 		log.Infof("--output-path not provided, defaulting to %s", *outputpath)
 	}
 
-	inppath, err := filepath.Abs(*scanpath)
+	roots := []domain.InputRoot{}
+	for _, sp := range *scanpaths {
+		root, err := domain.ParseInputRoot(sp)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		root.Path, err = filepath.Abs(root.Path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		roots = append(roots, root)
+	}
+	outpath, err := filepath.Abs(*outputpath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	outpath, err := filepath.Abs(*outputpath)
+	endings, err := docparser.ParseLineEndings(*lineEndings)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	syntaxes := []domain.MagicSyntax{domain.DefaultMagicSyntax}
+	for _, opening := range *magicSyntaxes {
+		syn, err := domain.ParseMagicSyntax(opening)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		syntaxes = append(syntaxes, syn)
+	}
 	log.SetLevel(log.DebugLevel)
 
-	docfndr := docfinder.NewDocFinder()
-	docprsr := docparser.NewDocParser()
-	docplcr := docplacer.NewDocPlacer()
+	search, err := docfinder.SearchFuncByName(*finderName, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	finderopts := []docfinder.Option{
+		docfinder.WithSearchFunc(search),
+		docfinder.WithMagicSyntaxes(syntaxes...),
+		docfinder.WithExcludes(*excludeGlobs...),
+		docfinder.WithIncludes(*includeGlobs...),
+		docfinder.WithIgnoreFiles(!*noIgnoreFiles),
+		docfinder.WithFollowSymlinks(*followSymlinks),
+		docfinder.WithArchiveDepth(*archiveDepth),
+	}
+	docfndr := docfinder.NewArchiveFinder(finderopts...)
+	if *gitRef != "" {
+		docfndr = docfinder.NewGitRevisionFinder(*gitRef, finderopts...)
+	}
+	parseropts := []docparser.Option{
+		docparser.WithSubstringDelimiters(*substringDelims),
+		docparser.WithLineEndings(endings),
+		docparser.WithMagicSyntaxes(syntaxes...),
+		docparser.WithLanguageAware(*languageAware),
+	}
+	docprsr := docparser.NewDefaultRegistry(parseropts...)
+	for _, mapping := range *parserMappings {
+		ext, name, err := docparser.ParseParserMapping(mapping)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		dp, err := docparser.NewNamedParser(name, parseropts...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		docprsr.RegisterExtension(ext, dp)
+	}
+	// While watching, OmegaDocs are placed again as they change.
+	docplcr := docplacer.NewDocPlacer(docplacer.WithOverwrite(watch))
 	odcc := application.NewController(
 		docfndr,
 		docprsr,
 		postprocess.GetPostprocessors(),
 		docplcr,
 	)
+	if !*noCache {
+		dir := *cacheDir
+		if dir == "" {
+			dir, err = doccache.DefaultDir()
+		}
+		if err == nil {
+			// Anything which changes what's parsed from a file must change
+			// the version of the cache.
+			version := fmt.Sprintf("%s %t %q %q %t %q", docparser.Version, *substringDelims, *lineEndings, *magicSyntaxes, *languageAware, *parserMappings)
+			var cache domain.DocCache
+			cache, err = doccache.NewDocCache(dir, version)
+			if err == nil {
+				odcc = odcc.WithCache(cache)
+			}
+		}
+		if err != nil {
+			log.Warnf("not using a cache of parsed files: %v", err)
+		}
+	}
+
+	if watch {
+		paths := []string{}
+		for _, root := range roots {
+			paths = append(paths, root.Path)
+		}
+		w, err := docwatcher.NewWatcher(paths, docwatcher.WithDebounce(*debounce), docwatcher.WithIgnorePaths(outpath))
+		if err != nil {
+			log.Errorf("Cannot watch the input search paths: %q", err.Error())
+			os.Exit(1)
+		}
+		defer w.Close()
+		err = odcc.WatchOmegaTree(roots, outpath, w.Changes())
+		if err != nil {
+			log.Errorf("Error encountered while watching OmegaDocs: %q", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 
-	err = odcc.GenerateOmegaTree(inppath, outpath)
+	err = odcc.GenerateOmegaTreeFromRoots(roots, outpath)
 	if err != nil {
 		log.Errorf("Error encountered while attempting to generate OmegaDocs: %q", err.Error())
 		os.Exit(1)
@@ -45,7 +45,7 @@ it'd have the following modification:
 	Hello, I should have a URL back to this source document on the line below
 	this one, just down here ↓↓↓↓↓↓↓↓↓
 
-	[Link to this original document: https://github.com/lelandbatey/omegadoc/tree/32bb1a36ee9bd0a5437eb952d6e4cab09125ca47/main.go#L30](https://github.com/lelandbatey/omegadoc/tree/32bb1a36ee9bd0a5437eb952d6e4cab09125ca47/main.go#L30)
+	[Link to this original document: https://github.com/lelandbatey/omegadoc/tree/32bb1a36ee9bd0a5437eb952d6e4cab09125ca47/main.go#L30-L52](https://github.com/lelandbatey/omegadoc/tree/32bb1a36ee9bd0a5437eb952d6e4cab09125ca47/main.go#L30-L52)
 
 This is a very useful addition when your documentation is spread widely across
 a large file structure crossing many repositories, which is the exact case
@@ -55,8 +55,9 @@ necessary changes to documentation.
 DELIMIDENT
 `
 	lines := strings.Split(doc, "\n")
-	// Trim off the in-band beginning and end of this OmegaDoc.
-	return strings.Join(lines[1:len(lines)-1], "\n")
+	// Trim off the in-band beginning and end of this OmegaDoc, along with the
+	// trailing newline after the delimiting identifier.
+	return strings.Join(lines[1:len(lines)-2], "\n")
 }
 
 func (sla SourceLinkAdder) Postprocess(odocs []domain.OmegaDoc) ([]domain.OmegaDoc, error) {
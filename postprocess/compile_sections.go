@@ -84,10 +84,12 @@ OmegaDocs into a single output OmegaDoc which would look like the following:
 	Let's imagine that this is discussing the final pieces of operation of a
 	piece of software and the cleanup which that software does.
 	EOF
-DELIMIDENT`
+DELIMIDENT
+`
 	lines := strings.Split(doc, "\n")
-	// Trim off the in-band beginning and end of this OmegaDoc.
-	return strings.Join(lines[1:len(lines)-1], "\n")
+	// Trim off the in-band beginning and end of this OmegaDoc, along with the
+	// trailing newline after the delimiting identifier.
+	return strings.Join(lines[1:len(lines)-2], "\n")
 }
 
 func getattr(odoc domain.OmegaDoc, key, defval string) string {
@@ -131,6 +133,7 @@ func (sc SectionsCompiler) Postprocess(odocs []domain.OmegaDoc) ([]domain.OmegaD
 		nd := domain.OmegaDoc{}
 		for _, d := range withsections {
 			nd.DestFilePath = d.DestFilePath
+			nd.Root = d.Root
 			nd.Attributes = append(nd.Attributes, d.Attributes...)
 			nd.Contents += d.Contents
 
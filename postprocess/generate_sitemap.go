@@ -30,23 +30,47 @@ func (gsm GenerateSiteMap) Description() string {
 GenerateSiteMap generates a page which links to all OmegaDocs. If there's no
 toplevel 'index.md' document defined then that 'index.md' will be created blank
 by this postprocessor. Then 'index.md' will have the sitemap appended to it.
-DELIMIDENT`
+When several input paths are searched at once, the OmegaDocs of each are
+listed under a heading of their own.
+DELIMIDENT
+`
 	lines := strings.Split(doc, "\n")
-	// Trim off the in-band beginning and end of this OmegaDoc.
-	return strings.Join(lines[1:len(lines)-1], "\n")
+	// Trim off the in-band beginning and end of this OmegaDoc, along with the
+	// trailing newline after the delimiting identifier.
+	return strings.Join(lines[1:len(lines)-2], "\n")
 }
 
 func (gsm GenerateSiteMap) Postprocess(odocs []domain.OmegaDoc) ([]domain.OmegaDoc, error) {
-	root := &node{}
+	// When OmegaDocs were found beneath several input roots, the sitemap of
+	// each root is listed separately, in the order the roots were searched.
+	roots := []*domain.InputRoot{}
+	trees := map[*domain.InputRoot]*node{}
 	for _, d := range odocs {
+		root, ok := trees[d.Root]
+		if !ok {
+			root = &node{}
+			trees[d.Root] = root
+			roots = append(roots, d.Root)
+		}
 		root.Children = AddToTree(root.Children, strings.Split(d.DestFilePath, "/"))
 	}
-	sort.SliceStable(root.Children, func(i, j int) bool {
-		return root.Children[i].Name < root.Children[j].Name
-	})
 	buf := bytes.NewBuffer(nil)
-	for _, c := range root.Children {
-		writeMDSiteMap(buf, c, nil)
+	for i, r := range roots {
+		if len(roots) > 1 {
+			if i > 0 {
+				fmt.Fprintf(buf, "\n")
+			}
+			if r != nil {
+				fmt.Fprintf(buf, "## %s\n\n", r.Name())
+			}
+		}
+		root := trees[r]
+		sort.SliceStable(root.Children, func(i, j int) bool {
+			return root.Children[i].Name < root.Children[j].Name
+		})
+		for _, c := range root.Children {
+			writeMDSiteMap(buf, c, nil)
+		}
 	}
 	var index *domain.OmegaDoc
 	for idx := range odocs {
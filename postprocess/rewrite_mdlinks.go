@@ -3,6 +3,7 @@ package postprocess
 import (
 	"bytes"
 	"io"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -47,10 +48,12 @@ postprocessor:
     |[link](stuff/thing.md)  | [link](stuff/thing.html)         |
     |[word](other.html)      | [word](other.html)               | # No change because original not linking to markdown file
     |[word](path/other.html) | [word](path/other.html)          | # No change because original not linking to markdown file
-DELIMIDENT`
+DELIMIDENT
+`
 	lines := strings.Split(doc, "\n")
-	// Trim off the in-band beginning and end of this OmegaDoc.
-	return strings.Join(lines[1:len(lines)-1], "\n")
+	// Trim off the in-band beginning and end of this OmegaDoc, along with the
+	// trailing newline after the delimiting identifier.
+	return strings.Join(lines[1:len(lines)-2], "\n")
 }
 
 func (mlr MarkdownLinkRewriter) Postprocess(odocs []domain.OmegaDoc) ([]domain.OmegaDoc, error) {
@@ -140,6 +143,11 @@ func (f fakerender) replaceLinks(node ast.Node, entering bool) (ast.WalkStatus,
 			"doc_dest": f.odoc.DestFilePath,
 			"link_url": dest,
 		})
+		// Links are written relative to the root the OmegaDoc came from,
+		// which is beneath the prefix of that root in the tree.
+		if f.odoc.Root != nil && f.odoc.Root.Prefix != "" && !strings.Contains(dest, "://") {
+			dest = path.Join(f.odoc.Root.Prefix, dest)
+		}
 		ndest, err := filepath.Rel(filepath.Dir("/"+f.odoc.DestFilePath), "/"+dest)
 		if err != nil {
 			ndest = dest
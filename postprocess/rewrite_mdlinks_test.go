@@ -37,6 +37,15 @@ func TestMarkdownLinkRewriter(t *testing.T) {
 			odocs:    []domain.OmegaDoc{{Contents: "[foo](zap/bar.md.html)\n"}},
 			expected: "[foo](zap/bar.md.html)\n",
 		},
+		// Links are within the root of the OmegaDoc, beneath its prefix.
+		{
+			odocs: []domain.OmegaDoc{{
+				DestFilePath: "pay/docs/a.md",
+				Root:         &domain.InputRoot{Path: "/src/payments", Prefix: "pay"},
+				Contents:     "[foo](docs/b.md) [bar](index.md)\n",
+			}},
+			expected: "[foo](b.html) [bar](../index.html)\n",
+		},
 	} {
 		newdocs, err := ppr.Postprocess(tst.odocs)
 		require.NoError(t, err, "test #%d", idx)